@@ -10,15 +10,19 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
-
+	"nox-core/pkg/backoff"
 	noxcrypto "nox-core/pkg/crypto"
+	"nox-core/pkg/endpoint"
 	"nox-core/pkg/frame"
+	"nox-core/pkg/keys"
+	"nox-core/pkg/proxy"
 	"nox-core/pkg/tun"
 )
 
@@ -29,7 +33,10 @@ const (
 var sessionID [8]byte
 
 func main() {
-	server := getenv("NOX_SERVER", "208.123.185.235:9000")
+	servers, err := endpoint.Parse(os.Getenv("NOX_SERVER"))
+	if err != nil {
+		log.Fatalf("NOX_SERVER: %v", err)
+	}
 	staticCIDR := getenv("NOX_CLIENT_CIDR", "10.8.0.2/24")
 	tunName := getenv("NOX_TUN", "nox1")
 	reconnect := getenvBool("NOX_RECONNECT", true)
@@ -39,7 +46,19 @@ func main() {
 
 	loadSessionID()
 
-	k, err := loadKey()
+	proxies := make(map[string]*proxy.Proxy)
+	for _, addr := range servers.Addrs() {
+		px, err := proxy.Select(os.Getenv("NOX_PROXY"), addr)
+		if err != nil {
+			log.Fatalf("NOX_PROXY: %v", err)
+		}
+		if px != nil {
+			log.Printf("%s: dialing through proxy %s", addr, px)
+		}
+		proxies[addr] = px
+	}
+
+	k, err := keys.LoadMaster()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -64,6 +83,52 @@ func main() {
 	}
 	defer cleanup()
 
+	statusSig := make(chan os.Signal, 1)
+	signal.Notify(statusSig, syscall.SIGUSR1)
+	go func() {
+		for range statusSig {
+			log.Printf("endpoints: %s", servers.Status())
+		}
+	}()
+
+	// Every NOX_FAILBACK, a client away from its home endpoint checks whether
+	// home accepts connections again and, if so, ends the session to move back.
+	var sessMu sync.Mutex
+	var endSession context.CancelFunc
+	var moving atomic.Bool
+	failback := 5 * time.Minute
+	if v := os.Getenv("NOX_FAILBACK"); v != "" {
+		if failback, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("parse NOX_FAILBACK: %v", err)
+		}
+	}
+	if servers.Len() > 1 && failback > 0 {
+		go func() {
+			for range time.Tick(failback) {
+				home := servers.Failback()
+				if home == nil {
+					continue
+				}
+				conn, err := proxies[home.Addr].Dial(&net.Dialer{Timeout: 5 * time.Second}, home.Addr)
+				if err != nil {
+					log.Printf("home endpoint %s still unreachable: %v", home.Addr, err)
+					servers.Failed(home)
+					continue
+				}
+				conn.Close()
+				log.Printf("home endpoint %s is back, moving to it", home.Addr)
+				moving.Store(true)
+				sessMu.Lock()
+				if endSession != nil {
+					endSession()
+				}
+				sessMu.Unlock()
+			}
+		}()
+	}
+
+	retry := backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+	short := backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
 	for {
 		tunMu.Lock()
 		if clientTUN == nil {
@@ -74,33 +139,69 @@ func main() {
 				if !reconnect {
 					return
 				}
-				time.Sleep(2 * time.Second)
+				time.Sleep(retry.Next())
 				continue
 			}
 			log.Println("client TUN", tunName, "ready")
 		}
 		curTUN := clientTUN
 		tunMu.Unlock()
+		retry.Reset()
 
-		if err := runOnce(server, staticCIDR, tunName, curTUN, ciph); err != nil {
-			log.Println("run:", err)
+		ep, wait := servers.Next()
+		if wait > 0 {
+			log.Printf("all endpoints failing; retrying %s in %s", ep.Addr, wait.Round(time.Millisecond))
+			time.Sleep(wait)
 		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sessMu.Lock()
+		endSession = cancel
+		sessMu.Unlock()
+		started := time.Now()
+		err := runOnce(ctx, ep.Addr, proxies[ep.Addr], staticCIDR, tunName, curTUN, ciph)
+		if err != nil {
+			log.Printf("run %s: %v", ep.Addr, err)
+		}
+		cancel()
 
 		if !reconnect {
 			return
 		}
-		time.Sleep(2 * time.Second)
+		// Only failing to connect counts against the endpoint. A session
+		// that stayed up for a while marks it healthy; one that ended
+		// sooner, e.g. closed by the server or cut by a network change, is
+		// retried after a growing pause.
+		var connectErr *connectError
+		switch {
+		case moving.Swap(false):
+		case errors.As(err, &connectErr):
+			servers.Failed(ep)
+		case time.Since(started) > time.Minute:
+			servers.Succeeded(ep)
+			short.Reset()
+		default:
+			time.Sleep(short.Next())
+		}
 	}
 }
 
-func runOnce(server, staticCIDR, tunName string, t *tun.Tun, ciph *noxcrypto.Cipher) error {
-	conn, err := net.DialTimeout("tcp", server, 8*time.Second)
+// connectError is a runOnce failure before the session was up: dialing or
+// sending HELLO failed.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string { return e.err.Error() }
+func (e *connectError) Unwrap() error { return e.err }
+
+func runOnce(parent context.Context, server string, px *proxy.Proxy, staticCIDR, tunName string, t *tun.Tun, ciph *noxcrypto.Cipher) error {
+	conn, err := px.Dial(&net.Dialer{Timeout: 8 * time.Second}, server)
 	if err != nil {
-		return err
+		return &connectError{err}
 	}
 	defer conn.Close()
 
-	log.Println("connected to server")
+	log.Println("connected to", server)
 
 	assigned := staticCIDR
 
@@ -112,7 +213,7 @@ func runOnce(server, staticCIDR, tunName string, t *tun.Tun, ciph *noxcrypto.Cip
 		Flags:    0,
 		Payload:  helloPayload,
 	}); err != nil {
-		return err
+		return &connectError{err}
 	}
 
 	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
@@ -191,7 +292,8 @@ func runOnce(server, staticCIDR, tunName string, t *tun.Tun, ciph *noxcrypto.Cip
 		}
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
 	go func() {
 		<-kaDone
 		cancel()
@@ -237,30 +339,6 @@ func runOnce(server, staticCIDR, tunName string, t *tun.Tun, ciph *noxcrypto.Cip
 	}
 }
 
-func loadKey() ([]byte, error) {
-	keyHex := strings.TrimSpace(os.Getenv("NOX_KEY_HEX"))
-	if keyHex == "" {
-		if path := strings.TrimSpace(os.Getenv("NOX_KEY_FILE")); path != "" {
-			raw, err := os.ReadFile(path)
-			if err != nil {
-				return nil, fmt.Errorf("read NOX_KEY_FILE: %w", err)
-			}
-			keyHex = strings.TrimSpace(string(raw))
-		}
-	}
-	if keyHex == "" {
-		return nil, errors.New("NOX_KEY_HEX required (or set NOX_KEY_FILE)")
-	}
-	k, err := hex.DecodeString(keyHex)
-	if err != nil {
-		return nil, fmt.Errorf("decode NOX_KEY_HEX: %w", err)
-	}
-	if len(k) != chacha20poly1305.KeySize {
-		return nil, fmt.Errorf("NOX_KEY_HEX must be %d bytes", chacha20poly1305.KeySize)
-	}
-	return k, nil
-}
-
 func cleanupTUN(name string) {
 	_ = exec.Command("ip", "link", "del", name).Run()
 	_ = exec.Command("ip", "tuntap", "del", "dev", name, "mode", "tun").Run()
@@ -16,12 +16,11 @@ import (
 	"syscall"
 	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
-
 	"nox-core/internal/server"
 	ipam "nox-core/internal/server"
 	noxcrypto "nox-core/pkg/crypto"
 	"nox-core/pkg/frame"
+	"nox-core/pkg/keys"
 	"nox-core/pkg/tun"
 )
 
@@ -45,7 +44,7 @@ func main() {
 	handshakeBurst := getenvInt("NOX_HANDSHAKE_BURST", defaultHandshakeBurst)
 	maxClients := getenvInt("NOX_MAX_CLIENTS", defaultMaxClients)
 
-	k, err := loadKey()
+	k, err := keys.LoadMaster()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -315,30 +314,6 @@ func getenvInt(k string, def int) int {
 	return n
 }
 
-func loadKey() ([]byte, error) {
-	keyHex := strings.TrimSpace(os.Getenv("NOX_KEY_HEX"))
-	if keyHex == "" {
-		if path := strings.TrimSpace(os.Getenv("NOX_KEY_FILE")); path != "" {
-			raw, err := os.ReadFile(path)
-			if err != nil {
-				return nil, fmt.Errorf("read NOX_KEY_FILE: %w", err)
-			}
-			keyHex = strings.TrimSpace(string(raw))
-		}
-	}
-	if keyHex == "" {
-		return nil, fmt.Errorf("NOX_KEY_HEX required (or set NOX_KEY_FILE)")
-	}
-	k, err := hex.DecodeString(keyHex)
-	if err != nil {
-		return nil, fmt.Errorf("decode NOX_KEY_HEX: %w", err)
-	}
-	if len(k) != chacha20poly1305.KeySize {
-		return nil, fmt.Errorf("NOX_KEY_HEX must be %d bytes", chacha20poly1305.KeySize)
-	}
-	return k, nil
-}
-
 func setupServerTUN(name, cidr string) error {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"nox-core/pkg/keys"
+	"nox-core/v2/transport"
+)
+
+const usage = `usage: noxctl <command> [flags] [args]
+
+commands:
+  keygen -out PATH [-master] [-force]   generate an X25519 key pair (PATH and its .pub)
+                                        or, with -master, a hex v1 master key
+  pubkey [-out PATH] PRIVATE_KEY        print (or write) the X25519 public key
+  fingerprint [-private] KEY            print the short fingerprint of a public key
+  rotate [-grace 24h] PRIVATE_KEY       replace a server key, keeping the old one
+                                        accepted for the grace period
+  tlspin CERT                           print the pins of a PEM certificate for the
+                                        pin= option of tls:// and wss:// addresses
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "keygen":
+		err = keygen(args)
+	case "pubkey":
+		err = pubkey(args)
+	case "fingerprint":
+		err = fingerprint(args)
+	case "rotate":
+		err = rotate(args)
+	case "tlspin":
+		err = tlspin(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("noxctl %s: %v", cmd, err)
+	}
+}
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "", "private key path")
+	master := fs.Bool("master", false, "generate a v1 master key (hex) instead of an X25519 pair")
+	force := fs.Bool("force", false, "overwrite existing files")
+	fs.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("-out required")
+	}
+	if *master {
+		k, err := keys.NewMaster()
+		if err != nil {
+			return err
+		}
+		if err := keys.WriteFile(*out, []byte(hex.EncodeToString(k)+"\n"), keys.PrivateMode, *force); err != nil {
+			return err
+		}
+		fmt.Printf("wrote master key %s (use as NOX_KEY_FILE)\n", *out)
+		return nil
+	}
+	priv, pub, err := keys.NewKeyPair()
+	if err != nil {
+		return err
+	}
+	if err := keys.WriteFile(*out, priv, keys.PrivateMode, *force); err != nil {
+		return err
+	}
+	pubPath := keys.PublicPath(*out)
+	if err := keys.WriteFile(pubPath, pub, keys.PublicMode, *force); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s\npublic key  %x\nfingerprint %s\n", *out, pubPath, pub, keys.Fingerprint(pub))
+	return nil
+}
+
+func pubkey(args []string) error {
+	fs := flag.NewFlagSet("pubkey", flag.ExitOnError)
+	out := fs.String("out", "", "write the raw public key here instead of printing it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected PRIVATE_KEY")
+	}
+	priv, err := keys.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	pub, err := keys.Public(priv)
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		return keys.WriteFile(*out, pub, keys.PublicMode, true)
+	}
+	fmt.Printf("%x\n", pub)
+	return nil
+}
+
+func fingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	private := fs.Bool("private", false, "KEY is a private key; fingerprint its public key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected KEY")
+	}
+	k, err := keys.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *private {
+		if k, err = keys.Public(k); err != nil {
+			return err
+		}
+	}
+	fmt.Println(keys.Fingerprint(k))
+	return nil
+}
+
+func rotate(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	grace := fs.Duration("grace", 24*time.Hour, "how long the previous key stays accepted")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected PRIVATE_KEY")
+	}
+	path := fs.Arg(0)
+	pub, err := keys.Rotate(path, *grace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rotated %s; previous key kept in %s until %s\nnew public key %x\nfingerprint    %s\n",
+		path, keys.PreviousPath(path), time.Now().Add(*grace).UTC().Format(time.RFC3339), pub, keys.Fingerprint(pub))
+	fmt.Println("distribute the new public key to clients and restart the server")
+	return nil
+}
+
+func tlspin(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected CERT")
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s: no PEM certificate", args[0])
+	}
+	pins, err := transport.CertPins(block.Bytes)
+	if err != nil {
+		return err
+	}
+	for _, p := range pins {
+		fmt.Println(p)
+	}
+	return nil
+}
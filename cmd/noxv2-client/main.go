@@ -3,22 +3,43 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"nox-core/pkg/backoff"
+	"nox-core/pkg/endpoint"
+	"nox-core/pkg/keys"
+	"nox-core/pkg/proxy"
+	"nox-core/v2/batch"
 	"nox-core/v2/client"
+	"nox-core/v2/crypto"
 	"nox-core/v2/transport"
 )
 
 func main() {
-	keyHex := os.Getenv("NOX_KEY_HEX")
 	serverAddr := os.Getenv("NOX_SERVER")
-	if keyHex == "" || serverAddr == "" {
-		log.Fatal("NOX_KEY_HEX and NOX_SERVER required")
+	if serverAddr == "" {
+		log.Fatal("NOX_SERVER required")
 	}
-	key, err := hex.DecodeString(keyHex)
-	if err != nil || len(key) != 32 {
-		log.Fatalf("invalid NOX_KEY_HEX")
+	key, err := keys.ReadFile(envOr("NOX_PRIVATE_KEY", "keys/client.key"))
+	if err != nil {
+		log.Fatalf("load NOX_PRIVATE_KEY: %v", err)
+	}
+	serverKey, err := keys.ReadFile(envOr("NOX_SERVER_PUB", "keys/server.pub"))
+	if err != nil {
+		log.Fatalf("load NOX_SERVER_PUB: %v", err)
+	}
+	suites, err := crypto.ParseSuites(os.Getenv("NOX_SUITES"))
+	if err != nil {
+		log.Fatal(err)
 	}
 	var sessionID [8]byte
 	if sid := os.Getenv("NOX_SESSION_ID"); sid != "" {
@@ -29,15 +50,166 @@ func main() {
 	} else {
 		rand.Read(sessionID[:])
 	}
-	opts := client.Options{Key: key, Session: sessionID, Server: serverAddr, MTU: 1400, TunName: envOr("NOX_TUN", "nox1")}
+	var replayWindow uint64
+	if v := os.Getenv("NOX_REPLAY_WINDOW"); v != "" {
+		if replayWindow, err = strconv.ParseUint(v, 10, 64); err != nil {
+			log.Fatalf("parse NOX_REPLAY_WINDOW: %v", err)
+		}
+	}
+	links := 1
+	if v := os.Getenv("NOX_LINKS"); v != "" {
+		if links, err = strconv.Atoi(v); err != nil || links < 1 {
+			log.Fatalf("NOX_LINKS must be a positive number")
+		}
+	}
+	var sources []string
+	if v := os.Getenv("NOX_SOURCES"); v != "" {
+		sources = strings.Split(v, ",")
+	}
+	// NOX_BATCH_DELAY is how long a batch of packets waits for more; "off"
+	// disables batching.
+	var batchDelay time.Duration
+	if v := os.Getenv("NOX_BATCH_DELAY"); v == "off" {
+		batchDelay = -1
+	} else if v != "" {
+		if batchDelay, err = time.ParseDuration(v); err != nil || batchDelay < 0 {
+			log.Fatalf("NOX_BATCH_DELAY must be a duration or off")
+		}
+	}
+	// NOX_OFFLOAD=1 opens the TUN with TSO/USO so large TCP and UDP sends
+	// cross the tunnel as one superpacket.
+	offloads := os.Getenv("NOX_OFFLOAD") == "1"
+	servers, err := endpoint.Parse(serverAddr)
+	if err != nil {
+		log.Fatalf("NOX_SERVER: %v", err)
+	}
+	routes := make(map[string]route)
+	for _, a := range servers.Addrs() {
+		if routes[a], err = resolve(a); err != nil {
+			log.Fatalf("NOX_SERVER %s: %v", a, err)
+		}
+	}
+	opts := client.Options{PrivateKey: key, ServerKey: serverKey, Session: sessionID, MTU: 1400, TunName: envOr("NOX_TUN", "nox1"), Suites: suites, ReplayWindow: replayWindow, Links: links, Sources: sources, BatchDelay: batchDelay, Offload: offloads}
 	c, err := client.New(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("connecting to %s with session %x", serverAddr, sessionID)
-	if err := c.Run(transport.TCPDialer{}); err != nil {
-		log.Fatal(err)
+
+	statusSig := make(chan os.Signal, 1)
+	signal.Notify(statusSig, syscall.SIGUSR1)
+	go func() {
+		for range statusSig {
+			log.Printf("endpoints: %s", servers.Status())
+			if tx, rx := c.BatchSizes(); tx != (batch.Sizes{}) || rx != (batch.Sizes{}) {
+				log.Printf("packets per record tx %s, rx %s", tx, rx)
+			}
+		}
+	}()
+	failback := 5 * time.Minute
+	if v := os.Getenv("NOX_FAILBACK"); v != "" {
+		if failback, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("parse NOX_FAILBACK: %v", err)
+		}
+	}
+	// moving is set when the session is dropped on purpose to return home.
+	var moving atomic.Bool
+	if servers.Len() > 1 && failback > 0 {
+		go func() {
+			for range time.Tick(failback) {
+				home := servers.Failback()
+				if home == nil {
+					continue
+				}
+				r := routes[home.Addr]
+				if err := client.Probe(r.dialer, r.addr, 5*time.Second); err != nil {
+					log.Printf("home endpoint %s still unreachable: %v", home.Addr, err)
+					servers.Failed(home)
+					continue
+				}
+				log.Printf("home endpoint %s is back, moving to it", home.Addr)
+				moving.Store(true)
+				c.Disconnect()
+			}
+		}()
+	}
+
+	// Reconnects reuse the client so its resumption ticket and TUN survive.
+	once := os.Getenv("NOX_RECONNECT") == "0"
+	// Sessions that come up but end soon are retried after a growing pause.
+	short := backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+	for {
+		ep, wait := servers.Next()
+		if wait > 0 {
+			log.Printf("all endpoints failing; retrying %s in %s", ep.Addr, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+		}
+		r := routes[ep.Addr]
+		log.Printf("connecting to %s with session %x", ep.Addr, sessionID)
+		started := time.Now()
+		err := c.Run(r.dialer, r.addr)
+		if once {
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		log.Printf("session with %s ended: %v", ep.Addr, err)
+		// Only dial and handshake errors count against the endpoint. A
+		// session that came up may still end early for reasons that say
+		// nothing about the server's health: CLOSE, revocation, a reload or
+		// a change of local network.
+		var connectErr *client.ConnectError
+		switch {
+		case moving.Swap(false):
+		case errors.As(err, &connectErr):
+			servers.Failed(ep)
+		case time.Since(started) > time.Minute:
+			servers.Succeeded(ep)
+			short.Reset()
+		default:
+			time.Sleep(short.Next())
+		}
+	}
+}
+
+// route is how to reach one server endpoint.
+type route struct {
+	dialer transport.Dialer
+	addr   string
+}
+
+// resolve picks the transport for a NOX_SERVER entry and applies NOX_PROXY
+// or the *_PROXY environment. An explicit NOX_PROXY must apply; one from the
+// environment is skipped by transports that cannot be proxied.
+func resolve(address string) (route, error) {
+	dialer, addr, err := transport.Resolve(address)
+	if err != nil {
+		return route{}, err
+	}
+	setting := os.Getenv("NOX_PROXY")
+	px, err := proxy.Select(setting, hostPort(addr))
+	if err != nil {
+		return route{}, fmt.Errorf("NOX_PROXY: %w", err)
+	}
+	if d, err := transport.WithProxy(dialer, px); err == nil {
+		dialer = d
+		if px != nil {
+			log.Printf("%s: dialing through proxy %s", address, px)
+		}
+	} else if setting != "" {
+		return route{}, err
+	} else {
+		log.Printf("%s: %v; dialing directly", address, err)
+	}
+	return route{dialer: dialer, addr: addr}, nil
+}
+
+// hostPort strips the path and options from a transport address.
+func hostPort(addr string) string {
+	if i := strings.IndexAny(addr, "/?"); i >= 0 {
+		return addr[:i]
 	}
+	return addr
 }
 
 func envOr(k, def string) string {
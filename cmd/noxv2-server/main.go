@@ -1,47 +1,176 @@
 package main
 
 import (
-	"encoding/hex"
 	"flag"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"nox-core/pkg/keys"
+	"nox-core/v2/crypto"
+	"nox-core/v2/padding"
+	"nox-core/v2/registry"
+	"nox-core/v2/replay"
 	"nox-core/v2/server"
 	"nox-core/v2/transport"
 )
 
 func main() {
+	// Comma-separated scheme://addr list, e.g. "tcp://:9000,udp://:9000".
 	listen := envOr("NOX_LISTEN", ":9000")
 	subnetStr := envOr("NOX_SUBNET", "10.8.0.0/24")
-	keyHex := os.Getenv("NOX_KEY_HEX")
-	if keyHex == "" {
-		log.Fatal("NOX_KEY_HEX required")
-	}
-	key, err := hex.DecodeString(keyHex)
-	if err != nil || len(key) != 32 {
-		log.Fatalf("invalid NOX_KEY_HEX")
-	}
+	keyPath := envOr("NOX_PRIVATE_KEY", "keys/server.key")
+	peersPath := envOr("NOX_PEERS", "keys/peers")
+	revokedPath := envOr("NOX_REVOKED", "keys/revoked")
 	oneshotMTU := flag.Int("mtu", 1400, "server MTU")
+	rekeyInterval := flag.Duration("rekey-interval", 10*time.Minute, "rekey sessions after this long")
+	rekeyBytes := flag.Uint64("rekey-bytes", 1<<30, "rekey sessions after this many bytes")
+	cookieLoad := flag.Int("cookie-load", 32, "in-flight handshakes above which HELLO must echo a cookie")
+	requireCookie := flag.Bool("require-cookie", false, "always demand a cookie round trip")
+	replayWindow := flag.Uint64("replay-window", replay.DefaultSize, "replay window in packets (max 8192)")
+	padPolicy := flag.String("padding", "off", "data padding for clients that support it: off, random (up to the MTU) or bucket sizes, e.g. 256,512,1024,1400")
+	ticketLifetime := flag.Duration("ticket-lifetime", 12*time.Hour, "validity of session resumption tickets; 0 disables resumption")
+	sendQueue := flag.Int("send-queue", 256, "data records buffered per session before dropping")
+	dropPolicy := flag.String("drop-policy", "tail", "what a full send queue discards: tail (the new packet) or oldest")
+	tunQueues := flag.Int("tun-queues", 1, "nox0 queues, each read by its own worker; use about one per core")
+	batching := flag.Bool("batch", true, "let clients that support it coalesce several packets into one record")
+	batchDelay := flag.Duration("batch-delay", 0, "how long a batch waits for more packets; 0 sends what is already queued")
+	offloads := flag.Bool("offload", false, "open nox0 with TSO/USO and carry superpackets to clients that support it")
+	suiteList := flag.String("suites", "", "data cipher suites in preference order (default: AES-GCM first if hardware-accelerated)")
 	flag.Parse()
 
+	key, err := keys.ReadFile(keyPath)
+	if err != nil {
+		log.Fatalf("load NOX_PRIVATE_KEY: %v", err)
+	}
+	var prev keys.Retired
+	if r, err := keys.ReadRetired(keys.PreviousPath(keyPath)); err == nil && time.Now().Before(r.NotAfter) {
+		prev = r
+		log.Printf("previous server key accepted until %s", r.NotAfter.Format(time.RFC3339))
+	}
+	peers, err := registry.Load(peersPath)
+	if err != nil {
+		log.Fatalf("load NOX_PEERS: %v", err)
+	}
+	revoked, err := registry.LoadRevocations(revokedPath)
+	if err != nil {
+		log.Fatalf("load NOX_REVOKED: %v", err)
+	}
+
+	suites, err := crypto.ParseSuites(*suiteList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pad, err := padding.Parse(*padPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	_, subnet, err := net.ParseCIDR(subnetStr)
 	if err != nil {
 		log.Fatalf("parse subnet: %v", err)
 	}
 
-	srv, err := server.New(server.Options{Key: key, Subnet: subnet, MTU: *oneshotMTU})
+	drop, err := server.ParseDropPolicy(*dropPolicy)
 	if err != nil {
 		log.Fatal(err)
 	}
-	ln, err := transport.ListenTCP(listen)
+	if *ticketLifetime == 0 {
+		*ticketLifetime = -1
+	}
+	if !*batching {
+		*batchDelay = -1
+	}
+	srv, err := server.New(server.Options{
+		PrivateKey:     key,
+		PreviousKey:    prev.Key,
+		PreviousUntil:  prev.NotAfter,
+		Peers:          peers,
+		Revoked:        revoked,
+		Subnet:         subnet,
+		MTU:            *oneshotMTU,
+		RekeyInterval:  *rekeyInterval,
+		RekeyBytes:     *rekeyBytes,
+		CookieLoad:     *cookieLoad,
+		RequireCookie:  *requireCookie,
+		Suites:         suites,
+		ReplayWindow:   *replayWindow,
+		Padding:        pad,
+		TicketLifetime: *ticketLifetime,
+		SendQueue:      *sendQueue,
+		DropPolicy:     drop,
+		TunQueues:      *tunQueues,
+		BatchDelay:     *batchDelay,
+		Offload:        *offloads,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("NOX v2 server listening on %s", listen)
-	if err := srv.Serve(ln); err != nil {
-		log.Fatal(err)
+	var listeners []transport.Listener
+	for _, addr := range strings.Split(listen, ",") {
+		ln, err := transport.Listen(strings.TrimSpace(addr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	go reloadOnHUP(srv, peersPath, revokedPath)
+	go dumpStatsOnUSR1(srv)
+	log.Printf("NOX v2 server listening on %s (public key %x, %d peers)", listen, srv.PublicKey(), peers.Len())
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln transport.Listener) { errc <- srv.Serve(ln) }(ln)
+	}
+	log.Fatal(<-errc)
+}
+
+func reloadOnHUP(srv *server.Server, peersPath, revokedPath string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if n, err := srv.ReloadPeers(); err != nil {
+			log.Printf("reload %s: %v", peersPath, err)
+		} else {
+			log.Printf("reloaded peers from %s, closed %d sessions", peersPath, n)
+		}
+		n, err := srv.ReloadRevocations()
+		if err != nil {
+			log.Printf("reload %s: %v", revokedPath, err)
+			continue
+		}
+		log.Printf("reloaded revocations from %s, closed %d sessions", revokedPath, n)
+	}
+}
+
+func dumpStatsOnUSR1(srv *server.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		stats := srv.Stats()
+		log.Printf("%d live sessions", len(stats))
+		for _, st := range stats {
+			log.Printf("  %s %x %s links=%d queue=%d drops=%d epoch=%d rekeys=%d tx=%d/%dB rx=%d/%dB total tx=%dB rx=%dB soft=%v refused=%d dup=%d old=%d authfail=%d pad tx=%dB (%.1f%%) rx=%dB",
+				st.Peer, st.Session, st.IP, st.Links, st.Queued, st.Dropped, st.Epoch, st.Rekeys, st.TxPackets, st.TxBytes, st.RxPackets, st.RxBytes,
+				st.TxTotal, st.RxTotal, st.SoftLimit, st.Refused, st.Duplicates, st.TooOld, st.AuthFailures,
+				st.TxPadding, overhead(st.TxPadding, st.TxTotal), st.RxPadding)
+			if st.Batched {
+				log.Printf("    packets per record tx %s, rx %s", st.TxBatches, st.RxBatches)
+			}
+		}
+	}
+}
+
+// overhead is padding as a percentage of the payload it was added to.
+func overhead(pad, payload uint64) float64 {
+	if payload == 0 {
+		return 0
 	}
+	return 100 * float64(pad) / float64(payload)
 }
 
 func envOr(k, def string) string {
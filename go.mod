@@ -3,9 +3,18 @@ module nox-core
 go 1.24.0
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/quic-go/quic-go v0.54.1
 	github.com/vishvananda/netlink v1.3.0
 	golang.org/x/crypto v0.38.0
 	golang.org/x/sys v0.38.0
 )
 
-require github.com/vishvananda/netns v0.0.4 // indirect
+require (
+	github.com/vishvananda/netns v0.0.4 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,42 @@
+// Package backoff computes reconnect delays: exponential growth from Min to
+// Max with full jitter on the upper half, so clients restarted together do
+// not reconnect in lockstep.
+package backoff
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff is not safe for concurrent use.
+type Backoff struct {
+	Min time.Duration // first delay, default 500ms
+	Max time.Duration // delay cap, default 30s
+
+	n int
+}
+
+// Next returns the delay before the next attempt and advances the sequence.
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = 500 * time.Millisecond
+	}
+	if max < min {
+		max = 30 * time.Second
+		if max < min {
+			max = min
+		}
+	}
+	d := max
+	if b.n < 32 && min<<b.n < max {
+		d = min << b.n
+	}
+	b.n++
+	// Pick uniformly from [d/2, d].
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// Reset restarts the sequence from Min, e.g. after a long-lived connection.
+func (b *Backoff) Reset() { b.n = 0 }
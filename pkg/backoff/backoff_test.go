@@ -0,0 +1,30 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGrowthAndCap(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	for i, ceil := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ceil *= time.Millisecond
+		d := b.Next()
+		if d < ceil/2 || d > ceil {
+			t.Fatalf("attempt %d: %v outside [%v, %v]", i, d, ceil/2, ceil)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d > 100*time.Millisecond {
+		t.Fatalf("after reset: %v", d)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var b Backoff
+	for i := 0; i < 100; i++ {
+		if d := b.Next(); d <= 0 || d > 30*time.Second {
+			t.Fatalf("attempt %d: %v", i, d)
+		}
+	}
+}
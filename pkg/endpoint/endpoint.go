@@ -0,0 +1,198 @@
+// Package endpoint chooses which server a client connects to. Each endpoint
+// keeps a failure score; a failed endpoint is skipped for a backoff period
+// that grows with its score, and the client returns to its home endpoint
+// once that is healthy again.
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nox-core/pkg/backoff"
+)
+
+// Endpoint is one server address.
+type Endpoint struct {
+	Addr   string
+	Weight int // relative share in weighted lists; 0 in ordered lists
+
+	failures  int
+	retry     backoff.Backoff
+	notBefore time.Time
+}
+
+// List is an ordered or weighted set of endpoints. In an ordered list the
+// home endpoint is the first one and failover walks the list in order. In a
+// weighted list home is drawn by weight, so clients spread over the servers,
+// and failover draws again among the healthy ones.
+type List struct {
+	mu       sync.Mutex
+	eps      []*Endpoint
+	weighted bool
+	home     *Endpoint
+	current  *Endpoint
+	now      func() time.Time
+}
+
+// Parse reads a comma-separated list of addresses. An address may end in
+// "*weight", e.g. "a.example:9000*3,b.example:9000*1"; then every entry
+// needs one and the list is weighted.
+func Parse(s string) (*List, error) {
+	l := &List{now: time.Now}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		ep := &Endpoint{Addr: f, retry: backoff.Backoff{Min: time.Second, Max: 30 * time.Second}}
+		if i := strings.LastIndexByte(f, '*'); i >= 0 {
+			w, err := strconv.Atoi(f[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("endpoint %q: bad weight", f)
+			}
+			ep.Addr, ep.Weight = f[:i], w
+		}
+		l.eps = append(l.eps, ep)
+	}
+	if len(l.eps) == 0 {
+		return nil, errors.New("no server endpoints")
+	}
+	l.weighted = l.eps[0].Weight > 0
+	for _, ep := range l.eps {
+		if (ep.Weight > 0) != l.weighted {
+			return nil, errors.New("endpoints: give a weight for all or none")
+		}
+	}
+	l.home = l.eps[0]
+	if l.weighted {
+		l.home = pick(l.eps)
+	}
+	return l, nil
+}
+
+// pick draws from eps by weight, scaled down by each one's failure score.
+func pick(eps []*Endpoint) *Endpoint {
+	var total float64
+	for _, ep := range eps {
+		total += float64(ep.Weight) / float64(1+ep.failures)
+	}
+	r := rand.Float64() * total
+	for _, ep := range eps {
+		if r -= float64(ep.Weight) / float64(1+ep.failures); r < 0 {
+			return ep
+		}
+	}
+	return eps[len(eps)-1]
+}
+
+// Next returns the endpoint to try now, or, when every endpoint is backing
+// off, the one that recovers first and how long to wait for it.
+func (l *List) Next() (*Endpoint, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var ready []*Endpoint
+	for _, ep := range l.eps {
+		if !now.Before(ep.notBefore) {
+			ready = append(ready, ep)
+		}
+	}
+	switch {
+	case len(ready) == 0:
+		first := l.eps[0]
+		for _, ep := range l.eps[1:] {
+			if ep.notBefore.Before(first.notBefore) {
+				first = ep
+			}
+		}
+		l.current = first
+		return first, first.notBefore.Sub(now)
+	case !now.Before(l.home.notBefore):
+		l.current = l.home
+	case l.weighted:
+		l.current = pick(ready)
+	default:
+		l.current = ready[0]
+	}
+	return l.current, 0
+}
+
+// Failed raises ep's failure score and backs it off.
+func (l *List) Failed(ep *Endpoint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ep.failures++
+	ep.notBefore = l.now().Add(ep.retry.Next())
+}
+
+// Succeeded clears ep's failure score.
+func (l *List) Succeeded(ep *Endpoint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ep.failures = 0
+	ep.retry.Reset()
+	ep.notBefore = time.Time{}
+}
+
+// Failback returns the home endpoint when another one is in use and home is
+// not backing off, so the caller can probe it and move back.
+func (l *List) Failback() *Endpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil || l.current == l.home || l.now().Before(l.home.notBefore) {
+		return nil
+	}
+	return l.home
+}
+
+// Len returns the number of endpoints.
+func (l *List) Len() int {
+	return len(l.eps)
+}
+
+// Addrs returns the endpoint addresses in list order.
+func (l *List) Addrs() []string {
+	out := make([]string, len(l.eps))
+	for i, ep := range l.eps {
+		out[i] = ep.Addr
+	}
+	return out
+}
+
+// Status describes every endpoint: which is home, which is in use, and the
+// failure score and remaining backoff of the others.
+func (l *List) Status() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	parts := make([]string, 0, len(l.eps))
+	for _, ep := range l.eps {
+		var tags []string
+		if ep == l.current {
+			tags = append(tags, "in use")
+		}
+		if ep == l.home && len(l.eps) > 1 {
+			tags = append(tags, "home")
+		}
+		if ep.Weight > 0 {
+			tags = append(tags, "weight="+strconv.Itoa(ep.Weight))
+		}
+		if ep.failures > 0 {
+			tags = append(tags, "failures="+strconv.Itoa(ep.failures))
+		}
+		if d := ep.notBefore.Sub(now); d > 0 {
+			tags = append(tags, "retry in "+d.Round(time.Second).String())
+		}
+		s := ep.Addr
+		if len(tags) > 0 {
+			s += " (" + strings.Join(tags, ", ") + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, "; ")
+}
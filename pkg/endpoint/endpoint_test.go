@@ -0,0 +1,81 @@
+package endpoint
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	l, err := Parse("a:9000, tls://b:443?sni=x.example")
+	if err != nil || l.Len() != 2 || l.weighted || l.eps[1].Addr != "tls://b:443?sni=x.example" {
+		t.Fatalf("ordered: %+v %v", l, err)
+	}
+	l, err = Parse("a:9000*3,b:9000*1")
+	if err != nil || !l.weighted || l.eps[0].Weight != 3 || l.eps[0].Addr != "a:9000" {
+		t.Fatalf("weighted: %+v %v", l, err)
+	}
+	for _, bad := range []string{"", " , ", "a:1*0", "a:1*x", "a:1*2,b:1"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("Parse(%q) accepted", bad)
+		}
+	}
+}
+
+func TestFailoverAndFailback(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l, _ := Parse("a:1,b:1,c:1")
+	l.now = func() time.Time { return now }
+
+	ep, wait := l.Next()
+	if ep.Addr != "a:1" || wait != 0 || l.Failback() != nil {
+		t.Fatalf("first: %s %v", ep.Addr, wait)
+	}
+	l.Failed(ep)
+	if ep, _ = l.Next(); ep.Addr != "b:1" {
+		t.Fatalf("failover to %s", ep.Addr)
+	}
+	if l.Failback() != nil {
+		t.Fatal("failback while home backs off")
+	}
+	if !strings.Contains(l.Status(), "b:1 (in use)") || !strings.Contains(l.Status(), "failures=1") {
+		t.Fatalf("status %q", l.Status())
+	}
+
+	l.Failed(l.eps[1])
+	l.Failed(l.eps[2])
+	l.Failed(l.eps[2])
+	ep, wait = l.Next()
+	if wait <= 0 {
+		t.Fatalf("all backing off but no wait: %s", ep.Addr)
+	}
+
+	now = now.Add(time.Hour)
+	if ep, _ = l.Next(); ep.Addr != "a:1" {
+		t.Fatalf("home not preferred once healthy: %s", ep.Addr)
+	}
+	l.Succeeded(ep)
+	if l.eps[0].failures != 0 {
+		t.Fatal("success kept the failure score")
+	}
+
+	// On another endpoint with home healthy again, Failback names home.
+	l.Failed(l.eps[0])
+	l.Next()
+	now = now.Add(time.Hour)
+	if h := l.Failback(); h == nil || h.Addr != "a:1" {
+		t.Fatalf("failback: %v", h)
+	}
+}
+
+func TestWeightedSpread(t *testing.T) {
+	homes := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		l, _ := Parse("a:1*9,b:1*1")
+		ep, _ := l.Next()
+		homes[ep.Addr]++
+	}
+	if homes["a:1"] < 800 || homes["b:1"] < 30 {
+		t.Fatalf("home spread %v", homes)
+	}
+}
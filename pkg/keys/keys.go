@@ -0,0 +1,202 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Size is the length of every NOX key: master keys, X25519 private and public keys.
+const Size = 32
+
+// File modes for key material.
+const (
+	PrivateMode os.FileMode = 0o600
+	PublicMode  os.FileMode = 0o644
+)
+
+// LoadMaster reads the shared v1 master key from NOX_KEY_HEX or, if unset,
+// from the file named by NOX_KEY_FILE.
+func LoadMaster() ([]byte, error) {
+	keyHex := strings.TrimSpace(os.Getenv("NOX_KEY_HEX"))
+	if keyHex == "" {
+		if path := strings.TrimSpace(os.Getenv("NOX_KEY_FILE")); path != "" {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read NOX_KEY_FILE: %w", err)
+			}
+			keyHex = strings.TrimSpace(string(raw))
+		}
+	}
+	if keyHex == "" {
+		return nil, errors.New("NOX_KEY_HEX required (or set NOX_KEY_FILE)")
+	}
+	k, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("decode NOX_KEY_HEX: %w", err)
+	}
+	if len(k) != Size {
+		return nil, fmt.Errorf("NOX_KEY_HEX must be %d bytes", Size)
+	}
+	return k, nil
+}
+
+// ReadFile reads a 32-byte key stored either raw or as 64 hex characters.
+func ReadFile(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == Size {
+		return raw, nil
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(k) != Size {
+		return nil, fmt.Errorf("%s: key must be 32 raw bytes or 64 hex chars", path)
+	}
+	return k, nil
+}
+
+// WriteFile stores key raw at path with mode, refusing to replace an
+// existing file unless overwrite is set.
+func WriteFile(path string, key []byte, mode os.FileMode, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewMaster returns a random v1 master key.
+func NewMaster() ([]byte, error) {
+	k := make([]byte, Size)
+	_, err := rand.Read(k)
+	return k, err
+}
+
+// NewKeyPair returns a random X25519 private key and its public key.
+func NewKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, Size)
+	if _, err = rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = Public(priv)
+	return priv, pub, err
+}
+
+// Public computes the X25519 public key for priv.
+func Public(priv []byte) ([]byte, error) {
+	if len(priv) != Size {
+		return nil, errors.New("private key must be 32 bytes")
+	}
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+// Fingerprint is a short, stable identifier for a public key:
+// the first 8 bytes of its SHA-256, hex encoded.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PublicPath maps a private key path to its public key path:
+// "server.key" becomes "server.pub", anything else gets ".pub" appended.
+func PublicPath(priv string) string {
+	if strings.HasSuffix(priv, ".key") {
+		return strings.TrimSuffix(priv, ".key") + ".pub"
+	}
+	return priv + ".pub"
+}
+
+// PreviousPath is where Rotate keeps the retired key next to priv.
+func PreviousPath(priv string) string {
+	return priv + ".prev"
+}
+
+// Retired is a rotated-out private key that stays valid until NotAfter.
+type Retired struct {
+	Key      []byte
+	NotAfter time.Time
+}
+
+// WriteRetired stores r as "<hex-key> <RFC3339 not-after>".
+func WriteRetired(path string, r Retired) error {
+	line := hex.EncodeToString(r.Key) + " " + r.NotAfter.UTC().Format(time.RFC3339) + "\n"
+	return WriteFile(path, []byte(line), PrivateMode, true)
+}
+
+// ReadRetired parses a file written by WriteRetired.
+func ReadRetired(path string) (Retired, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Retired{}, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) != 2 {
+		return Retired{}, fmt.Errorf("%s: expected <key-hex> <not-after>", path)
+	}
+	k, err := hex.DecodeString(fields[0])
+	if err != nil || len(k) != Size {
+		return Retired{}, fmt.Errorf("%s: bad key", path)
+	}
+	t, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return Retired{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return Retired{Key: k, NotAfter: t}, nil
+}
+
+// Rotate replaces the X25519 key at priv (and its public key) with a fresh
+// pair. The old private key is kept at PreviousPath(priv) until now+grace.
+// Only one retired key is kept, so Rotate refuses while the previous one is
+// still within its grace period.
+func Rotate(priv string, grace time.Duration) (pub []byte, err error) {
+	if r, err := ReadRetired(PreviousPath(priv)); err == nil && time.Now().Before(r.NotAfter) {
+		return nil, fmt.Errorf("%s is still accepted until %s; rotate after that", PreviousPath(priv), r.NotAfter.UTC().Format(time.RFC3339))
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	old, err := ReadFile(priv)
+	if err != nil {
+		return nil, err
+	}
+	newPriv, newPub, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteRetired(PreviousPath(priv), Retired{Key: old, NotAfter: time.Now().Add(grace)}); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(priv), "."+filepath.Base(priv)+".new")
+	if err := WriteFile(tmp, newPriv, PrivateMode, true); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, priv); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := WriteFile(PublicPath(priv), newPub, PublicMode, true); err != nil {
+		return nil, err
+	}
+	return newPub, nil
+}
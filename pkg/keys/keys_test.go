@@ -0,0 +1,110 @@
+package keys
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadMaster(t *testing.T) {
+	t.Setenv("NOX_KEY_HEX", "")
+	path := filepath.Join(t.TempDir(), "shared.key")
+	if err := os.WriteFile(path, []byte("0011223344556677889900112233445566778899001122334455667788990011\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NOX_KEY_FILE", path)
+	k, err := LoadMaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k) != Size || k[1] != 0x11 {
+		t.Fatalf("unexpected key %x", k)
+	}
+	t.Setenv("NOX_KEY_HEX", "abcd")
+	if _, err := LoadMaster(); err == nil {
+		t.Fatalf("short key accepted")
+	}
+}
+
+func TestWriteFileModes(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "client.key")
+	if err := WriteFile(path, priv, PrivateMode, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, priv, PrivateMode, false); err == nil {
+		t.Fatalf("existing key overwritten")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != PrivateMode {
+		t.Fatalf("mode %v", fi.Mode().Perm())
+	}
+	got, err := ReadFile(path)
+	if err != nil || !bytes.Equal(got, priv) {
+		t.Fatalf("read back: %v", err)
+	}
+	derived, _ := Public(got)
+	if !bytes.Equal(derived, pub) {
+		t.Fatalf("public key mismatch")
+	}
+	if PublicPath(path) != filepath.Join(dir, "client.pub") {
+		t.Fatalf("public path %s", PublicPath(path))
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+	old, _, _ := NewKeyPair()
+	if err := WriteFile(path, old, PrivateMode, false); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := Rotate(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cur, old) {
+		t.Fatalf("key not replaced")
+	}
+	if onDisk, _ := ReadFile(PublicPath(path)); !bytes.Equal(onDisk, pub) {
+		t.Fatalf("public key not updated")
+	}
+	prev, err := ReadRetired(PreviousPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(prev.Key, old) || time.Until(prev.NotAfter) < 59*time.Minute {
+		t.Fatalf("retired key %+v", prev)
+	}
+
+	// A second rotation inside the grace period would drop the first
+	// retired key early.
+	if _, err := Rotate(path, time.Hour); err == nil {
+		t.Fatal("rotated while the retired key is still valid")
+	}
+	if again, _ := ReadRetired(PreviousPath(path)); !bytes.Equal(again.Key, old) {
+		t.Fatal("retired key replaced")
+	}
+	prev.NotAfter = time.Now().Add(-time.Second)
+	if err := WriteRetired(PreviousPath(path), prev); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rotate(path, time.Hour); err != nil {
+		t.Fatalf("rotate after grace: %v", err)
+	}
+	if again, _ := ReadRetired(PreviousPath(path)); !bytes.Equal(again.Key, cur) {
+		t.Fatal("expired retired key not replaced by the current one")
+	}
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]string{
+		"socks5://u:p@127.0.0.1:1080": "socks5://127.0.0.1:1080",
+		"socks5h://proxy":             "socks5h://proxy:1080",
+		"http://proxy.corp:3128":      "http://proxy.corp:3128",
+		"proxy.corp":                  "http://proxy.corp:80",
+	} {
+		p, err := Parse(in)
+		if err != nil || p.String() != want {
+			t.Fatalf("Parse(%q) = %v %v, want %s", in, p, err, want)
+		}
+	}
+	if p, _ := Parse("socks5://u:p@h"); p.User != "u" || p.Password != "p" {
+		t.Fatalf("credentials %+v", p)
+	}
+	for _, bad := range []string{"https://proxy:443", "ftp://x", "socks5://"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("Parse(%q) accepted", bad)
+		}
+	}
+}
+
+func TestBypass(t *testing.T) {
+	list := "localhost, .corp, example.org:9000, 10.0.0.0/8"
+	for target, want := range map[string]bool{
+		"localhost:9000":       true,
+		"vpn.corp:443":         true,
+		"corp:443":             false,
+		"example.org:9000":     true,
+		"example.org:443":      false,
+		"sub.example.org:9000": true,
+		"10.1.2.3:9000":        true,
+		"192.0.2.1:9000":       false,
+	} {
+		if got := bypass(list, target); got != want {
+			t.Fatalf("bypass(%s) = %v", target, got)
+		}
+	}
+	if !bypass("*", "anything:1") {
+		t.Fatal("* does not match")
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	t.Setenv("ALL_PROXY", "")
+	t.Setenv("all_proxy", "")
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "socks5://127.0.0.1:1080")
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:3128")
+	t.Setenv("NO_PROXY", "internal")
+	if p, err := FromEnvironment("vpn.example.com:443"); err != nil || p.String() != "socks5://127.0.0.1:1080" {
+		t.Fatalf("got %v %v", p, err)
+	}
+	if p, err := FromEnvironment("vpn.internal:443"); err != nil || p != nil {
+		t.Fatalf("NO_PROXY ignored: %v %v", p, err)
+	}
+	if p, err := Select("direct", "vpn.example.com:443"); err != nil || p != nil {
+		t.Fatalf("direct: %v %v", p, err)
+	}
+}
+
+// echoServer answers every connection by echoing it.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveProxy runs handle on each connection to a new listener.
+func serveProxy(t *testing.T, handle func(net.Conn) (string, error)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				target, err := handle(c)
+				if err != nil {
+					return
+				}
+				up, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func checkEcho(t *testing.T, p *Proxy, target string) {
+	t.Helper()
+	conn, err := p.Dial(&net.Dialer{Timeout: 2 * time.Second}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through %s: %q %v", p, buf, err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	target := echoServer(t)
+	addr := serveProxy(t, func(c net.Conn) (string, error) {
+		buf := make([]byte, 512)
+		io.ReadFull(c, buf[:3]) // VER NMETHODS METHOD
+		c.Write([]byte{5, 2})
+		io.ReadFull(c, buf[:2]) // VER ULEN
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(c, pass)
+		if string(user) != "alice" || string(pass) != "secret" {
+			c.Write([]byte{1, 1})
+			return "", io.EOF
+		}
+		c.Write([]byte{1, 0})
+		io.ReadFull(c, buf[:4])
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(c, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(c, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(c, buf[:2])
+		port := int(buf[0])<<8 | int(buf[1])
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	})
+	p, _ := Parse("socks5h://alice:secret@" + addr)
+	checkEcho(t, p, target)
+	p.Password = "wrong"
+	if _, err := p.Dial(&net.Dialer{Timeout: 2 * time.Second}, target); err == nil {
+		t.Fatal("bad credentials accepted")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t)
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw"))
+	addr := serveProxy(t, func(c net.Conn) (string, error) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != want {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", io.EOF
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, nil
+	})
+	p, _ := Parse("http://bob:pw@" + addr)
+	checkEcho(t, p, target)
+	p.User = ""
+	if _, err := p.Dial(&net.Dialer{Timeout: 2 * time.Second}, target); err == nil {
+		t.Fatal("CONNECT without credentials accepted")
+	}
+}
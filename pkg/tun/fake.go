@@ -52,6 +52,14 @@ func (f *Fake) WritePacket(pkt []byte) (int, error) {
 	}
 }
 
+// WriteIP is WritePacket: a Fake never carries virtio-net headers.
+func (f *Fake) WriteIP(pkt []byte) (int, error) {
+	return f.WritePacket(pkt)
+}
+
+// Vnet reports false.
+func (f *Fake) Vnet() bool { return false }
+
 func (f *Fake) ReadPacket(buf []byte) (int, error) {
 	f.mu.Lock()
 	deadline := f.deadline
@@ -3,6 +3,7 @@ package tun
 import (
 	"fmt"
 	"os"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -10,17 +11,106 @@ import (
 )
 
 const (
-	tunDevice = "/dev/net/tun"
-	IFF_TUN   = 0x0001
-	IFF_NO_PI = 0x1000
+	tunDevice       = "/dev/net/tun"
+	IFF_TUN         = 0x0001
+	IFF_NO_PI       = 0x1000
+	IFF_MULTI_QUEUE = 0x0100
+	IFF_VNET_HDR    = 0x4000
+
+	// VnetHdrLen — размер заголовка virtio_net_hdr перед каждым пакетом в
+	// режиме IFF_VNET_HDR.
+	VnetHdrLen = 10
 )
 
 type Tun struct {
-	f *os.File
+	f    *os.File
+	rc   syscall.RawConn
+	vnet bool
 }
 
 // Create поднимает TUN-интерфейс с именем name в режиме без PI (чистые IP-пакеты).
 func Create(name string) (*Tun, error) {
+	return open(name, IFF_TUN|IFF_NO_PI)
+}
+
+// CreateQueues поднимает TUN-интерфейс name с n очередями (IFF_MULTI_QUEUE).
+// Каждая очередь — отдельный дескриптор; ядро раскладывает по ним пакеты
+// по хешу потока, так что один поток всегда читается из одной очереди.
+// При n <= 1 это обычный Create.
+func CreateQueues(name string, n int) ([]*Tun, error) {
+	if n <= 1 {
+		t, err := Create(name)
+		if err != nil {
+			return nil, err
+		}
+		return []*Tun{t}, nil
+	}
+	queues := make([]*Tun, 0, n)
+	for i := 0; i < n; i++ {
+		t, err := open(name, IFF_TUN|IFF_NO_PI|IFF_MULTI_QUEUE)
+		if err != nil {
+			for _, q := range queues {
+				q.Close()
+			}
+			return nil, fmt.Errorf("queue %d: %w", i, err)
+		}
+		queues = append(queues, t)
+	}
+	return queues, nil
+}
+
+// CreateOffload поднимает TUN-интерфейс name с n очередями в режиме
+// IFF_VNET_HDR и включает TSO и, если ядро умеет (6.2+), USO: ядро отдаёт
+// TCP/UDP-суперпакеты до 64 КБ и принимает такие же обратно. Возвращает
+// включённые флаги TUN_F_*. Если ядро не поддерживает offload, интерфейс
+// поднимается в обычном режиме, а флаги равны нулю.
+func CreateOffload(name string, n int) ([]*Tun, uint, error) {
+	flags := uint16(IFF_TUN | IFF_NO_PI | IFF_VNET_HDR)
+	if n > 1 {
+		flags |= IFF_MULTI_QUEUE
+	}
+	var queues []*Tun
+	closeAll := func() {
+		for _, q := range queues {
+			q.Close()
+		}
+	}
+	for i := 0; i < max(n, 1); i++ {
+		t, err := open(name, flags)
+		if err != nil {
+			closeAll()
+			if i == 0 {
+				// Нет IFF_VNET_HDR — обычный режим.
+				queues, err := CreateQueues(name, n)
+				return queues, 0, err
+			}
+			return nil, 0, fmt.Errorf("queue %d: %w", i, err)
+		}
+		t.vnet = true
+		queues = append(queues, t)
+	}
+	offload := []uint{
+		unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6 | unix.TUN_F_USO4 | unix.TUN_F_USO6,
+		unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6,
+	}
+	for _, off := range offload {
+		var err error
+		if cerr := queues[0].rc.Control(func(fd uintptr) {
+			err = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, int(off))
+		}); cerr != nil {
+			err = cerr
+		}
+		if err == nil {
+			return queues, off, nil
+		}
+	}
+	// Без offload заголовок virtio только мешает: переоткрываем как обычно.
+	closeAll()
+	plain, err := CreateQueues(name, n)
+	return plain, 0, err
+}
+
+func open(name string, flags uint16) (*Tun, error) {
 	fd, err := unix.Open(tunDevice, unix.O_RDWR, 0)
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %w", tunDevice, err)
@@ -33,7 +123,7 @@ func Create(name string) (*Tun, error) {
 		_     [40 - 2]byte
 	}
 	copy(ifr.Name[:], []byte(name))
-	ifr.Flags = IFF_TUN | IFF_NO_PI
+	ifr.Flags = flags
 
 	// прямой SYS_IOCTL с указателем на ifr
 	_, _, errno := unix.Syscall(
@@ -47,8 +137,25 @@ func Create(name string) (*Tun, error) {
 		return nil, fmt.Errorf("TUNSETIFF: %w", errno)
 	}
 
+	// Неблокирующий дескриптор попадает в netpoller: Close прерывает
+	// ждущий ReadPacket, а SetReadDeadline работает.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("set nonblock: %w", err)
+	}
 	f := os.NewFile(uintptr(fd), name)
-	return &Tun{f: f}, nil
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Tun{f: f, rc: rc}, nil
+}
+
+// Vnet сообщает, открыт ли TUN с IFF_VNET_HDR. Тогда ReadPacket и
+// WritePacket работают с пакетами, перед которыми стоит virtio_net_hdr.
+func (t *Tun) Vnet() bool {
+	return t.vnet
 }
 
 // ReadPacket читает один IP-пакет из TUN.
@@ -61,6 +168,26 @@ func (t *Tun) WritePacket(pkt []byte) (int, error) {
 	return t.f.Write(pkt)
 }
 
+var zeroVnetHdr [VnetHdrLen]byte
+
+// WriteIP пишет голый IP-пакет в любом режиме: в режиме IFF_VNET_HDR
+// добавляет пустой заголовок одним writev.
+func (t *Tun) WriteIP(pkt []byte) (int, error) {
+	if !t.vnet {
+		return t.f.Write(pkt)
+	}
+	var n int
+	var werr error
+	err := t.rc.Write(func(fd uintptr) bool {
+		n, werr = unix.Writev(int(fd), [][]byte{zeroVnetHdr[:], pkt})
+		return werr != unix.EAGAIN
+	})
+	if err == nil {
+		err = werr
+	}
+	return max(n-VnetHdrLen, 0), err
+}
+
 // Close закрывает TUN.
 func (t *Tun) Close() error {
 	if t.f == nil {
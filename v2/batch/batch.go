@@ -0,0 +1,189 @@
+// Package batch coalesces several IP packets into one data record, saving
+// the per-record header, sequence number and tag on small-packet workloads.
+// A batch plaintext is Marker || (Len(2) || Packet)...; no IP packet starts
+// with a zero version nibble, so a peer that negotiated batching tells a
+// batch from a lone packet by its first byte.
+package batch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"nox-core/v2/protocol"
+)
+
+// Marker is the first byte of a batch plaintext.
+const Marker = 0x00
+
+// Overhead is what a batch adds to its first packet; every further packet
+// costs its 2-byte length.
+const Overhead = 1 + 2
+
+// IsBatch reports whether a data plaintext is a batch.
+func IsBatch(pt []byte) bool {
+	return len(pt) > 0 && pt[0] == Marker
+}
+
+// Split calls fn for every packet in a batch; the slices alias pt.
+func Split(pt []byte, fn func(pkt []byte)) error {
+	if !IsBatch(pt) {
+		return errors.New("batch: no marker")
+	}
+	for p := pt[1:]; len(p) > 0; {
+		if len(p) < 2 {
+			return errors.New("batch: truncated length")
+		}
+		n := int(binary.BigEndian.Uint16(p))
+		if n == 0 || len(p) < 2+n {
+			return errors.New("batch: bad packet length")
+		}
+		fn(p[2 : 2+n])
+		p = p[2+n:]
+	}
+	return nil
+}
+
+// Collector coalesces queued packets. Packets sit in pooled record buffers
+// (protocol.GetBuffer) at Off, ending at the slice length; a batch is built
+// in place in the buffer of its first packet.
+type Collector struct {
+	Off   int             // packet offset in every buffer
+	Limit int             // largest batch plaintext, normally the tunnel MTU
+	Delay time.Duration   // how long to wait for more packets; 0 takes only queued ones
+	Wake  <-chan struct{} // interrupts the wait for a first packet; Next then returns a nil buf
+
+	held  *[]byte // packet that did not fit the previous batch
+	timer *time.Timer
+}
+
+// Next waits for a packet on ch and adds whatever else is queued, or arrives
+// within Delay, while the batch stays under Limit. It returns the buffer and
+// the number of packets in it; a single packet is left as it is, without
+// batch framing. Only IP packets are coalesced: any other plaintext, such as
+// a GSO superpacket, always goes alone. ok is false once done is closed.
+func (c *Collector) Next(ch <-chan *[]byte, done <-chan struct{}) (buf *[]byte, count int, ok bool) {
+	buf, c.held = c.held, nil
+	if buf == nil {
+		select {
+		case buf = <-ch:
+		case <-c.Wake:
+			return nil, 0, true
+		case <-done:
+			return nil, 0, false
+		}
+	}
+	if !isIP((*buf)[c.Off:]) {
+		return buf, 1, true
+	}
+	var wait <-chan time.Time
+	if c.Delay > 0 {
+		if c.timer == nil {
+			c.timer = time.NewTimer(c.Delay)
+		} else {
+			c.timer.Reset(c.Delay)
+		}
+		defer c.timer.Stop()
+		wait = c.timer.C
+	}
+	for count = 1; ; count++ {
+		var next *[]byte
+		select {
+		case next = <-ch:
+		default:
+			if wait != nil {
+				select {
+				case next = <-ch:
+				case <-wait:
+				case <-done:
+				}
+			}
+		}
+		if next == nil {
+			return buf, count, true
+		}
+		pkt := (*next)[c.Off:]
+		size := len(*buf) - c.Off + 2 + len(pkt)
+		if count == 1 {
+			size += Overhead
+		}
+		if !isIP(pkt) || size > c.Limit || c.Off+size > cap(*buf) {
+			c.held = next
+			return buf, count, true
+		}
+		if count == 1 {
+			b := (*buf)[c.Off:]
+			n := len(b)
+			b = b[:Overhead+n]
+			copy(b[Overhead:], b[:n])
+			b[0] = Marker
+			binary.BigEndian.PutUint16(b[1:3], uint16(n))
+			*buf = (*buf)[:c.Off+len(b)]
+		}
+		*buf = binary.BigEndian.AppendUint16(*buf, uint16(len(pkt)))
+		*buf = append(*buf, pkt...)
+		protocol.PutBuffer(next)
+	}
+}
+
+// isIP reports whether pt starts like an IPv4 or IPv6 packet.
+func isIP(pt []byte) bool {
+	return len(pt) > 0 && (pt[0]>>4 == 4 || pt[0]>>4 == 6)
+}
+
+// Release returns a packet held back by Next to the pool.
+func (c *Collector) Release() {
+	if c.held != nil {
+		protocol.PutBuffer(c.held)
+		c.held = nil
+	}
+}
+
+// bounds are the upper packet counts of the histogram buckets; the last
+// bucket takes everything larger.
+var bounds = [...]int{1, 2, 4, 8, 16}
+
+// Sizes is a snapshot of a Histogram: records with 1, 2, 3-4, 5-8, 9-16 and
+// more than 16 packets.
+type Sizes [len(bounds) + 1]uint64
+
+func (s Sizes) String() string {
+	parts := make([]string, len(s))
+	for i, n := range s {
+		switch {
+		case i == len(bounds):
+			parts[i] = fmt.Sprintf(">%d:%d", bounds[i-1], n)
+		case i > 0 && bounds[i]-bounds[i-1] > 1:
+			parts[i] = fmt.Sprintf("%d-%d:%d", bounds[i-1]+1, bounds[i], n)
+		default:
+			parts[i] = fmt.Sprintf("%d:%d", bounds[i], n)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Histogram counts data records by the number of packets they carry.
+type Histogram struct {
+	b [len(bounds) + 1]atomic.Uint64
+}
+
+// Observe counts one record of n packets.
+func (h *Histogram) Observe(n int) {
+	i := 0
+	for i < len(bounds) && n > bounds[i] {
+		i++
+	}
+	h.b[i].Add(1)
+}
+
+// Sizes returns the current counts.
+func (h *Histogram) Sizes() Sizes {
+	var s Sizes
+	for i := range h.b {
+		s[i] = h.b[i].Load()
+	}
+	return s
+}
@@ -0,0 +1,137 @@
+package batch
+
+import (
+	"testing"
+	"time"
+
+	"nox-core/v2/protocol"
+)
+
+const off = 16
+
+func packet(n int, fill byte) *[]byte {
+	b := protocol.GetBuffer()
+	*b = (*b)[:off+n]
+	for i := range (*b)[off:] {
+		(*b)[off+i] = fill
+	}
+	(*b)[off] = 0x45
+	return b
+}
+
+func TestCollectAndSplit(t *testing.T) {
+	ch := make(chan *[]byte, 8)
+	for i := 0; i < 4; i++ {
+		ch <- packet(100, byte(i))
+	}
+	ch <- packet(900, 9)
+	c := Collector{Off: off, Limit: 1000}
+	buf, count, ok := c.Next(ch, nil)
+	if !ok || count != 4 {
+		t.Fatalf("first batch: %d packets", count)
+	}
+	pt := (*buf)[off:]
+	if !IsBatch(pt) || len(pt) != Overhead+3*2+400 {
+		t.Fatalf("batch of %d bytes", len(pt))
+	}
+	var got [][]byte
+	if err := Split(pt, func(p []byte) { got = append(got, append([]byte(nil), p...)) }); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range got {
+		if len(p) != 100 || p[0] != 0x45 || p[1] != byte(i) {
+			t.Fatalf("packet %d: %d bytes %x", i, len(p), p[:2])
+		}
+	}
+	protocol.PutBuffer(buf)
+
+	// The packet that did not fit comes next, alone and unframed.
+	buf, count, _ = c.Next(ch, nil)
+	if count != 1 || IsBatch((*buf)[off:]) || len(*buf) != off+900 {
+		t.Fatalf("held packet: %d packets, %d bytes", count, len(*buf))
+	}
+	protocol.PutBuffer(buf)
+
+	done := make(chan struct{})
+	close(done)
+	if _, _, ok := c.Next(ch, done); ok {
+		t.Fatal("Next after done")
+	}
+
+	wake := make(chan struct{}, 1)
+	wake <- struct{}{}
+	c.Wake = wake
+	if buf, _, ok := c.Next(ch, nil); buf != nil || !ok {
+		t.Fatal("Next ignored Wake")
+	}
+
+	for _, bad := range [][]byte{{0x45}, {Marker, 0}, {Marker, 0, 5, 1}, {Marker, 0, 0}} {
+		if Split(bad, func([]byte) {}) == nil {
+			t.Fatalf("Split(%x) accepted", bad)
+		}
+	}
+}
+
+func TestCollectAlone(t *testing.T) {
+	// Plaintexts that are not IP packets, such as superpackets, never join a
+	// batch, however small.
+	super := func() *[]byte {
+		b := packet(20, 7)
+		(*b)[off] = 0x01
+		return b
+	}
+	ch := make(chan *[]byte, 8)
+	ch <- packet(10, 1)
+	ch <- super()
+	ch <- super()
+	ch <- packet(10, 2)
+	ch <- packet(10, 3)
+	c := Collector{Off: off, Limit: 1400, Delay: 10 * time.Millisecond}
+	want := []int{1, 1, 1, 2}
+	for i, n := range want {
+		buf, count, _ := c.Next(ch, nil)
+		if count != n {
+			t.Fatalf("record %d: %d packets, want %d", i, count, n)
+		}
+		if pt := (*buf)[off:]; (i == 1 || i == 2) && pt[0] != 0x01 {
+			t.Fatalf("record %d: superpacket framed as %x", i, pt[:3])
+		}
+		protocol.PutBuffer(buf)
+	}
+}
+
+func TestCollectDelay(t *testing.T) {
+	ch := make(chan *[]byte, 2)
+	c := Collector{Off: off, Limit: 1400, Delay: 50 * time.Millisecond}
+	ch <- packet(10, 1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		ch <- packet(10, 2)
+	}()
+	buf, count, _ := c.Next(ch, nil)
+	if count != 2 {
+		t.Fatalf("late packet missed: %d", count)
+	}
+	protocol.PutBuffer(buf)
+
+	c.Delay = 0
+	ch <- packet(10, 3)
+	start := time.Now()
+	if _, count, _ := c.Next(ch, nil); count != 1 || time.Since(start) > 20*time.Millisecond {
+		t.Fatalf("no-delay collector waited")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for _, n := range []int{1, 1, 2, 3, 4, 8, 17} {
+		h.Observe(n)
+	}
+	s := h.Sizes()
+	if s != (Sizes{2, 1, 2, 1, 0, 1}) {
+		t.Fatalf("sizes %v", s)
+	}
+	if got := s.String(); got != "1:2 2:1 3-4:2 5-8:1 9-16:0 >16:1" {
+		t.Fatalf("String() = %q", got)
+	}
+}
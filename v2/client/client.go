@@ -1,43 +1,101 @@
 package client
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/hmac"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"nox-core/v2/batch"
 	"nox-core/v2/crypto"
+	"nox-core/v2/offload"
+	"nox-core/v2/padding"
 	"nox-core/v2/protocol"
-	"nox-core/v2/replay"
 	"nox-core/v2/transport"
 	"nox-core/v2/tun"
 )
 
-// FSM (client): Init -> HelloSent -> AssignRecv -> Ready -> Rekeying? -> Closing.
+// FSM (client): Init -> HelloSent -> AssignRecv -> Confirmed -> Ready -> Rekeying? -> Closing.
+
+// heartbeatInterval keeps datagram sessions and their NAT bindings alive.
+const heartbeatInterval = 25 * time.Second
+
+// dataHeadroom is the space in front of a packet read from the TUN for the
+// record header and sequence number, so it is sealed and framed in place.
+const dataHeadroom = protocol.RecordHeaderLen + 8
+
+// quicMTU is the largest tunnel MTU whose full-size data records, padding
+// trailer included, still go out as one QUIC datagram.
+const quicMTU = transport.QUICMaxRecord - protocol.RecordHeaderLen - crypto.DataOverhead - padding.TrailerLen
 
 type Options struct {
-	Key     []byte
-	Session [8]byte
-	Server  string
-	MTU     int
-	Timeout time.Duration
-	TunName string
+	PrivateKey   []byte // client static X25519 key
+	ServerKey    []byte // server static X25519 public key
+	Session      [8]byte
+	MTU          int
+	Timeout      time.Duration
+	TunName      string
+	Suites       []crypto.Suite // data suites to offer; empty offers all
+	ReplayWindow uint64         // packets of reordering tolerated; 0 = replay.DefaultSize
+	Links        int            // connections to bond into the session; default 1
+	Sources      []string       // local IP or interface per link, reused cyclically; empty = default route
+	BatchDelay   time.Duration  // wait for more packets to batch; 0 batches queued ones, negative disables
+	Offload      bool           // open the TUN with TSO/USO and offer CapGSO on stream transports
+	OpenTun      tun.Opener     // opens the TUN for an assignment; default tun.Manager.Ensure
 }
 
+// errTicketRejected means the server would not resume; a full handshake follows.
+var errTicketRejected = errors.New("resumption ticket rejected")
+
+// ConnectError is what Run returns when no session came up: dialing or the
+// handshake failed. Any other error ends a session that was established.
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string { return e.Err.Error() }
+func (e *ConnectError) Unwrap() error { return e.Err }
+
 type Client struct {
 	opts      Options
 	tun       *tun.Device
-	cipherTx  *crypto.CipherState
-	cipherRx  *crypto.CipherState
-	replay    *replay.Window
+	pumpDone  chan struct{} // closed when the pump of tun returns
 	assigned  net.IP
 	prefixLen uint8
+	mtu       uint16
+	confirm   protocol.Frame // our CONFIRM, re-sent if the server repeats its flight
+
+	mu     sync.Mutex
+	keys   *crypto.Session
+	links  []transport.Conn // live bonded connections, the handshake one first
+	next   int
+	ticket *ticket // from the current session, for the next Run
+
+	batching atomic.Bool // the current session granted CapBatch
+	gso      atomic.Bool // and CapGSO
+	txSizes  batch.Histogram
+	rxSizes  batch.Histogram
+}
+
+// ticket is a resumption ticket and the secret that goes with it.
+type ticket struct {
+	opaque  []byte
+	secret  []byte
+	expires time.Time
 }
 
 func New(opts Options) (*Client, error) {
-	if len(opts.Key) != 32 {
-		return nil, fmt.Errorf("key must be 32 bytes")
+	if _, err := crypto.PublicKey(opts.PrivateKey); err != nil {
+		return nil, fmt.Errorf("client key: %w", err)
+	}
+	if len(opts.ServerKey) != crypto.PublicKeySize {
+		return nil, fmt.Errorf("server public key must be %d bytes", crypto.PublicKeySize)
 	}
 	if opts.Timeout == 0 {
 		opts.Timeout = 5 * time.Second
@@ -45,101 +103,691 @@ func New(opts Options) (*Client, error) {
 	if opts.TunName == "" {
 		opts.TunName = "nox1"
 	}
-	return &Client{opts: opts, replay: replay.New(64)}, nil
+	if len(opts.Suites) == 0 {
+		opts.Suites = crypto.DefaultSuites()
+	}
+	if opts.Links == 0 {
+		opts.Links = 1
+	}
+	if opts.OpenTun == nil {
+		opts.OpenTun = tun.NewManager().Ensure
+	}
+	return &Client{opts: opts}, nil
 }
 
-func (c *Client) Run(dialer transport.TCPDialer) error {
-	conn, err := dialer.Dial(c.opts.Server)
+// Run establishes a session with server and serves it until every link has
+// failed or Disconnect is called. It may be called again on the same Client
+// to reconnect: a ticket from the previous session is tried first, and the
+// TUN device is kept as long as the assignment does not change.
+func (c *Client) Run(dialer transport.Dialer, server string) error {
+	conn, keys, assign, err := c.connect(dialer, server)
 	if err != nil {
-		return err
+		return &ConnectError{Err: err}
 	}
 	defer conn.Close()
+	c.mu.Lock()
+	c.keys = keys
+	c.batching.Store(assign.Granted&protocol.CapBatch != 0)
+	c.gso.Store(assign.Granted&protocol.CapGSO != 0)
+	c.mu.Unlock()
+
+	ip := net.IP(assign.IPv4[:])
+	if c.tun == nil || !ip.Equal(c.assigned) || assign.PrefixLen != c.prefixLen || assign.MTU != c.mtu {
+		if c.tun != nil {
+			// Closing the device ends its pump; wait so two never run.
+			c.tun.Close()
+			<-c.pumpDone
+			c.tun = nil
+		}
+		_, subnet, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ip, assign.PrefixLen))
+		dev, err := c.opts.OpenTun(tun.Config{Name: c.opts.TunName, CIDR: subnet, MTU: int(assign.MTU), Offload: c.opts.Offload})
+		if err != nil {
+			return err
+		}
+		if c.opts.Offload && dev.Offload == 0 {
+			log.Printf("%s: kernel lacks TUN offloads, packets are read one by one", c.opts.TunName)
+		}
+		c.tun, c.assigned, c.prefixLen, c.mtu = dev, ip, assign.PrefixLen, assign.MTU
+		c.pumpDone = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			c.pumpTun(dev, int(assign.MTU))
+		}(c.pumpDone)
+	}
+
+	done := make(chan error, c.opts.Links)
+	c.addLink(conn, done)
+	started := 1
+	for i := 1; i < c.opts.Links; i++ {
+		link, err := c.join(dialer, server, c.source(i))
+		if err != nil {
+			log.Printf("link %d: %v", i, err)
+			continue
+		}
+		c.addLink(link, done)
+		started++
+	}
+	if started > 1 {
+		log.Printf("bonded %d links", started)
+	}
+	// The session lives as long as any link does.
+	for ; started > 0; started-- {
+		err = <-done
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// connect dials the server and establishes a session, by resumption when a
+// ticket is held and by a full handshake otherwise.
+func (c *Client) connect(dialer transport.Dialer, server string) (transport.Conn, *crypto.Session, protocol.AssignIP, error) {
+	c.mu.Lock()
+	t := c.ticket
+	c.ticket = nil // single use, whatever the outcome
+	c.mu.Unlock()
+	if t != nil && time.Now().Before(t.expires) {
+		conn, err := transport.DialFrom(dialer, c.source(0), server)
+		if err != nil {
+			return nil, nil, protocol.AssignIP{}, err
+		}
+		keys, assign, err := c.resumeHandshake(conn, t)
+		if err == nil {
+			log.Printf("session resumed")
+			return conn, keys, assign, nil
+		}
+		conn.Close()
+		if !errors.Is(err, errTicketRejected) {
+			return nil, nil, protocol.AssignIP{}, err
+		}
+		log.Printf("%v, falling back to a full handshake", err)
+	}
+	conn, err := transport.DialFrom(dialer, c.source(0), server)
+	if err != nil {
+		return nil, nil, protocol.AssignIP{}, err
+	}
+	keys, assign, err := c.fullHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, protocol.AssignIP{}, err
+	}
+	return conn, keys, assign, nil
+}
+
+// capabilities returns the HELLO/RESUME capability bits for conn.
+func (c *Client) capabilities(conn transport.Conn) uint16 {
+	caps := protocol.CapMTUNeg | protocol.CapReplayGuard | protocol.CapRekey | protocol.CapPadding | protocol.CapResume
+	if c.opts.BatchDelay >= 0 {
+		caps |= protocol.CapBatch
+	}
+	// Datagram transports cannot carry a superpacket in one record.
+	if c.opts.Offload && !transport.IsDatagram(conn) {
+		caps |= protocol.CapGSO
+	}
+	if transport.IsQUIC(conn) {
+		caps |= protocol.CapQUIC
+	}
+	for _, s := range c.opts.Suites {
+		switch s {
+		case crypto.SuiteChaCha20Poly1305:
+			caps |= protocol.CapChaCha20
+		case crypto.SuiteAES256GCM:
+			caps |= protocol.CapAESGCM
+		}
+	}
+	return caps
+}
+
+// desiredMTU returns the MTU to ask for on conn.
+func (c *Client) desiredMTU(conn transport.Conn) uint16 {
+	mtu := c.opts.MTU
+	if transport.IsQUIC(conn) && (mtu == 0 || mtu > quicMTU) {
+		mtu = quicMTU
+	}
+	return uint16(mtu)
+}
+
+// fullHandshake runs HELLO -> ASSIGN_IP -> CONFIRM on conn.
+func (c *Client) fullHandshake(conn transport.Conn) (*crypto.Session, protocol.AssignIP, error) {
+	hs, err := crypto.NewInitiator(c.opts.PrivateKey, c.opts.ServerKey)
+	if err != nil {
+		return nil, protocol.AssignIP{}, err
+	}
 
 	// HELLO
 	var hello protocol.Hello
-	hello.Capabilities = protocol.CapMTUNeg | protocol.CapReplayGuard
+	hello.Capabilities = c.capabilities(conn)
 	hello.SessionID = c.opts.Session
 	randBytes, _ := crypto.RandomBytes(16)
 	copy(hello.ClientNonce[:], randBytes)
-	hello.DesiredMTU = uint16(c.opts.MTU)
-	payload := append([]byte{protocol.CtrlHello}, protocol.EncodeHello(hello)...)
-	if err := protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}); err != nil {
-		return err
+	hello.DesiredMTU = c.desiredMTU(conn)
+	hello.Ephemeral, hello.Static, err = hs.WriteHello()
+	if err != nil {
+		return nil, protocol.AssignIP{}, err
+	}
+	helloFrame := protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlHello}, protocol.EncodeHello(hello)...)}
+	rt := c.retransmitter(conn)
+	if err := rt.Send(helloFrame); err != nil {
+		return nil, protocol.AssignIP{}, err
+	}
+	assignFrame, err := rt.Read()
+	if err != nil {
+		return nil, protocol.AssignIP{}, err
+	}
+	for assignFrame.Kind == protocol.KindControl && len(assignFrame.Payload) > 0 && assignFrame.Payload[0] == protocol.CtrlRetry {
+		// Server is under load: echo its cookie in an otherwise identical
+		// HELLO. A repeated RETRY answers a retransmitted HELLO; skip it.
+		retry, err := protocol.DecodeRetry(assignFrame.Payload[1:])
+		if err != nil {
+			return nil, protocol.AssignIP{}, err
+		}
+		if retry.Cookie != hello.Cookie {
+			hello.Cookie = retry.Cookie
+			helloFrame.Payload = append([]byte{protocol.CtrlHello}, protocol.EncodeHello(hello)...)
+			if err := rt.Send(helloFrame); err != nil {
+				return nil, protocol.AssignIP{}, err
+			}
+		}
+		if assignFrame, err = rt.Read(); err != nil {
+			return nil, protocol.AssignIP{}, err
+		}
+	}
+	assign, err := readAssign(assignFrame)
+	if err != nil {
+		return nil, protocol.AssignIP{}, err
 	}
+	if err := hs.ReadAssign(assign.Ephemeral, assign.Auth); err != nil {
+		return nil, protocol.AssignIP{}, fmt.Errorf("server authentication: %w", err)
+	}
+	keys, err := c.establish(conn, rt, helloFrame, assignFrame, assign, hs.Secret(), hello.ClientNonce[:])
+	return keys, assign, err
+}
 
-	conn.SetReadDeadline(time.Now().Add(c.opts.Timeout))
-	assignFrame, err := protocol.ReadRecord(conn)
+// resumeHandshake runs RESUME -> ASSIGN_IP -> CONFIRM on conn. The server
+// proves it opened the ticket by confirming under the resumed secret.
+func (c *Client) resumeHandshake(conn transport.Conn, t *ticket) (*crypto.Session, protocol.AssignIP, error) {
+	var r protocol.Resume
+	r.Capabilities = c.capabilities(conn)
+	r.SessionID = c.opts.Session
+	randBytes, _ := crypto.RandomBytes(16)
+	copy(r.ClientNonce[:], randBytes)
+	r.DesiredMTU = c.desiredMTU(conn)
+	r.Ticket = t.opaque
+	resumeFrame := protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlResume}, protocol.EncodeResume(r)...)}
+	rt := c.retransmitter(conn)
+	if err := rt.Send(resumeFrame); err != nil {
+		return nil, protocol.AssignIP{}, err
+	}
+	assignFrame, err := rt.Read()
 	if err != nil {
-		return err
+		return nil, protocol.AssignIP{}, err
+	}
+	assign, err := readAssign(assignFrame)
+	if err != nil {
+		return nil, protocol.AssignIP{}, err
 	}
-	if assignFrame.Kind != protocol.KindControl || len(assignFrame.Payload) == 0 || assignFrame.Payload[0] != protocol.CtrlAssignIP {
-		return fmt.Errorf("unexpected control")
+	if assign.SessionID != r.SessionID {
+		return nil, protocol.AssignIP{}, fmt.Errorf("server resumed another session")
 	}
-	assign, err := protocol.DecodeAssign(assignFrame.Payload[1:])
+	secret, err := crypto.ResumedSecret(t.secret, r.ClientNonce[:], assign.ServerNonce[:])
 	if err != nil {
-		return err
+		return nil, protocol.AssignIP{}, err
+	}
+	keys, err := c.establish(conn, rt, resumeFrame, assignFrame, assign, secret, r.ClientNonce[:])
+	return keys, assign, err
+}
+
+func (c *Client) retransmitter(conn transport.Conn) *protocol.Retransmitter {
+	var rto time.Duration
+	if transport.IsDatagram(conn) {
+		rto = transport.HandshakeRTO
+	}
+	return protocol.NewRetransmitter(conn, rto, time.Now().Add(c.opts.Timeout))
+}
+
+// readAssign decodes the server's answer to HELLO or RESUME.
+func readAssign(frame protocol.Frame) (protocol.AssignIP, error) {
+	if err := serverError(frame); err != nil {
+		return protocol.AssignIP{}, err
+	}
+	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlAssignIP {
+		return protocol.AssignIP{}, fmt.Errorf("unexpected control")
+	}
+	return protocol.DecodeAssign(frame.Payload[1:])
+}
+
+// establish checks the server's choices in ASSIGN_IP, confirms the transcript
+// of request and assign under secret and derives the session keys.
+func (c *Client) establish(conn transport.Conn, rt *protocol.Retransmitter, request, assignFrame protocol.Frame, assign protocol.AssignIP, secret, clientNonce []byte) (*crypto.Session, error) {
+	suite := crypto.Suite(assign.Suite)
+	if _, ok := crypto.SelectSuite([]crypto.Suite{suite}, c.opts.Suites); !ok {
+		return nil, fmt.Errorf("server chose unoffered suite %s", suite)
+	}
+	pad := padding.Policy{Mode: padding.Mode(assign.PadMode), Buckets: assign.PadBuckets}
+	if pad.Mode > padding.Random {
+		return nil, fmt.Errorf("server chose unknown padding mode %d", pad.Mode)
+	}
+	if extra := assign.Granted &^ c.capabilities(conn); extra != 0 {
+		return nil, fmt.Errorf("server enabled unoffered capabilities %#04x", extra)
+	}
+	requestRaw, _ := protocol.Encode(request)
+	assignRaw, _ := protocol.Encode(assignFrame)
+	transcript := crypto.TranscriptHash(requestRaw, assignRaw)
+	if err := c.confirmHandshake(conn, rt, assignRaw, secret, transcript); err != nil {
+		return nil, fmt.Errorf("aborting handshake: %w", err)
 	}
 	conn.SetReadDeadline(time.Time{})
 
-	txKey, rxKey, err := crypto.DeriveSessionKeys(c.opts.Key, hello.SessionID, hello.ClientNonce[:], assign.ServerNonce[:], false)
+	keys, err := crypto.NewSession(crypto.SessionParams{
+		Secret:       secret,
+		Transcript:   transcript,
+		SessionID:    assign.SessionID,
+		ClientNonce:  clientNonce,
+		ServerNonce:  assign.ServerNonce[:],
+		Suite:        suite,
+		ReplayWindow: c.opts.ReplayWindow,
+		Padding:      pad,
+		MTU:          int(assign.MTU),
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	txCipher, _ := crypto.NewCipherState(txKey, 1)
-	rxCipher, _ := crypto.NewCipherState(rxKey, 1)
-	c.cipherTx, c.cipherRx = txCipher, rxCipher
-	c.assigned = net.IP(assign.IPv4[:])
-	c.prefixLen = assign.PrefixLen
+	log.Printf("session ready, suite %s, padding %s, batching %t, gso %t", suite, pad, assign.Granted&protocol.CapBatch != 0, assign.Granted&protocol.CapGSO != 0)
+	return keys, nil
+}
 
-	// configure TUN
-	_, subnet, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", c.assigned.String(), c.prefixLen))
-	mgr := tun.NewManager()
-	dev, err := mgr.Ensure(tun.Config{Name: c.opts.TunName, CIDR: subnet, MTU: int(assign.MTU)})
+// source returns the local address or interface for link i.
+func (c *Client) source(i int) string {
+	if len(c.opts.Sources) == 0 {
+		return ""
+	}
+	return c.opts.Sources[i%len(c.opts.Sources)]
+}
+
+// join opens another connection and attaches it to the established session.
+func (c *Client) join(dialer transport.Dialer, server, source string) (transport.Conn, error) {
+	conn, err := transport.DialFrom(dialer, source, server)
+	if err != nil {
+		return nil, err
+	}
+	var j protocol.Join
+	j.SessionID = c.opts.Session
+	nonce, err := crypto.RandomBytes(len(j.Nonce))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	copy(j.Nonce[:], nonce)
+	j.Tag = c.keys.JoinTag(true, j.Nonce[:])
+	rt := c.retransmitter(conn)
+	if err := rt.Send(protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlJoin}, protocol.EncodeJoin(j)...)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	frame, err := rt.Read()
+	if err == nil {
+		err = serverError(frame)
+	}
+	if err == nil {
+		err = checkJoinAck(frame, j.Nonce, c.keys.JoinTag(false, j.Nonce[:]))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+func checkJoinAck(frame protocol.Frame, nonce, tag [16]byte) error {
+	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlJoin {
+		return fmt.Errorf("expected JOIN answer")
+	}
+	ack, err := protocol.DecodeJoin(frame.Payload[1:])
 	if err != nil {
 		return err
 	}
-	c.tun = dev
+	if ack.Nonce != nonce || !hmac.Equal(ack.Tag[:], tag[:]) {
+		return fmt.Errorf("server authentication failed on join")
+	}
+	return nil
+}
+
+// addLink starts reading conn; its reader reports to done when the link fails.
+func (c *Client) addLink(conn transport.Conn, done chan<- error) {
+	c.mu.Lock()
+	c.links = append(c.links, conn)
+	c.mu.Unlock()
+	if transport.IsDatagram(conn) {
+		go c.heartbeat(conn)
+	}
+	go func() {
+		err := c.readLink(conn)
+		conn.Close()
+		c.mu.Lock()
+		for i, l := range c.links {
+			if l == conn {
+				c.links = append(c.links[:i], c.links[i+1:]...)
+				break
+			}
+		}
+		c.mu.Unlock()
+		done <- err
+	}()
+}
 
-	go c.pumpTun(conn)
-	buf := make([]byte, 65535)
+func (c *Client) readLink(conn transport.Conn) error {
+	rd := protocol.NewReader(conn)
 	for {
-		frame, err := protocol.ReadRecord(conn)
+		frame, err := rd.Read()
 		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
 			return err
 		}
-		if frame.Kind != protocol.KindData || len(frame.Payload) < 8 {
+		if frame.Kind == protocol.KindControl {
+			if err := c.handleControl(conn, frame.Payload); err != nil {
+				return err
+			}
 			continue
 		}
-		seq := binary.BigEndian.Uint64(frame.Payload[:8])
-		if !c.replay.Check(seq) {
+		if frame.Kind != protocol.KindData {
 			continue
 		}
-		pt, err := c.cipherRx.Open(seq, nil, frame.Payload[8:])
+		pt, err := c.keys.OpenInPlace(frame.Payload)
 		if err != nil {
 			continue
 		}
-		_, _ = c.tun.Tun.WritePacket(pt)
+		if !c.batching.Load() {
+			_ = offload.ToTun(c.tun.Tun, c.tun.Offload, pt)
+			continue
+		}
+		if !batch.IsBatch(pt) {
+			c.rxSizes.Observe(1)
+			_ = offload.ToTun(c.tun.Tun, c.tun.Offload, pt)
+			continue
+		}
+		count := 0
+		if batch.Split(pt, func(pkt []byte) { _, _ = c.tun.Tun.WriteIP(pkt); count++ }) == nil {
+			c.rxSizes.Observe(count)
+		}
+	}
+}
+
+// Disconnect closes every link of the current session, making Run return.
+// The session's ticket, if any, is kept for the next Run.
+func (c *Client) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.links {
+		conn.Close()
+	}
+}
+
+// Probe checks that a NOX server answers at addr without starting a
+// session: it sends a JOIN for a random session and waits for the ERROR
+// that any live server returns.
+func Probe(dialer transport.Dialer, addr string, timeout time.Duration) error {
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var j protocol.Join
+	nonce, err := crypto.RandomBytes(len(j.SessionID) + len(j.Nonce))
+	if err != nil {
+		return err
+	}
+	copy(j.SessionID[:], nonce)
+	copy(j.Nonce[:], nonce[len(j.SessionID):])
+	var rto time.Duration
+	if transport.IsDatagram(conn) {
+		rto = transport.HandshakeRTO
+	}
+	rt := protocol.NewRetransmitter(conn, rto, time.Now().Add(timeout))
+	if err := rt.Send(protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlJoin}, protocol.EncodeJoin(j)...)}); err != nil {
+		return err
+	}
+	frame, err := rt.Read()
+	if err != nil {
+		return err
+	}
+	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlError {
+		return fmt.Errorf("unexpected answer to probe")
+	}
+	return nil
+}
+
+// nextLink picks the link for the next data record, round robin, and the
+// keys to seal it with.
+func (c *Client) nextLink() (transport.Conn, *crypto.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.links) == 0 {
+		return nil, nil
+	}
+	c.next++
+	return c.links[c.next%len(c.links)], c.keys
+}
+
+// confirmHandshake verifies the server CONFIRM, then answers with the client
+// CONFIRM. Any mismatch means HELLO or ASSIGN_IP was altered in transit.
+func (c *Client) confirmHandshake(conn transport.Conn, rt *protocol.Retransmitter, assignRaw, secret, transcript []byte) error {
+	var frame protocol.Frame
+	for {
+		var err error
+		if frame, err = rt.Read(); err != nil {
+			return err
+		}
+		if err := serverError(frame); err != nil {
+			return err
+		}
+		if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 {
+			return fmt.Errorf("expected CONFIRM")
+		}
+		if frame.Payload[0] == protocol.CtrlConfirm {
+			break
+		}
+		// Our retransmitted HELLO drew the whole server flight again.
+		if raw, _ := protocol.Encode(frame); frame.Payload[0] == protocol.CtrlAssignIP && bytes.Equal(raw, assignRaw) {
+			continue
+		}
+		return fmt.Errorf("expected CONFIRM")
+	}
+	cf, err := protocol.DecodeConfirm(frame.Payload[1:])
+	if err != nil {
+		return err
+	}
+	if err := crypto.OpenConfirm(secret, transcript, cf.Sealed[:], true); err != nil {
+		return err
+	}
+	sealed, err := crypto.SealConfirm(secret, transcript, false)
+	if err != nil {
+		return err
+	}
+	copy(cf.Sealed[:], sealed)
+	payload := append([]byte{protocol.CtrlConfirm}, protocol.EncodeConfirm(cf)...)
+	c.confirm = protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}
+	return protocol.WriteRecord(conn, c.confirm)
+}
+
+// serverError turns an ERROR record received during the handshake into an error.
+func serverError(frame protocol.Frame) error {
+	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlError {
+		return nil
+	}
+	e, err := protocol.DecodeClose(frame.Payload[1:])
+	if err != nil {
+		return fmt.Errorf("malformed server error: %w", err)
+	}
+	switch e.Code {
+	case protocol.CodeAuthFailed:
+		return fmt.Errorf("not authorised by server: %s", e.Reason)
+	case protocol.CodeRevoked:
+		return fmt.Errorf("key or session revoked by server")
+	case protocol.CodeTicket:
+		return fmt.Errorf("%w: %s", errTicketRejected, e.Reason)
+	}
+	return fmt.Errorf("server error %#04x: %s", e.Code, e.Reason)
+}
+
+func (c *Client) handleControl(conn transport.Conn, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	switch p[0] {
+	case protocol.CtrlConfirm:
+		// The server never saw our CONFIRM and is repeating its flight.
+		if transport.IsDatagram(conn) {
+			return protocol.WriteRecord(conn, c.confirm)
+		}
+	case protocol.CtrlRekey:
+		rk, err := protocol.DecodeRekey(p[1:])
+		if err != nil {
+			return err
+		}
+		// With bonding, REKEY arrives once per link, and the server repeats
+		// it until acknowledged, so every copy of the latest one is.
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if rk.Epoch < c.keys.Epoch() {
+			return nil
+		}
+		if rk.Epoch > c.keys.Epoch() {
+			if err := c.keys.Rekey(rk.Epoch, rk.Nonce[:]); err != nil {
+				return fmt.Errorf("rekey: %w", err)
+			}
+			log.Printf("rekeyed to epoch %d", rk.Epoch)
+		}
+		ack := protocol.RekeyAck{Epoch: rk.Epoch, Tag: c.keys.RekeyTag(rk.Epoch, rk.Nonce[:])}
+		payload := append([]byte{protocol.CtrlRekeyAck}, protocol.EncodeRekeyAck(ack)...)
+		return protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload})
+	case protocol.CtrlTicket:
+		t, err := protocol.DecodeTicket(p[1:])
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.ticket = &ticket{opaque: t.Opaque, secret: c.keys.ResumeSecret(), expires: time.Now().Add(time.Duration(t.Lifetime) * time.Second)}
+		c.mu.Unlock()
+	case protocol.CtrlClose, protocol.CtrlError:
+		cl, err := protocol.DecodeClose(p[1:])
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("closed by server %#04x: %s", cl.Code, cl.Reason)
 	}
-	_ = buf
 	return nil
 }
 
-func (c *Client) pumpTun(conn net.Conn) {
-	buf := make([]byte, 65535)
+// heartbeat keeps an otherwise idle datagram session from timing out.
+func (c *Client) heartbeat(conn transport.Conn) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+	var echo uint32
+	for range t.C {
+		echo++
+		payload := append([]byte{protocol.CtrlHeartbeat}, protocol.EncodeHeartbeat(protocol.Heartbeat{Echo: echo})...)
+		if err := protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}); err != nil {
+			return
+		}
+	}
+}
+
+// pumpTun forwards packets from dev until the device goes away. It outlives
+// Run so a reconnect keeps the device; packets read while no link is up
+// are dropped. Each packet is read into a pooled buffer behind room for the
+// record header and sequence number, sealed in place and written with one
+// Write. While the session batches, packets go to sendBatches instead.
+// Superpackets from an offloading device that the session cannot take whole
+// are split first.
+func (c *Client) pumpTun(dev *tun.Device, mtu int) {
+	out := make(chan *[]byte, 64)
+	done := make(chan struct{})
+	defer close(done)
+	go c.sendBatches(out, done, mtu)
+	off := dataHeadroom
+	if dev.Tun.Vnet() {
+		off++ // room for the superpacket marker
+	}
 	for {
-		n, err := c.tun.Tun.ReadPacket(buf)
+		rec := protocol.GetBuffer()
+		buf := *rec
+		n, err := dev.Tun.ReadPacket(buf[off:])
 		if err != nil {
+			protocol.PutBuffer(rec)
 			return
 		}
-		pkt := append([]byte{}, buf[:n]...)
-		seq := c.cipherTx.Seq()
-		ct := c.cipherTx.Seal(nil, pkt)
-		payload := make([]byte, 8+len(ct))
-		binary.BigEndian.PutUint64(payload[0:8], seq)
-		copy(payload[8:], ct)
-		_ = protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: payload})
+		pt := buf[dataHeadroom : dataHeadroom+n]
+		if dev.Tun.Vnet() {
+			if pt, err = offload.FromTun(buf[dataHeadroom:], n); err != nil {
+				protocol.PutBuffer(rec)
+				continue
+			}
+		}
+		if offload.IsSuper(pt) && (!c.gso.Load() || len(offload.Packet(pt)) > offload.MaxPacket) {
+			_ = offload.Segment(pt, func(pkt []byte) {
+				seg := protocol.GetBuffer()
+				c.sendData(out, seg, copy((*seg)[dataHeadroom:], pkt))
+			})
+			protocol.PutBuffer(rec)
+			continue
+		}
+		c.sendData(out, rec, len(pt))
 	}
 }
+
+// sendData seals and sends the n-byte plaintext at (*rec)[dataHeadroom:],
+// or hands it to sendBatches on out while the session batches.
+func (c *Client) sendData(out chan<- *[]byte, rec *[]byte, n int) {
+	buf := *rec
+	if c.batching.Load() {
+		*rec = buf[:dataHeadroom+n]
+		out <- rec
+		return
+	}
+	conn, keys := c.nextLink()
+	if conn != nil {
+		c.sendRecord(conn, keys, buf[:dataHeadroom+n])
+	}
+	protocol.PutBuffer(rec)
+}
+
+// sendBatches coalesces the packets pumpTun queues on out and sends each
+// batch as one record.
+func (c *Client) sendBatches(out <-chan *[]byte, done <-chan struct{}, mtu int) {
+	col := batch.Collector{Off: dataHeadroom, Limit: mtu, Delay: c.opts.BatchDelay}
+	defer col.Release()
+	for {
+		rec, count, ok := col.Next(out, done)
+		if !ok {
+			return
+		}
+		conn, keys := c.nextLink()
+		// A batch left over from a session that granted batching must not
+		// reach one that did not.
+		if conn != nil && (count == 1 || c.batching.Load()) {
+			c.txSizes.Observe(count)
+			c.sendRecord(conn, keys, *rec)
+		}
+		protocol.PutBuffer(rec)
+	}
+}
+
+// sendRecord seals the plaintext at buf[dataHeadroom:] in place and writes
+// it to conn as one data record.
+func (c *Client) sendRecord(conn transport.Conn, keys *crypto.Session, buf []byte) {
+	payload, err := keys.SealInPlace(buf[protocol.RecordHeaderLen:], len(buf)-dataHeadroom)
+	if err != nil {
+		return
+	}
+	rec := buf[:protocol.RecordHeaderLen+len(payload)]
+	if protocol.PutRecordHeader(rec, protocol.KindData) == nil {
+		_, _ = conn.Write(rec)
+	}
+}
+
+// BatchSizes returns histograms of packets per data record sent and received
+// while sessions batched.
+func (c *Client) BatchSizes() (tx, rx batch.Sizes) {
+	return c.txSizes.Sizes(), c.rxSizes.Sizes()
+}
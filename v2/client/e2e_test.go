@@ -0,0 +1,226 @@
+//go:build linux
+
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	coretun "nox-core/pkg/tun"
+	"nox-core/v2/crypto"
+	"nox-core/v2/protocol"
+	"nox-core/v2/registry"
+	"nox-core/v2/server"
+	"nox-core/v2/transport"
+	"nox-core/v2/tun"
+)
+
+// tap records the control opcodes a client writes on each connection.
+type tap struct {
+	mu    sync.Mutex
+	conns [][]byte
+}
+
+func (t *tap) Dial(addr string) (transport.Conn, error) {
+	conn, err := transport.MemDialer{}.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.conns = append(t.conns, nil)
+	i := len(t.conns) - 1
+	t.mu.Unlock()
+	return &tappedConn{Conn: conn, tap: t, i: i}, nil
+}
+
+func (t *tap) opcodes(i int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i >= len(t.conns) {
+		return nil
+	}
+	return append([]byte(nil), t.conns[i]...)
+}
+
+type tappedConn struct {
+	transport.Conn
+	tap *tap
+	i   int
+}
+
+func (c *tappedConn) Write(p []byte) (int, error) {
+	if len(p) > protocol.RecordHeaderLen && p[3] == protocol.KindControl {
+		c.tap.mu.Lock()
+		c.tap.conns[c.i] = append(c.tap.conns[c.i], p[protocol.RecordHeaderLen])
+		c.tap.mu.Unlock()
+	}
+	return c.Conn.Write(p)
+}
+
+// ipv4 builds a bare IPv4/UDP packet from src to dst carrying b.
+func ipv4(src, dst net.IP, b byte) []byte {
+	pkt := make([]byte, 29)
+	pkt[0] = 0x45
+	pkt[3] = byte(len(pkt))
+	pkt[8], pkt[9] = 64, 17
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	pkt[28] = b
+	return pkt
+}
+
+// expect sends pkt into one TUN and waits for it to come out of the other.
+func expect(t *testing.T, in, out *coretun.Fake, pkt []byte) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, _ = in.WritePacket(pkt) // a full backlog drops it, as a TUN would
+		_ = out.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 2048)
+		n, err := out.ReadPacket(buf)
+		if err == nil && string(buf[:n]) == string(pkt) {
+			return
+		}
+		// A packet sent before the session was up is lost; send again.
+		if time.Now().After(deadline) {
+			t.Fatalf("packet %x did not cross the tunnel: %v", pkt[28], err)
+		}
+	}
+}
+
+// TestSessionOverMem runs a server and a client over mem:// with fake TUNs
+// through the full handshake with RETRY, data both ways, a rekey and a
+// resumption.
+func TestSessionOverMem(t *testing.T) {
+	serverPriv, serverPub, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPriv, clientPub, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := filepath.Join(t.TempDir(), "peers")
+	if err := os.WriteFile(peers, []byte("laptop "+hex.EncodeToString(clientPub)+" allow 10.9.0.7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := registry.Load(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	gatewayIP, clientIP := net.IPv4(10, 9, 0, 1), net.IPv4(10, 9, 0, 7)
+
+	serverTun, serverNet := coretun.NewFakePair()
+	srv, err := server.New(server.Options{
+		PrivateKey:    serverPriv,
+		Peers:         reg,
+		Subnet:        subnet,
+		RequireCookie: true,
+		RekeyInterval: 300 * time.Millisecond,
+		OpenTun: func(tun.Config) (*tun.Device, error) {
+			return &tun.Device{Tun: serverTun, Queues: []tun.Queue{serverTun}}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := transport.ListenMem(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+
+	clientTun, clientNet := coretun.NewFakePair()
+	var opened []tun.Config
+	c, err := New(Options{
+		PrivateKey: clientPriv,
+		ServerKey:  serverPub,
+		OpenTun: func(cfg tun.Config) (*tun.Device, error) {
+			opened = append(opened, cfg)
+			return &tun.Device{Tun: clientTun, Queues: []tun.Queue{clientTun}}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &tap{}
+	// A server that cannot be reached is a connect failure.
+	var connectErr *ConnectError
+	if err := c.Run(dialer, "nowhere"); !errors.As(err, &connectErr) {
+		t.Fatalf("Run to a missing server: %v", err)
+	}
+	run := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- c.Run(dialer, t.Name()) }()
+		return done
+	}
+
+	// HELLO, RETRY, HELLO with the cookie, ASSIGN_IP and CONFIRM.
+	done := run()
+	expect(t, clientNet, serverNet, ipv4(clientIP, gatewayIP, 1))
+	expect(t, serverNet, clientNet, ipv4(gatewayIP, clientIP, 2))
+	if ops := dialer.opcodes(0); len(ops) < 3 || ops[0] != protocol.CtrlHello || ops[1] != protocol.CtrlHello || ops[2] != protocol.CtrlConfirm {
+		t.Fatalf("handshake sent %x, want HELLO, HELLO after RETRY, CONFIRM", ops)
+	}
+	if len(opened) != 1 || opened[0].CIDR.String() != "10.9.0.0/24" {
+		t.Fatalf("TUN opened with %+v", opened)
+	}
+
+	// Traffic past the interval rekeys; the session carries on in the new
+	// epoch once the client has acknowledged.
+	time.Sleep(350 * time.Millisecond)
+	for i := byte(3); ; i += 2 {
+		expect(t, clientNet, serverNet, ipv4(clientIP, gatewayIP, i))
+		expect(t, serverNet, clientNet, ipv4(gatewayIP, clientIP, i+1))
+		if st := srv.Stats(); len(st) == 1 && st[0].Rekeys > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("no rekey: %+v", srv.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mu.Lock()
+	epoch := c.keys.Epoch()
+	c.mu.Unlock()
+	if epoch < 2 {
+		t.Fatalf("client still in epoch %d", epoch)
+	}
+	expect(t, clientNet, serverNet, ipv4(clientIP, gatewayIP, 200))
+	expect(t, serverNet, clientNet, ipv4(gatewayIP, clientIP, 201))
+	hasAck := false
+	for _, op := range dialer.opcodes(0) {
+		hasAck = hasAck || op == protocol.CtrlRekeyAck
+	}
+	if !hasAck {
+		t.Fatalf("client never acknowledged REKEY: %x", dialer.opcodes(0))
+	}
+
+	// Reconnect: the ticket resumes the session and the TUN is kept.
+	// A session that came up is not a connect failure however it ends.
+	c.Disconnect()
+	if err := <-done; errors.As(err, &connectErr) {
+		t.Fatalf("ended session reported as connect failure: %v", err)
+	}
+	done = run()
+	defer func() {
+		c.Disconnect()
+		<-done
+	}()
+	expect(t, clientNet, serverNet, ipv4(clientIP, gatewayIP, 210))
+	expect(t, serverNet, clientNet, ipv4(gatewayIP, clientIP, 211))
+	if ops := dialer.opcodes(1); len(ops) == 0 || ops[0] != protocol.CtrlResume {
+		t.Fatalf("reconnect sent %x, want RESUME first", ops)
+	}
+	if len(opened) != 1 {
+		t.Fatalf("TUN reopened on resumption: %+v", opened)
+	}
+}
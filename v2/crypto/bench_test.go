@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"nox-core/v2/padding"
+	"nox-core/v2/protocol"
+)
+
+// BenchmarkRecordPath measures one data packet through the v2 record path:
+// SealData, WriteRecord, ReadRecord and OpenData, per suite and packet size.
+func BenchmarkRecordPath(b *testing.B) {
+	for _, suite := range []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM} {
+		for _, size := range []int{64, 512, 1400} {
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				tx, rx := sessionPairWith(b, SessionParams{Suite: suite})
+				pkt := make([]byte, size)
+				var buf bytes.Buffer
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					payload, err := tx.SealData(pkt)
+					if err != nil {
+						b.Fatal(err)
+					}
+					buf.Reset()
+					if err := protocol.WriteRecord(&buf, protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: payload}); err != nil {
+						b.Fatal(err)
+					}
+					f, err := protocol.ReadRecord(&buf)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := rx.OpenData(f.Payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// inPlaceRecord runs one packet through the pooled path the tunnels use:
+// SealInPlace behind the record header, one Write, Reader and OpenInPlace.
+func inPlaceRecord(tx, rx *Session, buf []byte, pkt []byte, wire *bytes.Buffer, rd *protocol.Reader) error {
+	const headroom = protocol.RecordHeaderLen + 8
+	copy(buf[headroom:], pkt)
+	payload, err := tx.SealInPlace(buf[protocol.RecordHeaderLen:headroom+len(pkt)], len(pkt))
+	if err != nil {
+		return err
+	}
+	rec := buf[:protocol.RecordHeaderLen+len(payload)]
+	if err := protocol.PutRecordHeader(rec, protocol.KindData); err != nil {
+		return err
+	}
+	wire.Reset()
+	if _, err := wire.Write(rec); err != nil {
+		return err
+	}
+	f, err := rd.Read()
+	if err != nil {
+		return err
+	}
+	pt, err := rx.OpenInPlace(f.Payload)
+	if err != nil {
+		return err
+	}
+	if len(pt) != len(pkt) {
+		return fmt.Errorf("opened %d bytes, sealed %d", len(pt), len(pkt))
+	}
+	return nil
+}
+
+// BenchmarkRecordPathInPlace is BenchmarkRecordPath on the pooled path; it
+// reports 0 allocs/op.
+func BenchmarkRecordPathInPlace(b *testing.B) {
+	for _, suite := range []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM} {
+		for _, size := range []int{64, 512, 1400} {
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				tx, rx := sessionPairWith(b, SessionParams{Suite: suite})
+				pkt := make([]byte, size)
+				buf := protocol.GetBuffer()
+				defer protocol.PutBuffer(buf)
+				var wire bytes.Buffer
+				rd := protocol.NewReader(&wire)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := inPlaceRecord(tx, rx, *buf, pkt, &wire, rd); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRecordPathAllocs(t *testing.T) {
+	for _, p := range []SessionParams{
+		{Suite: SuiteChaCha20Poly1305},
+		{Suite: SuiteAES256GCM},
+		{Padding: padding.Policy{Mode: padding.Random}, MTU: 1400},
+	} {
+		tx, rx := sessionPairWith(t, p)
+		pkt := make([]byte, 1000)
+		buf := make([]byte, protocol.MaxRecordLen)
+		var wire bytes.Buffer
+		rd := protocol.NewReader(&wire)
+		var err error
+		allocs := testing.AllocsPerRun(100, func() {
+			if e := inPlaceRecord(tx, rx, buf, pkt, &wire, rd); e != nil {
+				err = e
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocs != 0 {
+			t.Fatalf("%s padding=%s: %.1f allocs per record", p.Suite, p.Padding, allocs)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ConfirmSize is the length of a CONFIRM payload: the sealed transcript hash.
+const ConfirmSize = sha256.Size + chacha20poly1305.Overhead
+
+// ErrConfirm is returned when a peer's CONFIRM does not match our transcript.
+var ErrConfirm = errors.New("handshake confirmation failed: transcript or keys do not match")
+
+// TranscriptHash hashes the handshake records exactly as they were sent.
+// Each message is length-prefixed so boundaries cannot be shifted.
+func TranscriptHash(msgs ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("noxv2 transcript"))
+	var l [4]byte
+	for _, m := range msgs {
+		binary.BigEndian.PutUint32(l[:], uint32(len(m)))
+		h.Write(l[:])
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// SealConfirm builds the CONFIRM payload sent by the server (fromServer) or client.
+func SealConfirm(secret, transcript []byte, fromServer bool) ([]byte, error) {
+	a, err := confirmAEAD(secret, transcript, fromServer)
+	if err != nil {
+		return nil, err
+	}
+	return a.Seal(nil, make([]byte, chacha20poly1305.NonceSize), transcript, transcript), nil
+}
+
+// OpenConfirm verifies a CONFIRM payload produced by the other side.
+func OpenConfirm(secret, transcript, msg []byte, fromServer bool) error {
+	a, err := confirmAEAD(secret, transcript, fromServer)
+	if err != nil {
+		return err
+	}
+	pt, err := a.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg, transcript)
+	if err != nil || subtle.ConstantTimeCompare(pt, transcript) != 1 {
+		return ErrConfirm
+	}
+	return nil
+}
+
+func confirmAEAD(secret, transcript []byte, fromServer bool) (cipher, error) {
+	info := []byte("noxv2-confirm-client")
+	if fromServer {
+		info = []byte("noxv2-confirm-server")
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, transcript, info), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
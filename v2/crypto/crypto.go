@@ -6,22 +6,27 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
 
 const keyLen = 32
 
-// DeriveSessionKeys derives tx/rx keys using HKDF over the master key and nonces.
-func DeriveSessionKeys(master []byte, sessionID [8]byte, clientNonce, serverNonce []byte, isServer bool) (txKey, rxKey []byte, err error) {
-	if len(master) != keyLen {
-		return nil, nil, errors.New("master key must be 32 bytes")
+// TagLen is the AEAD tag size of every suite.
+const TagLen = 16
+
+// DeriveSessionKeys derives tx/rx keys using HKDF over the handshake secret,
+// nonces and the HELLO/ASSIGN_IP transcript hash.
+func DeriveSessionKeys(secret, transcript []byte, sessionID [8]byte, clientNonce, serverNonce []byte, isServer bool) (txKey, rxKey []byte, err error) {
+	if len(secret) != keyLen {
+		return nil, nil, errors.New("handshake secret must be 32 bytes")
 	}
-	salt := make([]byte, 8+len(clientNonce)+len(serverNonce))
-	copy(salt, sessionID[:])
-	copy(salt[8:], clientNonce)
-	copy(salt[8+len(clientNonce):], serverNonce)
+	salt := make([]byte, 0, 8+len(clientNonce)+len(serverNonce)+len(transcript))
+	salt = append(salt, sessionID[:]...)
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	salt = append(salt, transcript...)
 
 	infoTx := []byte("noxv2-tx")
 	infoRx := []byte("noxv2-rx")
@@ -29,8 +34,8 @@ func DeriveSessionKeys(master []byte, sessionID [8]byte, clientNonce, serverNonc
 		infoTx, infoRx = infoRx, infoTx
 	}
 
-	hkTx := hkdf.New(sha256.New, master, salt, infoTx)
-	hkRx := hkdf.New(sha256.New, master, salt, infoRx)
+	hkTx := hkdf.New(sha256.New, secret, salt, infoTx)
+	hkRx := hkdf.New(sha256.New, secret, salt, infoRx)
 	txKey = make([]byte, keyLen)
 	rxKey = make([]byte, keyLen)
 	if _, err = io.ReadFull(hkTx, txKey); err != nil {
@@ -42,11 +47,40 @@ func DeriveSessionKeys(master []byte, sessionID [8]byte, clientNonce, serverNonc
 	return txKey, rxKey, nil
 }
 
+// Limits bounds how much one key may protect. Crossing a soft limit makes
+// NeedsRekey report true; at a hard limit Seal refuses so no nonce repeats.
+type Limits struct {
+	SoftPackets uint64
+	HardPackets uint64
+	SoftBytes   uint64
+	HardBytes   uint64
+}
+
+// DefaultLimits follows WireGuard's message limits and caps bytes at 2^42.
+var DefaultLimits = Limits{
+	SoftPackets: 1 << 60,
+	HardPackets: math.MaxUint64 - 1<<13,
+	SoftBytes:   1 << 40,
+	HardBytes:   1 << 42,
+}
+
+var (
+	// ErrKeyExhausted is returned once a hard limit has been reached.
+	ErrKeyExhausted = errors.New("key usage limit reached")
+	// ErrKeyRetired is returned when sealing with a state replaced by rekey.
+	ErrKeyRetired = errors.New("key retired")
+)
+
 // CipherState wraps AEAD with a monotonically increasing nonce/seq.
 type CipherState struct {
-	aead  cipher
-	seq   uint64
-	epoch uint32
+	aead    cipher
+	seq     uint64
+	epoch   uint32
+	limits  Limits
+	packets uint64
+	bytes   uint64
+	retired bool
+	nonce   [12]byte // scratch for Seal and Open; callers serialise use
 }
 
 type cipher interface {
@@ -54,13 +88,32 @@ type cipher interface {
 	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
 }
 
-// NewCipherState constructs CipherState from a key and epoch.
-func NewCipherState(key []byte, epoch uint32) (*CipherState, error) {
-	a, err := chacha20poly1305.New(key)
+// NewCipherState constructs CipherState for suite from a key and epoch.
+func NewCipherState(suite Suite, key []byte, epoch uint32) (*CipherState, error) {
+	a, err := suite.newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
-	return &CipherState{aead: a, epoch: epoch}, nil
+	return &CipherState{aead: a, epoch: epoch, limits: DefaultLimits}, nil
+}
+
+// SetLimits overrides DefaultLimits.
+func (c *CipherState) SetLimits(l Limits) {
+	c.limits = l
+}
+
+// Retire stops the state from sealing; used when an epoch is replaced.
+func (c *CipherState) Retire() {
+	c.retired = true
+}
+
+// Packets and Bytes count what this key has sealed, or opened and committed.
+func (c *CipherState) Packets() uint64 { return c.packets }
+func (c *CipherState) Bytes() uint64   { return c.bytes }
+
+// NeedsRekey reports whether a soft limit has been crossed.
+func (c *CipherState) NeedsRekey() bool {
+	return c.packets >= c.limits.SoftPackets || c.bytes >= c.limits.SoftBytes
 }
 
 // Seq returns the next sequence value that will be used for sealing.
@@ -76,20 +129,52 @@ func (c *CipherState) NextNonce() []byte {
 	return nonce
 }
 
-// Seal increments seq and seals plaintext.
-func (c *CipherState) Seal(ad, plaintext []byte) []byte {
-	nonce := c.NextNonce()
-	ct := c.aead.Seal(nil, nonce, plaintext, ad)
+// Seal increments seq and seals plaintext, refusing past the hard limits.
+func (c *CipherState) Seal(ad, plaintext []byte) ([]byte, error) {
+	return c.SealTo(nil, ad, plaintext)
+}
+
+// SealTo is Seal appending the ciphertext to dst. Like cipher.AEAD, it seals
+// in place when plaintext starts where the ciphertext goes, at len(dst).
+func (c *CipherState) SealTo(dst, ad, plaintext []byte) ([]byte, error) {
+	if c.retired {
+		return nil, ErrKeyRetired
+	}
+	if c.seq >= c.limits.HardPackets || c.bytes+uint64(len(plaintext)) > c.limits.HardBytes {
+		return nil, ErrKeyExhausted
+	}
+	binary.BigEndian.PutUint32(c.nonce[0:4], c.epoch)
+	binary.BigEndian.PutUint64(c.nonce[4:12], c.seq)
+	ct := c.aead.Seal(dst, c.nonce[:], plaintext, ad)
 	c.seq++
-	return ct
+	c.packets++
+	c.bytes += uint64(len(plaintext))
+	return ct, nil
 }
 
-// Open decrypts ciphertext with provided seq (for replay-guard).
+// Open decrypts ciphertext with provided seq (for replay-guard). The packet
+// only counts against the key once the caller commits it.
 func (c *CipherState) Open(seq uint64, ad, ciphertext []byte) ([]byte, error) {
-	nonce := make([]byte, 12)
-	binary.BigEndian.PutUint32(nonce[0:4], c.epoch)
-	binary.BigEndian.PutUint64(nonce[4:12], seq)
-	return c.aead.Open(nil, nonce, ciphertext, ad)
+	return c.OpenTo(nil, seq, ad, ciphertext)
+}
+
+// OpenTo is Open appending the plaintext to dst; ciphertext[:0] opens in
+// place. A failed open may overwrite dst's spare capacity.
+func (c *CipherState) OpenTo(dst []byte, seq uint64, ad, ciphertext []byte) ([]byte, error) {
+	if seq >= c.limits.HardPackets {
+		return nil, ErrKeyExhausted
+	}
+	binary.BigEndian.PutUint32(c.nonce[0:4], c.epoch)
+	binary.BigEndian.PutUint64(c.nonce[4:12], seq)
+	return c.aead.Open(dst, c.nonce[:], ciphertext, ad)
+}
+
+// Commit counts an opened packet of n plaintext bytes against the key. Call
+// it once the packet is accepted, after its replay check, so replayed records
+// cannot push the key towards its limits.
+func (c *CipherState) Commit(n int) {
+	c.packets++
+	c.bytes += uint64(n)
 }
 
 // RandomBytes returns n random bytes.
@@ -8,14 +8,14 @@ func TestDeriveSessionKeys(t *testing.T) {
 	sid[0] = 1
 	cn := make([]byte, 16)
 	sn := make([]byte, 16)
-	tx, rx, err := DeriveSessionKeys(master, sid, cn, sn, false)
+	tx, rx, err := DeriveSessionKeys(master, nil, sid, cn, sn, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(tx) != 32 || len(rx) != 32 {
 		t.Fatalf("bad key len")
 	}
-	tx2, rx2, err := DeriveSessionKeys(master, sid, cn, sn, true)
+	tx2, rx2, err := DeriveSessionKeys(master, nil, sid, cn, sn, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -23,3 +23,80 @@ func TestDeriveSessionKeys(t *testing.T) {
 		t.Fatalf("keys should differ by role")
 	}
 }
+
+func TestHandshakeIK(t *testing.T) {
+	serverPriv, serverPub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPriv, clientPub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ini, err := NewInitiator(clientPriv, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewResponder(serverPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, cs, err := ini.WriteHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPub, err := resp.ReadHello(ce, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotPub) != string(clientPub) {
+		t.Fatalf("client static mismatch")
+	}
+	se, tag, err := resp.WriteAssign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ini.ReadAssign(se, tag); err != nil {
+		t.Fatal(err)
+	}
+	if string(ini.Secret()) != string(resp.Secret()) {
+		t.Fatalf("secrets differ")
+	}
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	serverPriv, _, _ := GenerateKeyPair()
+	_, otherPub, _ := GenerateKeyPair()
+	clientPriv, _, _ := GenerateKeyPair()
+	ini, _ := NewInitiator(clientPriv, otherPub)
+	resp, _ := NewResponder(serverPriv)
+	ce, cs, err := ini.WriteHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.ReadHello(ce, cs); err == nil {
+		t.Fatalf("hello for another server key accepted")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	secret := make([]byte, 32)
+	tr := TranscriptHash([]byte("hello"), []byte("assign"))
+	msg, err := SealConfirm(secret, tr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != ConfirmSize {
+		t.Fatalf("confirm len %d", len(msg))
+	}
+	if err := OpenConfirm(secret, tr, msg, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenConfirm(secret, tr, msg, false); err != ErrConfirm {
+		t.Fatalf("confirm accepted for wrong role: %v", err)
+	}
+	tampered := TranscriptHash([]byte("hello"), []byte("assign!"))
+	if err := OpenConfirm(secret, tampered, msg, true); err != ErrConfirm {
+		t.Fatalf("confirm accepted for tampered transcript: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sizes of the handshake fields carried in HELLO and ASSIGN_IP.
+const (
+	PublicKeySize = curve25519.PointSize
+	StaticBoxSize = PublicKeySize + chacha20poly1305.Overhead
+	AuthTagSize   = chacha20poly1305.Overhead
+)
+
+var handshakeLabel = []byte("noxv2 IK X25519 ChaChaPoly SHA256")
+
+// ErrHandshakeAuth is returned when a handshake field fails authentication.
+var ErrHandshakeAuth = errors.New("handshake authentication failed")
+
+// GenerateKeyPair returns a fresh X25519 private/public key pair.
+func GenerateKeyPair() (priv, pub []byte, err error) {
+	priv, err = RandomBytes(curve25519.ScalarSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err = PublicKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// PublicKey computes the X25519 public key for priv.
+func PublicKey(priv []byte) ([]byte, error) {
+	if len(priv) != curve25519.ScalarSize {
+		return nil, errors.New("private key must be 32 bytes")
+	}
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+// Handshake runs a Noise-IK-style exchange. The client knows the server static
+// key up front; HELLO carries the client ephemeral and its encrypted static key
+// (es, ss), ASSIGN_IP carries the server ephemeral (ee, se) and a tag that only
+// the holder of the server static key can produce.
+type Handshake struct {
+	initiator       bool
+	ck              []byte
+	k               []byte
+	h               []byte
+	static          []byte
+	staticPub       []byte
+	ephemeral       []byte
+	remoteStatic    []byte
+	remoteEphemeral []byte
+}
+
+// NewInitiator prepares the client side of the handshake.
+func NewInitiator(staticPriv, serverPub []byte) (*Handshake, error) {
+	if len(serverPub) != PublicKeySize {
+		return nil, errors.New("server public key must be 32 bytes")
+	}
+	hs, err := newHandshake(staticPriv, true)
+	if err != nil {
+		return nil, err
+	}
+	hs.remoteStatic = append([]byte(nil), serverPub...)
+	hs.mixHash(serverPub)
+	return hs, nil
+}
+
+// NewResponder prepares the server side of the handshake.
+func NewResponder(staticPriv []byte) (*Handshake, error) {
+	hs, err := newHandshake(staticPriv, false)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(hs.staticPub)
+	return hs, nil
+}
+
+func newHandshake(staticPriv []byte, initiator bool) (*Handshake, error) {
+	pub, err := PublicKey(staticPriv)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(handshakeLabel)
+	return &Handshake{
+		initiator: initiator,
+		ck:        append([]byte(nil), h[:]...),
+		h:         append([]byte(nil), h[:]...),
+		static:    append([]byte(nil), staticPriv...),
+		staticPub: pub,
+	}, nil
+}
+
+// WriteHello produces the client ephemeral key and encrypted static key.
+func (hs *Handshake) WriteHello() (ephemeral [PublicKeySize]byte, static [StaticBoxSize]byte, err error) {
+	if !hs.initiator {
+		return ephemeral, static, errors.New("hello written by responder")
+	}
+	priv, pub, err := GenerateKeyPair()
+	if err != nil {
+		return ephemeral, static, err
+	}
+	hs.ephemeral = priv
+	copy(ephemeral[:], pub)
+	hs.mixHash(pub)
+	if err = hs.mixDH(priv, hs.remoteStatic); err != nil {
+		return ephemeral, static, err
+	}
+	box, err := hs.encrypt(hs.staticPub)
+	if err != nil {
+		return ephemeral, static, err
+	}
+	copy(static[:], box)
+	hs.mixHash(box)
+	err = hs.mixDH(hs.static, hs.remoteStatic)
+	return ephemeral, static, err
+}
+
+// ReadHello consumes the client fields and returns the client static public key.
+func (hs *Handshake) ReadHello(ephemeral [PublicKeySize]byte, static [StaticBoxSize]byte) ([]byte, error) {
+	if hs.initiator {
+		return nil, errors.New("hello read by initiator")
+	}
+	hs.remoteEphemeral = append([]byte(nil), ephemeral[:]...)
+	hs.mixHash(ephemeral[:])
+	if err := hs.mixDH(hs.static, hs.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	pub, err := hs.decrypt(static[:])
+	if err != nil {
+		return nil, err
+	}
+	hs.remoteStatic = pub
+	hs.mixHash(static[:])
+	if err := hs.mixDH(hs.static, hs.remoteStatic); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), pub...), nil
+}
+
+// WriteAssign produces the server ephemeral key and the key-possession tag.
+func (hs *Handshake) WriteAssign() (ephemeral [PublicKeySize]byte, auth [AuthTagSize]byte, err error) {
+	if hs.initiator || hs.remoteStatic == nil {
+		return ephemeral, auth, errors.New("assign written out of order")
+	}
+	priv, pub, err := GenerateKeyPair()
+	if err != nil {
+		return ephemeral, auth, err
+	}
+	hs.ephemeral = priv
+	copy(ephemeral[:], pub)
+	hs.mixHash(pub)
+	if err = hs.mixDH(priv, hs.remoteEphemeral); err != nil {
+		return ephemeral, auth, err
+	}
+	if err = hs.mixDH(priv, hs.remoteStatic); err != nil {
+		return ephemeral, auth, err
+	}
+	tag, err := hs.encrypt(nil)
+	if err != nil {
+		return ephemeral, auth, err
+	}
+	copy(auth[:], tag)
+	hs.mixHash(tag)
+	return ephemeral, auth, nil
+}
+
+// ReadAssign consumes the server fields and verifies the key-possession tag.
+func (hs *Handshake) ReadAssign(ephemeral [PublicKeySize]byte, auth [AuthTagSize]byte) error {
+	if !hs.initiator || hs.ephemeral == nil {
+		return errors.New("assign read out of order")
+	}
+	hs.remoteEphemeral = append([]byte(nil), ephemeral[:]...)
+	hs.mixHash(ephemeral[:])
+	if err := hs.mixDH(hs.ephemeral, hs.remoteEphemeral); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.static, hs.remoteEphemeral); err != nil {
+		return err
+	}
+	if _, err := hs.decrypt(auth[:]); err != nil {
+		return err
+	}
+	hs.mixHash(auth[:])
+	return nil
+}
+
+// Secret returns the chaining key to feed into DeriveSessionKeys once both
+// messages have been processed.
+func (hs *Handshake) Secret() []byte {
+	return append([]byte(nil), hs.ck...)
+}
+
+// RemoteStatic returns the peer static public key, if known.
+func (hs *Handshake) RemoteStatic() []byte {
+	return append([]byte(nil), hs.remoteStatic...)
+}
+
+func (hs *Handshake) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(hs.h)
+	sum.Write(data)
+	hs.h = sum.Sum(nil)
+}
+
+func (hs *Handshake) mixDH(priv, pub []byte) error {
+	shared, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return ErrHandshakeAuth
+	}
+	out := make([]byte, 2*keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, hs.ck, nil), out); err != nil {
+		return err
+	}
+	hs.ck, hs.k = out[:keyLen], out[keyLen:]
+	return nil
+}
+
+func (hs *Handshake) encrypt(plaintext []byte) ([]byte, error) {
+	a, err := chacha20poly1305.New(hs.k)
+	if err != nil {
+		return nil, err
+	}
+	return a.Seal(nil, make([]byte, a.NonceSize()), plaintext, hs.h), nil
+}
+
+func (hs *Handshake) decrypt(ciphertext []byte) ([]byte, error) {
+	a, err := chacha20poly1305.New(hs.k)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := a.Open(nil, make([]byte, a.NonceSize()), ciphertext, hs.h)
+	if err != nil {
+		return nil, ErrHandshakeAuth
+	}
+	return pt, nil
+}
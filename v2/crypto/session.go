@@ -0,0 +1,518 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"nox-core/v2/padding"
+	"nox-core/v2/replay"
+)
+
+// DefaultRekeyOverlap is how long the previous epoch's rx key stays valid.
+const DefaultRekeyOverlap = 5 * time.Second
+
+// ErrReplay is returned by OpenData for duplicate or too-old sequence numbers.
+var ErrReplay = errors.New("replayed or stale packet")
+
+// Session holds the data-path cipher states of one tunnel and switches epochs
+// on rekey. After a switch the previous rx state is kept for the overlap so
+// packets sealed before the peer saw REKEY still decrypt.
+type Session struct {
+	p SessionParams
+
+	txMu       sync.Mutex
+	tx         *CipherState
+	nextTx     *CipherState // tx of a begun rekey the peer has not confirmed
+	rekeyNonce []byte       // nonce of that rekey's REKEY
+	txTotal    uint64
+	txPad      uint64
+	refused    uint64
+
+	rxMu       sync.Mutex
+	rx         *CipherState
+	rxReplay   *replay.Window
+	rxTotal    uint64
+	rxPad      uint64
+	duplicates uint64 // folded in from retired replay windows
+	tooOld     uint64
+	failures   uint64
+	prevRx     *CipherState
+	prevReplay *replay.Window
+	prevUntil  time.Time
+	prevHeld   bool   // prevRx is kept past prevUntil while a rekey is pending
+	rxSpare    []byte // ciphertext copy for in-place opens during the overlap
+
+	secret    []byte
+	joinKey   []byte // authenticates extra links; fixed for the session
+	resumeKey []byte // seeds a resumed session; fixed for the session
+	epoch     uint32
+	rekeys    uint32
+	rekeyedAt time.Time
+}
+
+// Stats is a snapshot of a session's data-path counters. Packet and byte
+// counts under Tx/Rx cover the current epoch's keys; totals span all epochs.
+type Stats struct {
+	Epoch        uint32
+	Rekeys       uint32
+	TxPackets    uint64
+	TxBytes      uint64
+	RxPackets    uint64
+	RxBytes      uint64
+	TxTotal      uint64
+	RxTotal      uint64
+	SoftLimit    bool   // a soft limit was crossed; rekey pending
+	Refused      uint64 // seals refused at a hard limit
+	Replays      uint64 // Duplicates + TooOld
+	Duplicates   uint64
+	TooOld       uint64
+	AuthFailures uint64
+	TxPadding    uint64 // padding bytes added to sent packets, trailers included
+	RxPadding    uint64 // padding bytes stripped from received packets
+}
+
+// SessionParams are the handshake outputs and policy a Session is built from.
+// Zero Suite, Overlap, Limits and ReplayWindow select ChaCha20-Poly1305,
+// DefaultRekeyOverlap, DefaultLimits and replay.DefaultSize.
+type SessionParams struct {
+	Secret      []byte
+	Transcript  []byte
+	SessionID   [8]byte
+	ClientNonce []byte
+	ServerNonce []byte
+	IsServer    bool
+	Suite       Suite
+	Overlap     time.Duration
+	Limits      Limits
+	// ReplayWindow is the number of packets a sequence number may trail the
+	// highest one received and still be accepted.
+	ReplayWindow uint64
+	// Padding applies to both directions; MTU caps random padding.
+	Padding padding.Policy
+	MTU     int
+}
+
+// NewSession derives epoch-1 keys from the handshake secret and transcript.
+func NewSession(p SessionParams) (*Session, error) {
+	if p.Suite == 0 {
+		p.Suite = SuiteChaCha20Poly1305
+	}
+	if p.Overlap == 0 {
+		p.Overlap = DefaultRekeyOverlap
+	}
+	if p.Limits == (Limits{}) {
+		p.Limits = DefaultLimits
+	}
+	secret := append([]byte(nil), p.Secret...)
+	p.Secret = nil
+	p.Transcript = append([]byte(nil), p.Transcript...)
+	p.ClientNonce = append([]byte(nil), p.ClientNonce...)
+	p.ServerNonce = append([]byte(nil), p.ServerNonce...)
+	s := &Session{p: p, joinKey: make([]byte, 32), resumeKey: make([]byte, keyLen)}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, p.Transcript, []byte("noxv2-join")), s.joinKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, p.Transcript, []byte("noxv2-resume")), s.resumeKey); err != nil {
+		return nil, err
+	}
+	if err := s.install(secret, 1); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// JoinTag authenticates a JOIN for another link of this session: the
+// client's request when fromClient is set, the server's answer otherwise.
+func (s *Session) JoinTag(fromClient bool, nonce []byte) [16]byte {
+	dir := byte('S')
+	if fromClient {
+		dir = 'C'
+	}
+	mac := hmac.New(sha256.New, s.joinKey)
+	mac.Write([]byte{dir})
+	mac.Write(s.p.SessionID[:])
+	mac.Write(nonce)
+	var tag [16]byte
+	copy(tag[:], mac.Sum(nil))
+	return tag
+}
+
+// ResumeSecret returns the secret a resumption ticket for this session
+// carries. Both sides derive it from the handshake, so only the server that
+// sealed the ticket and the client that holds the session can use it.
+func (s *Session) ResumeSecret() []byte {
+	return append([]byte(nil), s.resumeKey...)
+}
+
+// ResumedSecret derives the handshake secret of a resumed session from a
+// ticket's resume secret and the fresh RESUME and ASSIGN_IP nonces.
+func ResumedSecret(resume, clientNonce, serverNonce []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), clientNonce...), serverNonce...)
+	out := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, resume, salt, []byte("noxv2-resumed")), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Suite returns the negotiated AEAD suite.
+func (s *Session) Suite() Suite {
+	return s.p.Suite
+}
+
+func (s *Session) ciphers(secret []byte, epoch uint32) (tx, rx *CipherState, err error) {
+	txKey, rxKey, err := DeriveSessionKeys(secret, s.p.Transcript, s.p.SessionID, s.p.ClientNonce, s.p.ServerNonce, s.p.IsServer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tx, err = NewCipherState(s.p.Suite, txKey, epoch); err != nil {
+		return nil, nil, err
+	}
+	if rx, err = NewCipherState(s.p.Suite, rxKey, epoch); err != nil {
+		return nil, nil, err
+	}
+	tx.SetLimits(s.p.Limits)
+	rx.SetLimits(s.p.Limits)
+	return tx, rx, nil
+}
+
+func (s *Session) install(secret []byte, epoch uint32) error {
+	tx, rx, err := s.ciphers(secret, epoch)
+	if err != nil {
+		return err
+	}
+	if s.rx != nil {
+		s.dropPrev()
+		s.prevRx, s.prevReplay = s.rx, s.rxReplay
+		s.prevUntil = time.Now().Add(s.p.Overlap)
+		s.tx.Retire()
+		s.rekeys++
+	}
+	s.tx, s.rx, s.rxReplay = tx, rx, replay.New(s.p.ReplayWindow)
+	s.secret, s.epoch = secret, epoch
+	s.rekeyedAt = time.Now()
+	return nil
+}
+
+// dropPrev forgets the previous epoch's rx state, keeping its replay counters.
+func (s *Session) dropPrev() {
+	if s.prevReplay != nil {
+		s.duplicates += s.prevReplay.Duplicates()
+		s.tooOld += s.prevReplay.TooOld()
+	}
+	s.prevRx, s.prevReplay, s.prevHeld = nil, nil, false
+}
+
+// Epoch returns the current key epoch.
+func (s *Session) Epoch() uint32 {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return s.epoch
+}
+
+// Rekey ratchets the secret with the REKEY nonce and switches to epoch.
+// epoch must be exactly one past the current epoch.
+func (s *Session) Rekey(epoch uint32, nonce []byte) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	next, err := s.ratchet(epoch, nonce)
+	if err != nil {
+		return err
+	}
+	return s.install(next, epoch)
+}
+
+// BeginRekey is Rekey for the side that sends REKEY, which may be lost: it
+// switches rx at once, so the peer can seal in the new epoch as soon as it
+// has REKEY, but keeps sealing in the old epoch, and accepting it, until the
+// peer confirms with an acknowledgement (FinishRekey) or its first record
+// in the new epoch.
+func (s *Session) BeginRekey(epoch uint32, nonce []byte) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	next, err := s.ratchet(epoch, nonce)
+	if err != nil {
+		return err
+	}
+	tx, rx, err := s.ciphers(next, epoch)
+	if err != nil {
+		return err
+	}
+	s.dropPrev()
+	s.prevRx, s.prevReplay, s.prevHeld = s.rx, s.rxReplay, true
+	s.rx, s.rxReplay = rx, replay.New(s.p.ReplayWindow)
+	s.nextTx, s.rekeyNonce = tx, append([]byte(nil), nonce...)
+	s.secret, s.epoch = next, epoch
+	s.rekeyedAt = time.Now()
+	return nil
+}
+
+// RekeyPending reports whether a rekey begun by BeginRekey awaits the peer.
+func (s *Session) RekeyPending() bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return s.nextTx != nil
+}
+
+// RekeyTag authenticates the acknowledgement of the REKEY for epoch with
+// nonce, proving the sender holds the session and saw that REKEY.
+func (s *Session) RekeyTag(epoch uint32, nonce []byte) [16]byte {
+	mac := hmac.New(sha256.New, s.joinKey)
+	mac.Write([]byte{'K'})
+	mac.Write(s.p.SessionID[:])
+	mac.Write(binary.BigEndian.AppendUint32(nil, epoch))
+	mac.Write(nonce)
+	var tag [16]byte
+	copy(tag[:], mac.Sum(nil))
+	return tag
+}
+
+// FinishRekey switches tx to the epoch begun by BeginRekey when tag
+// acknowledges it. It reports whether it did; repeated, stale or forged
+// acknowledgements change nothing.
+func (s *Session) FinishRekey(epoch uint32, tag [16]byte) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if s.nextTx == nil || epoch != s.epoch {
+		return false
+	}
+	want := s.RekeyTag(epoch, s.rekeyNonce)
+	if !hmac.Equal(tag[:], want[:]) {
+		return false
+	}
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	s.finish()
+	return true
+}
+
+// finish completes a begun rekey. Callers hold txMu and rxMu.
+func (s *Session) finish() {
+	s.tx.Retire()
+	s.tx, s.nextTx, s.rekeyNonce = s.nextTx, nil, nil
+	s.prevHeld = false
+	s.prevUntil = time.Now().Add(s.p.Overlap)
+	s.rekeys++
+}
+
+// ratchet derives the secret of epoch, which must be exactly one past the
+// current epoch, from the current secret and the REKEY nonce. Callers hold
+// txMu and rxMu.
+func (s *Session) ratchet(epoch uint32, nonce []byte) ([]byte, error) {
+	if s.nextTx != nil {
+		return nil, errors.New("rekey pending")
+	}
+	if epoch != s.epoch+1 {
+		return nil, errors.New("unexpected rekey epoch")
+	}
+	salt := make([]byte, 4+len(nonce))
+	binary.BigEndian.PutUint32(salt, epoch)
+	copy(salt[4:], nonce)
+	next := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, s.secret, salt, []byte("noxv2-rekey")), next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// RekeyDue reports whether the current epoch is older than interval, has
+// carried more than maxBytes in either direction, or crossed a soft limit.
+// Zero disables interval and maxBytes. A pending rekey is never due again.
+func (s *Session) RekeyDue(interval time.Duration, maxBytes uint64) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	if s.nextTx != nil {
+		return false
+	}
+	if interval > 0 && time.Since(s.rekeyedAt) >= interval {
+		return true
+	}
+	if s.tx.NeedsRekey() || s.rx.NeedsRekey() {
+		return true
+	}
+	return maxBytes > 0 && (s.tx.Bytes() >= maxBytes || s.rx.Bytes() >= maxBytes)
+}
+
+// Stats returns a snapshot of the session counters.
+func (s *Session) Stats() Stats {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	dups, old := s.duplicates+s.rxReplay.Duplicates(), s.tooOld+s.rxReplay.TooOld()
+	if s.prevReplay != nil {
+		dups += s.prevReplay.Duplicates()
+		old += s.prevReplay.TooOld()
+	}
+	return Stats{
+		Epoch:        s.epoch,
+		Rekeys:       s.rekeys,
+		TxPackets:    s.tx.Packets(),
+		TxBytes:      s.tx.Bytes(),
+		RxPackets:    s.rx.Packets(),
+		RxBytes:      s.rx.Bytes(),
+		TxTotal:      s.txTotal,
+		RxTotal:      s.rxTotal,
+		SoftLimit:    s.tx.NeedsRekey() || s.rx.NeedsRekey(),
+		Refused:      s.refused,
+		Replays:      dups + old,
+		Duplicates:   dups,
+		TooOld:       old,
+		AuthFailures: s.failures,
+		TxPadding:    s.txPad,
+		RxPadding:    s.rxPad,
+	}
+}
+
+// DataOverhead is what sealing adds to a padded packet: seq(8) and the tag.
+const DataOverhead = 8 + TagLen
+
+// SealData encrypts pkt, padded per the session policy, into a data
+// payload: seq(8) || ciphertext. It fails with ErrKeyExhausted once the
+// current key hits a hard limit.
+func (s *Session) SealData(pkt []byte) ([]byte, error) {
+	size := s.p.Padding.Size(len(pkt), s.p.MTU)
+	buf := make([]byte, 8+len(pkt), DataOverhead+size)
+	copy(buf[8:], pkt)
+	return s.seal(buf, len(pkt), size)
+}
+
+// SealInPlace is SealData for an n-byte packet already at buf[8:]: the
+// payload is built over it and returned as a prefix of buf, without
+// allocating. buf needs capacity for the padding and DataOverhead.
+func (s *Session) SealInPlace(buf []byte, n int) ([]byte, error) {
+	size := s.p.Padding.Size(n, s.p.MTU)
+	if len(buf) < 8+n || cap(buf) < DataOverhead+size {
+		return nil, errors.New("data buffer too small")
+	}
+	return s.seal(buf, n, size)
+}
+
+func (s *Session) seal(buf []byte, n, size int) ([]byte, error) {
+	pkt := buf[8 : 8+n]
+	pt := pkt
+	if s.p.Padding.Mode != padding.Off {
+		pt = padding.Pad(pkt[:0], pkt, size)
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	seq := s.tx.Seq()
+	payload, err := s.tx.SealTo(buf[:8], nil, pt)
+	if err != nil {
+		s.refused++
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(payload[0:8], seq)
+	s.txTotal += uint64(n)
+	s.txPad += uint64(len(pt) - n)
+	return payload, nil
+}
+
+// OpenData authenticates a data payload against the current epoch and, during
+// the overlap, the previous one. The replay window is only updated for
+// payloads that authenticate.
+func (s *Session) OpenData(payload []byte) ([]byte, error) {
+	return s.open(payload, false)
+}
+
+// OpenInPlace is OpenData decrypting over the payload itself: the packet it
+// returns aliases payload, which is overwritten even if the open fails.
+func (s *Session) OpenInPlace(payload []byte) ([]byte, error) {
+	return s.open(payload, true)
+}
+
+func (s *Session) open(payload []byte, inPlace bool) ([]byte, error) {
+	pt, confirms, err := s.openRx(payload, inPlace)
+	if confirms != 0 {
+		// The peer seals in the new epoch, so it has the REKEY.
+		s.txMu.Lock()
+		s.rxMu.Lock()
+		if s.nextTx != nil && s.epoch == confirms {
+			s.finish()
+		}
+		s.rxMu.Unlock()
+		s.txMu.Unlock()
+	}
+	return pt, err
+}
+
+// openRx opens a payload. confirms is the epoch of a pending rekey that the
+// payload was sealed in, if any.
+func (s *Session) openRx(payload []byte, inPlace bool) (pt []byte, confirms uint32, err error) {
+	if len(payload) < 8 {
+		return nil, 0, errors.New("data payload too short")
+	}
+	seq := binary.BigEndian.Uint64(payload[:8])
+	ct := payload[8:]
+	var dst []byte
+	if inPlace {
+		dst = ct[:0]
+	}
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	if inPlace && s.prevRx != nil {
+		// A failed open wipes its output; keep the ciphertext for the
+		// previous epoch.
+		s.rxSpare = append(s.rxSpare[:0], ct...)
+	}
+	pt, err = s.rx.OpenTo(dst, seq, nil, ct)
+	if err == nil {
+		if !s.rxReplay.Check(seq) {
+			return nil, 0, ErrReplay
+		}
+		s.rx.Commit(len(pt))
+		if s.prevHeld {
+			confirms = s.rx.epoch
+		}
+		pt, err = s.unpad(pt)
+		return pt, confirms, err
+	}
+	if s.prevRx != nil && !s.prevHeld && time.Now().After(s.prevUntil) {
+		s.dropPrev()
+	}
+	if s.prevRx == nil {
+		s.failures++
+		return nil, 0, err
+	}
+	if inPlace {
+		ct = s.rxSpare
+	}
+	pt, err = s.prevRx.OpenTo(dst, seq, nil, ct)
+	if err != nil {
+		s.failures++
+		return nil, 0, err
+	}
+	if !s.prevReplay.Check(seq) {
+		return nil, 0, ErrReplay
+	}
+	s.prevRx.Commit(len(pt))
+	pt, err = s.unpad(pt)
+	return pt, 0, err
+}
+
+// unpad strips padding from an authenticated plaintext. Callers hold rxMu.
+func (s *Session) unpad(pt []byte) ([]byte, error) {
+	if s.p.Padding.Mode != padding.Off {
+		pkt, err := padding.Unpad(pt)
+		if err != nil {
+			return nil, err
+		}
+		s.rxPad += uint64(len(pt) - len(pkt))
+		pt = pkt
+	}
+	s.rxTotal += uint64(len(pt))
+	return pt, nil
+}
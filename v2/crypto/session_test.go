@@ -0,0 +1,337 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"nox-core/v2/padding"
+)
+
+func sessionPair(t *testing.T) (*Session, *Session) {
+	return sessionPairWith(t, SessionParams{})
+}
+
+// sessionPairWith builds matching server/client sessions; the server side
+// additionally gets p's Overlap, Limits and ReplayWindow.
+func sessionPairWith(t testing.TB, p SessionParams) (*Session, *Session) {
+	t.Helper()
+	p.Secret = make([]byte, 32)
+	p.Secret[0] = 7
+	p.ClientNonce = make([]byte, 16)
+	p.ServerNonce = make([]byte, 16)
+	p.IsServer = true
+	srv, err := NewSession(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.IsServer = false
+	p.Overlap, p.Limits, p.ReplayWindow = 0, Limits{}, 0
+	cli, err := NewSession(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, cli
+}
+
+func mustSeal(t *testing.T, s *Session, pkt []byte) []byte {
+	t.Helper()
+	payload, err := s.SealData(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestSessionRoundTripAndReplay(t *testing.T) {
+	srv, cli := sessionPair(t)
+	payload := mustSeal(t, cli, []byte("ping"))
+	pt, err := srv.OpenData(payload)
+	if err != nil || string(pt) != "ping" {
+		t.Fatalf("open: %v %q", err, pt)
+	}
+	if _, err := srv.OpenData(payload); err != ErrReplay {
+		t.Fatalf("replay not rejected: %v", err)
+	}
+	// Replays must not use up the key.
+	if st := srv.Stats(); st.RxPackets != 1 || st.RxBytes != 4 {
+		t.Fatalf("replay counted against the key: %+v", st)
+	}
+}
+
+func TestSessionPadding(t *testing.T) {
+	pol, _ := padding.Parse("128,512")
+	srv, cli := sessionPairWith(t, SessionParams{Padding: pol, MTU: 1400})
+	for _, n := range []int{4, 100, 126} {
+		payload := mustSeal(t, cli, make([]byte, n))
+		if len(payload) != 8+128+16 {
+			t.Fatalf("%d-byte packet sealed to %d bytes", n, len(payload))
+		}
+		pt, err := srv.OpenData(payload)
+		if err != nil || len(pt) != n {
+			t.Fatalf("open: %v, %d bytes", err, len(pt))
+		}
+	}
+	if tx, rx := cli.Stats().TxPadding, srv.Stats().RxPadding; tx != 3*128-230 || rx != tx {
+		t.Fatalf("padding tx %d rx %d", tx, rx)
+	}
+	if rx := srv.Stats().RxTotal; rx != 230 {
+		t.Fatalf("rx total %d counts padding", rx)
+	}
+}
+
+func TestSessionReorderedWindow(t *testing.T) {
+	srv, cli := sessionPairWith(t, SessionParams{ReplayWindow: 2048})
+	var payloads [][]byte
+	for i := 0; i < 2048; i++ {
+		payloads = append(payloads, mustSeal(t, cli, []byte{byte(i)}))
+	}
+	for i := len(payloads) - 1; i >= 0; i-- {
+		if _, err := srv.OpenData(payloads[i]); err != nil {
+			t.Fatalf("reordered seq %d rejected: %v", i, err)
+		}
+	}
+	srv.OpenData(payloads[5])
+	for i := 0; i < 2048; i++ {
+		mustSeal(t, cli, nil)
+	}
+	if _, err := srv.OpenData(mustSeal(t, cli, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.OpenData(payloads[0]); err != ErrReplay {
+		t.Fatalf("stale seq: %v", err)
+	}
+	st := srv.Stats()
+	if st.Duplicates != 1 || st.TooOld != 1 || st.Replays != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestSessionRekeyOverlap(t *testing.T) {
+	srv, cli := sessionPairWith(t, SessionParams{Overlap: 50 * time.Millisecond})
+	nonce := make([]byte, 16)
+	nonce[0] = 9
+
+	inFlight := mustSeal(t, cli, []byte("old"))
+	if err := srv.Rekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.OpenData(inFlight); err != nil {
+		t.Fatalf("old epoch rejected during overlap: %v", err)
+	}
+	if err := cli.Rekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := srv.OpenData(mustSeal(t, cli, []byte("new"))); err != nil || string(pt) != "new" {
+		t.Fatalf("new epoch: %v", err)
+	}
+	if pt, err := cli.OpenData(mustSeal(t, srv, []byte("down"))); err != nil || string(pt) != "down" {
+		t.Fatalf("server->client new epoch: %v", err)
+	}
+	if err := cli.Rekey(4, nonce); err == nil {
+		t.Fatalf("skipped epoch accepted")
+	}
+
+	stale := mustSeal(t, cli, []byte("stale"))
+	if err := srv.Rekey(3, nonce); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := srv.OpenData(stale); err == nil {
+		t.Fatalf("old epoch accepted after overlap")
+	}
+}
+
+func TestSessionBeginRekey(t *testing.T) {
+	srv, cli := sessionPairWith(t, SessionParams{Overlap: 10 * time.Millisecond})
+	nonce := make([]byte, 16)
+	nonce[0] = 9
+
+	// REKEY is lost: both sides stay on epoch 1, past the overlap.
+	if err := srv.BeginRekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.RekeyPending() || srv.RekeyDue(0, 0) {
+		t.Fatal("pending rekey not reported")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if pt, err := cli.OpenData(mustSeal(t, srv, []byte("down"))); err != nil || string(pt) != "down" {
+		t.Fatalf("old epoch not kept for sealing: %v", err)
+	}
+	if pt, err := srv.OpenData(mustSeal(t, cli, []byte("up"))); err != nil || string(pt) != "up" {
+		t.Fatalf("old epoch not kept for opening: %v", err)
+	}
+
+	if err := cli.Rekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if srv.FinishRekey(2, [16]byte{}) || srv.FinishRekey(1, cli.RekeyTag(1, nonce)) {
+		t.Fatal("forged or stale acknowledgement accepted")
+	}
+	if !srv.FinishRekey(2, cli.RekeyTag(2, nonce)) || srv.FinishRekey(2, cli.RekeyTag(2, nonce)) {
+		t.Fatal("acknowledgement not taken exactly once")
+	}
+	if pt, err := cli.OpenData(mustSeal(t, srv, []byte("new"))); err != nil || string(pt) != "new" {
+		t.Fatalf("new epoch after acknowledgement: %v", err)
+	}
+
+	// Without an acknowledgement, a record in the new epoch confirms.
+	if err := srv.BeginRekey(3, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Rekey(3, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.OpenData(mustSeal(t, cli, []byte("up"))); err != nil || srv.RekeyPending() {
+		t.Fatalf("new-epoch record did not confirm: %v", err)
+	}
+	if st := srv.Stats(); st.Epoch != 3 || st.Rekeys != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestSessionInPlace(t *testing.T) {
+	pol, _ := padding.Parse("128")
+	srv, cli := sessionPairWith(t, SessionParams{Padding: pol, MTU: 1400})
+	buf := make([]byte, 8+4, 8+128+TagLen)
+	copy(buf[8:], "ping")
+	payload, err := cli.SealInPlace(buf, 4)
+	if err != nil || len(payload) != 8+128+TagLen || &payload[0] != &buf[0] {
+		t.Fatalf("seal: %v, %d bytes", err, len(payload))
+	}
+	if _, err := cli.SealInPlace(make([]byte, 8+200), 200); err == nil {
+		t.Fatal("sealed past the buffer")
+	}
+
+	// An in-place open that fails on the new epoch still has the
+	// ciphertext for the previous one.
+	nonce := make([]byte, 16)
+	if err := srv.Rekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	pt, err := srv.OpenInPlace(payload)
+	if err != nil || string(pt) != "ping" || &pt[0] != &payload[8] {
+		t.Fatalf("open across rekey: %v %q", err, pt)
+	}
+}
+
+func TestSessionRekeyDue(t *testing.T) {
+	srv, _ := sessionPair(t)
+	if srv.RekeyDue(time.Hour, 1024) {
+		t.Fatalf("fresh session due")
+	}
+	mustSeal(t, srv, make([]byte, 2048))
+	if !srv.RekeyDue(time.Hour, 1024) {
+		t.Fatalf("byte limit not reached")
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	srv, cli := sessionPairWith(t, SessionParams{Limits: Limits{SoftPackets: 2, HardPackets: 3, SoftBytes: 1 << 20, HardBytes: 1 << 20}})
+	nonce := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		if _, err := cli.OpenData(mustSeal(t, srv, []byte("x"))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && !srv.RekeyDue(0, 0) {
+			t.Fatalf("soft limit did not request rekey")
+		}
+	}
+	if _, err := srv.SealData([]byte("x")); err != ErrKeyExhausted {
+		t.Fatalf("seal past hard limit: %v", err)
+	}
+	st := srv.Stats()
+	if st.TxPackets != 3 || st.Refused != 1 || !st.SoftLimit || st.Rekeys != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if err := srv.Rekey(2, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.SealData([]byte("x")); err != nil {
+		t.Fatalf("seal after rekey: %v", err)
+	}
+}
+
+func TestCipherStateRetire(t *testing.T) {
+	c, err := NewCipherState(SuiteChaCha20Poly1305, make([]byte, 32), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retire()
+	if _, err := c.Seal(nil, []byte("x")); err != ErrKeyRetired {
+		t.Fatalf("retired state sealed: %v", err)
+	}
+}
+
+func TestSessionSuites(t *testing.T) {
+	for _, suite := range []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM} {
+		srv, cli := sessionPairWith(t, SessionParams{Suite: suite})
+		pt, err := srv.OpenData(mustSeal(t, cli, []byte("ping")))
+		if err != nil || string(pt) != "ping" {
+			t.Fatalf("%s: %v", suite, err)
+		}
+	}
+	aes, _ := sessionPairWith(t, SessionParams{Suite: SuiteAES256GCM})
+	_, chacha := sessionPair(t)
+	if _, err := aes.OpenData(mustSeal(t, chacha, []byte("x"))); err == nil {
+		t.Fatalf("suite mismatch not detected")
+	}
+}
+
+func TestSelectSuite(t *testing.T) {
+	prefs := []Suite{SuiteAES256GCM, SuiteChaCha20Poly1305}
+	if s, ok := SelectSuite(prefs, []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM}); !ok || s != SuiteAES256GCM {
+		t.Fatalf("got %v", s)
+	}
+	if s, ok := SelectSuite(prefs, []Suite{SuiteChaCha20Poly1305}); !ok || s != SuiteChaCha20Poly1305 {
+		t.Fatalf("got %v", s)
+	}
+	if _, ok := SelectSuite([]Suite{SuiteAES256GCM}, []Suite{SuiteChaCha20Poly1305}); ok {
+		t.Fatalf("disjoint lists matched")
+	}
+	if got, err := ParseSuites("aes256gcm, chacha20poly1305"); err != nil || len(got) != 2 || got[0] != SuiteAES256GCM {
+		t.Fatalf("parse: %v %v", got, err)
+	}
+}
+
+func TestJoinTag(t *testing.T) {
+	srv, cli := sessionPair(t)
+	nonce := []byte("0123456789abcdef")
+	if srv.JoinTag(true, nonce) != cli.JoinTag(true, nonce) {
+		t.Fatal("client tag differs between the two ends")
+	}
+	if srv.JoinTag(true, nonce) == srv.JoinTag(false, nonce) {
+		t.Fatal("client and server tags are equal")
+	}
+	other, _ := sessionPairWith(t, SessionParams{SessionID: [8]byte{1}})
+	if other.JoinTag(true, nonce) == srv.JoinTag(true, nonce) {
+		t.Fatal("tag does not depend on the session")
+	}
+	// Rekeying must not invalidate joins.
+	before := cli.JoinTag(true, nonce)
+	if err := cli.Rekey(2, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if cli.JoinTag(true, nonce) != before {
+		t.Fatal("tag changed with the epoch")
+	}
+}
+
+func TestResumeSecret(t *testing.T) {
+	srv, cli := sessionPair(t)
+	if !bytes.Equal(srv.ResumeSecret(), cli.ResumeSecret()) {
+		t.Fatal("resume secret differs between the two ends")
+	}
+	if bytes.Equal(srv.ResumeSecret(), srv.joinKey) {
+		t.Fatal("resume secret equals the join key")
+	}
+	cn, sn := []byte("client nonce 16b"), []byte("server nonce 16b")
+	a, err := ResumedSecret(cli.ResumeSecret(), cn, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ResumedSecret(cli.ResumeSecret(), cn, []byte("another nonce 16"))
+	if bytes.Equal(a, b) || bytes.Equal(a, cli.ResumeSecret()) {
+		t.Fatal("resumed secret does not depend on the nonces")
+	}
+}
@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"crypto/aes"
+	stdcipher "crypto/cipher"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Suite identifies the AEAD protecting data records.
+type Suite uint8
+
+const (
+	SuiteChaCha20Poly1305 Suite = 0x01
+	SuiteAES256GCM        Suite = 0x02
+)
+
+// String returns the suite name as accepted by ParseSuite.
+func (s Suite) String() string {
+	switch s {
+	case SuiteChaCha20Poly1305:
+		return "chacha20poly1305"
+	case SuiteAES256GCM:
+		return "aes256gcm"
+	default:
+		return fmt.Sprintf("suite(%#02x)", uint8(s))
+	}
+}
+
+func (s Suite) newAEAD(key []byte) (stdcipher.AEAD, error) {
+	switch s {
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case SuiteAES256GCM:
+		if len(key) != keyLen {
+			return nil, fmt.Errorf("aes256gcm: bad key length %d", len(key))
+		}
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return stdcipher.NewGCM(b)
+	default:
+		return nil, fmt.Errorf("unsupported suite %s", s)
+	}
+}
+
+// ParseSuite maps a suite name to its Suite.
+func ParseSuite(name string) (Suite, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "chacha20poly1305", "chacha20-poly1305", "chacha":
+		return SuiteChaCha20Poly1305, nil
+	case "aes256gcm", "aes-256-gcm", "aes":
+		return SuiteAES256GCM, nil
+	default:
+		return 0, fmt.Errorf("unknown cipher suite %q", name)
+	}
+}
+
+// ParseSuites parses a comma-separated preference list.
+func ParseSuites(list string) ([]Suite, error) {
+	var out []Suite
+	for _, name := range strings.Split(list, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		s, err := ParseSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// HasAESHardware reports whether AES-GCM runs on dedicated instructions.
+func HasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
+
+// DefaultSuites returns the local preference order: AES-GCM first when the
+// CPU accelerates it, ChaCha20-Poly1305 first otherwise.
+func DefaultSuites() []Suite {
+	if HasAESHardware() {
+		return []Suite{SuiteAES256GCM, SuiteChaCha20Poly1305}
+	}
+	return []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM}
+}
+
+// SelectSuite returns the first suite in prefs that offered contains.
+func SelectSuite(prefs, offered []Suite) (Suite, bool) {
+	for _, p := range prefs {
+		for _, o := range offered {
+			if p == o {
+				return p, true
+			}
+		}
+	}
+	return 0, false
+}
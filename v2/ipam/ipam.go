@@ -15,11 +15,12 @@ type Lease struct {
 }
 
 type Manager struct {
-	mu     sync.Mutex
-	subnet *net.IPNet
-	nextIP net.IP
-	ttl    time.Duration
-	leases map[string]Lease
+	mu       sync.Mutex
+	subnet   *net.IPNet
+	nextIP   net.IP
+	ttl      time.Duration
+	leases   map[string]Lease
+	reserved map[string]bool
 }
 
 func New(subnet *net.IPNet, ttl time.Duration) (*Manager, error) {
@@ -27,7 +28,7 @@ func New(subnet *net.IPNet, ttl time.Duration) (*Manager, error) {
 		return nil, errors.New("ipv4 subnet required")
 	}
 	first := firstHost(subnet)
-	return &Manager{subnet: subnet, nextIP: first, ttl: ttl, leases: make(map[string]Lease)}, nil
+	return &Manager{subnet: subnet, nextIP: first, ttl: ttl, leases: make(map[string]Lease), reserved: make(map[string]bool)}, nil
 }
 
 func firstHost(n *net.IPNet) net.IP {
@@ -64,7 +65,7 @@ func (m *Manager) Allocate(session [8]byte) (Lease, error) {
 	for i := 0; i < usable; i++ {
 		offset := (int(start-base-1) + i) % usable
 		cand := uint32ToIP(base + uint32(offset+1))
-		if m.isUsable(cand) && !m.inUse(cand) {
+		if m.isUsable(cand) && !m.inUse(cand) && !m.reserved[cand.String()] {
 			lease := Lease{IP: append(net.IP(nil), cand...), Session: session, Acquired: time.Now(), Expires: time.Now().Add(m.ttl)}
 			m.leases[key] = lease
 			m.nextIP = uint32ToIP(base + uint32((offset+1)%usable+1))
@@ -74,6 +75,41 @@ func (m *Manager) Allocate(session [8]byte) (Lease, error) {
 	return Lease{}, errors.New("no available addresses")
 }
 
+// Reserve replaces the set of addresses kept out of dynamic allocation.
+func (m *Manager) Reserve(ips []net.IP) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved = make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		m.reserved[ip.String()] = true
+	}
+}
+
+// AllocateIP leases a specific address to session, e.g. a peer's fixed address.
+func (m *Manager) AllocateIP(session [8]byte, ip net.IP) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ip = ip.To4()
+	if ip == nil || !m.isUsable(ip) {
+		return Lease{}, errors.New("address outside pool")
+	}
+	key := string(session[:])
+	if l, ok := m.leases[key]; ok && l.IP.Equal(ip) {
+		l.Expires = time.Now().Add(m.ttl)
+		m.leases[key] = l
+		return l, nil
+	}
+	for k, l := range m.leases {
+		if k != key && l.IP.Equal(ip) && l.Expires.After(time.Now()) {
+			return Lease{}, errors.New("address in use")
+		}
+	}
+	lease := Lease{IP: append(net.IP(nil), ip...), Session: session, Acquired: time.Now(), Expires: time.Now().Add(m.ttl)}
+	m.leases[key] = lease
+	return lease, nil
+}
+
 func (m *Manager) inUse(ip net.IP) bool {
 	for _, l := range m.leases {
 		if l.IP.Equal(ip) && l.Expires.After(time.Now()) {
@@ -97,6 +133,19 @@ func (m *Manager) Release(session [8]byte) {
 	}
 }
 
+// Renew extends the lease of a session that is still alive by another TTL.
+// It reports whether the session had a lease.
+func (m *Manager) Renew(session [8]byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.leases[string(session[:])]
+	if ok {
+		l.Expires = time.Now().Add(m.ttl)
+		m.leases[string(session[:])] = l
+	}
+	return ok
+}
+
 // Sweep removes expired leases.
 func (m *Manager) Sweep() {
 	m.mu.Lock()
@@ -59,3 +59,54 @@ func TestExhaustionAndSweep(t *testing.T) {
 		t.Fatalf("expected reuse after sweep: %v", err)
 	}
 }
+
+func TestReservedAndFixed(t *testing.T) {
+	m, err := New(mustCIDR(t, "10.8.0.0/29"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := net.ParseIP("10.8.0.1")
+	m.Reserve([]net.IP{fixed})
+	l, err := m.Allocate([8]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.IP.Equal(fixed) {
+		t.Fatalf("dynamic lease took reserved address")
+	}
+	l, err = m.AllocateIP([8]byte{2}, fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.IP.Equal(fixed) {
+		t.Fatalf("got %v, want %v", l.IP, fixed)
+	}
+	if _, err := m.AllocateIP([8]byte{3}, fixed); err == nil {
+		t.Fatalf("fixed address handed out twice")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	m, err := New(mustCIDR(t, "10.8.0.0/30"), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, s2 := [8]byte{1}, [8]byte{2}
+	l1, _ := m.Allocate(s1)
+	if _, err := m.Allocate(s2); err != nil {
+		t.Fatal(err)
+	}
+	// A live session's renewed lease is never handed out again.
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if !m.Renew(s1) {
+			t.Fatal("lease not found")
+		}
+	}
+	if l, err := m.Allocate([8]byte{3}); err == nil && l.IP.Equal(l1.IP) {
+		t.Fatalf("renewed lease %s reallocated", l.IP)
+	}
+	if m.Renew([8]byte{9}) {
+		t.Fatal("renewed an unknown session")
+	}
+}
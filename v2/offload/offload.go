@@ -0,0 +1,311 @@
+// Package offload carries kernel GSO superpackets across the tunnel. A TUN
+// opened with IFF_VNET_HDR hands out TCP and UDP superpackets of up to 64 KB
+// behind a virtio_net_hdr; sent whole, one superpacket costs one record
+// instead of dozens. A superpacket plaintext is Marker || Hdr || Packet, the
+// header in wire order; the receiver gives it to its own TUN as it is, or
+// splits it into the packets the kernel would have sent where it has to.
+package offload
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"nox-core/v2/crypto"
+	"nox-core/v2/padding"
+	"nox-core/v2/protocol"
+)
+
+// Marker is the first byte of a superpacket plaintext. Batches start with
+// 0x00 and IP packets with their version, so the three never collide.
+const Marker = 0x01
+
+// HdrLen is the size of a virtio_net_hdr.
+const HdrLen = 10
+
+// MaxPacket is the largest superpacket that fits one data record with its
+// marker, header, padding trailer, sequence number and tag.
+const MaxPacket = protocol.MaxRecordLen - protocol.RecordHeaderLen - crypto.DataOverhead - padding.TrailerLen - 1 - HdrLen
+
+// MinGSOSize is the smallest segment payload Segment accepts. No real path
+// has a smaller MSS, and it bounds how many packets one superpacket fans out
+// into.
+const MinGSOSize = 64
+
+// virtio_net_hdr flags and GSO types.
+const (
+	FlagNeedsCsum = 1
+
+	GSONone  = 0
+	GSOTCPv4 = 1
+	GSOTCPv6 = 4
+	GSOUDPL4 = 5
+	GSOECN   = 0x80
+)
+
+// TUN_F_* offload flags, as TUNSETOFFLOAD takes them.
+const (
+	tunTSO4 = 0x02
+	tunTSO6 = 0x04
+	tunUSO4 = 0x20
+	tunUSO6 = 0x40
+)
+
+// Hdr is a virtio_net_hdr. The kernel uses native byte order, the wire big
+// endian.
+type Hdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// Parse decodes a header in the given byte order.
+func Parse(b []byte, order binary.ByteOrder) (Hdr, error) {
+	if len(b) < HdrLen {
+		return Hdr{}, errors.New("offload: short header")
+	}
+	return Hdr{
+		Flags:      b[0],
+		GSOType:    b[1],
+		HdrLen:     order.Uint16(b[2:4]),
+		GSOSize:    order.Uint16(b[4:6]),
+		CsumStart:  order.Uint16(b[6:8]),
+		CsumOffset: order.Uint16(b[8:10]),
+	}, nil
+}
+
+// Put encodes h into b in the given byte order.
+func (h Hdr) Put(b []byte, order binary.ByteOrder) {
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	order.PutUint16(b[2:4], h.HdrLen)
+	order.PutUint16(b[4:6], h.GSOSize)
+	order.PutUint16(b[6:8], h.CsumStart)
+	order.PutUint16(b[8:10], h.CsumOffset)
+}
+
+// IsSuper reports whether a data plaintext is a superpacket.
+func IsSuper(pt []byte) bool {
+	return len(pt) > 0 && pt[0] == Marker
+}
+
+// Packet returns the IP packet of a data plaintext, superpacket or not.
+func Packet(pt []byte) []byte {
+	if IsSuper(pt) && len(pt) >= 1+HdrLen {
+		return pt[1+HdrLen:]
+	}
+	return pt
+}
+
+// FromTun turns n bytes read from a vnet TUN into b[1:], header and packet,
+// into a data plaintext at the start of b. A superpacket keeps its header,
+// in wire order, behind Marker; anything else gets its checksum completed
+// and becomes a bare IP packet. A read that filled b may have been cut short
+// and is refused.
+func FromTun(b []byte, n int) ([]byte, error) {
+	if 1+n >= len(b) {
+		return nil, errors.New("offload: packet fills the buffer")
+	}
+	h, err := Parse(b[1:1+n], binary.NativeEndian)
+	if err != nil {
+		return nil, err
+	}
+	if h.GSOType != GSONone {
+		b[0] = Marker
+		h.Put(b[1:], binary.BigEndian)
+		return b[:1+n], nil
+	}
+	pkt := b[1+HdrLen : 1+n]
+	if err := Complete(h, pkt); err != nil {
+		return nil, err
+	}
+	return b[:copy(b, pkt)], nil
+}
+
+// Complete fills in the checksum the kernel left partial for hardware to
+// finish: the field holds the pseudo-header sum, and the sum from CsumStart
+// to the end goes in its place.
+func Complete(h Hdr, pkt []byte) error {
+	if h.Flags&FlagNeedsCsum == 0 {
+		return nil
+	}
+	start, at := int(h.CsumStart), int(h.CsumStart)+int(h.CsumOffset)
+	if at+2 > len(pkt) {
+		return errors.New("offload: checksum outside packet")
+	}
+	csum := ^fold(sum(pkt[start:], 0))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(pkt[at:], csum)
+	return nil
+}
+
+// Accepts reports whether a TUN with the given TUN_F_* offloads takes a
+// superpacket of gsoType whole.
+func Accepts(offloads uint, gsoType uint8) bool {
+	switch gsoType &^ GSOECN {
+	case GSOTCPv4:
+		return offloads&tunTSO4 != 0
+	case GSOTCPv6:
+		return offloads&tunTSO6 != 0
+	case GSOUDPL4:
+		return offloads&(tunUSO4|tunUSO6) == tunUSO4|tunUSO6
+	}
+	return false
+}
+
+// Tun is a TUN queue that data plaintexts are delivered to.
+type Tun interface {
+	WritePacket(pkt []byte) (int, error) // header and packet, on a vnet TUN
+	WriteIP(pkt []byte) (int, error)     // a bare IP packet
+}
+
+// ToTun writes a received data plaintext to t, whose TUN has the given
+// offloads. A superpacket the TUN cannot take whole is split first. The
+// header of pt is rewritten in place.
+func ToTun(t Tun, offloads uint, pt []byte) error {
+	if !IsSuper(pt) {
+		_, err := t.WriteIP(pt)
+		return err
+	}
+	h, err := Parse(pt[1:], binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	if Accepts(offloads, h.GSOType) {
+		h.Put(pt[1:], binary.NativeEndian)
+		_, err = t.WritePacket(pt[1:])
+		return err
+	}
+	return Segment(pt, func(pkt []byte) { _, _ = t.WriteIP(pkt) })
+}
+
+// Segment splits a superpacket plaintext into the packets the kernel would
+// have sent, with their lengths, IPv4 IDs, sequence numbers and checksums
+// set. Each is built in a scratch buffer and only valid during its fn call.
+func Segment(pt []byte, fn func(pkt []byte)) error {
+	if !IsSuper(pt) {
+		return errors.New("offload: no marker")
+	}
+	h, err := Parse(pt[1:], binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	pkt := pt[1+HdrLen:]
+	if len(pkt) < 1 {
+		return errors.New("offload: empty superpacket")
+	}
+	v6 := pkt[0]>>4 == 6
+	var proto byte
+	switch h.GSOType &^ GSOECN {
+	case GSOTCPv4, GSOTCPv6:
+		proto = 6
+	case GSOUDPL4:
+		proto = 17
+	default:
+		return errors.New("offload: unsupported GSO type")
+	}
+	ipLen := int(h.CsumStart)
+	if v6 && ipLen < 40 || !v6 && (pkt[0]>>4 != 4 || ipLen < 20 || ipLen != int(pkt[0]&0x0f)*4) {
+		return errors.New("offload: bad network header")
+	}
+	hdrLen := ipLen + 8
+	if proto == 6 {
+		if len(pkt) < ipLen+20 {
+			return errors.New("offload: short TCP header")
+		}
+		doff := int(pkt[ipLen+12] >> 4)
+		if doff < 5 {
+			return errors.New("offload: bad TCP data offset")
+		}
+		hdrLen = ipLen + doff*4
+	}
+	if hdrLen > len(pkt) {
+		return errors.New("offload: headers exceed superpacket")
+	}
+	mss := int(h.GSOSize)
+	if mss < MinGSOSize {
+		return errors.New("offload: GSO size too small")
+	}
+
+	scratch := protocol.GetBuffer()
+	defer protocol.PutBuffer(scratch)
+	buf := *scratch
+	payload := pkt[hdrLen:]
+	id := binary.BigEndian.Uint16(pkt[4:6])
+	seq := uint32(0)
+	if proto == 6 {
+		seq = binary.BigEndian.Uint32(pkt[ipLen+4:])
+	}
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+mss {
+		chunk := payload[off:min(off+mss, len(payload))]
+		last := off+len(chunk) == len(payload)
+		seg := buf[:hdrLen+len(chunk)]
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], chunk)
+
+		l4 := seg[ipLen:]
+		var pseudo uint32
+		if v6 {
+			binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)-40))
+			pseudo = sum(seg[8:40], uint32(proto)+uint32(len(l4)))
+		} else {
+			binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:6], id+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:12], ^fold(sum(seg[:ipLen], 0)))
+			pseudo = sum(seg[12:20], uint32(proto)+uint32(len(l4)))
+		}
+		if proto == 6 {
+			binary.BigEndian.PutUint32(l4[4:8], seq+uint32(off))
+			if !last {
+				l4[13] &^= 0x01 | 0x08 // FIN, PSH
+			}
+			if i > 0 {
+				l4[13] &^= 0x80 // CWR
+			}
+			l4[16], l4[17] = 0, 0
+			binary.BigEndian.PutUint16(l4[16:18], ^fold(sum(l4, pseudo)))
+		} else {
+			binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+			l4[6], l4[7] = 0, 0
+			csum := ^fold(sum(l4, pseudo))
+			if csum == 0 {
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(l4[6:8], csum)
+		}
+		fn(seg)
+	}
+	return nil
+}
+
+// sum adds b as big-endian 16-bit words to acc, one's complement style.
+func sum(b []byte, acc uint32) uint32 {
+	s := uint64(acc)
+	for len(b) >= 8 {
+		s += uint64(binary.BigEndian.Uint32(b)) + uint64(binary.BigEndian.Uint32(b[4:]))
+		b = b[8:]
+	}
+	for len(b) >= 2 {
+		s += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint64(b[0]) << 8
+	}
+	for s > 0xffffffff {
+		s = s&0xffffffff + s>>32
+	}
+	return uint32(s)
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
@@ -0,0 +1,212 @@
+package offload
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tcp4 builds an IPv4/TCP superpacket plaintext with n payload bytes cut
+// into mss-sized segments, flags FIN|PSH|CWR set.
+func tcp4(n, mss int) []byte {
+	pkt := make([]byte, 40+n)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:6], 0xfffe)
+	pkt[8], pkt[9] = 64, 6
+	copy(pkt[12:20], []byte{10, 8, 0, 2, 1, 1, 1, 1})
+	binary.BigEndian.PutUint32(pkt[24:28], 0xfffff000)
+	pkt[32] = 5 << 4
+	pkt[33] = 0x80 | 0x08 | 0x01
+	for i := range pkt[40:] {
+		pkt[40+i] = byte(i)
+	}
+	pt := make([]byte, 1+HdrLen+len(pkt))
+	pt[0] = Marker
+	Hdr{Flags: FlagNeedsCsum, GSOType: GSOTCPv4, HdrLen: 40, GSOSize: uint16(mss), CsumStart: 20, CsumOffset: 16}.Put(pt[1:], binary.BigEndian)
+	copy(pt[1+HdrLen:], pkt)
+	return pt
+}
+
+func udp6(n, mss int) []byte {
+	pkt := make([]byte, 48+n)
+	pkt[0] = 0x60
+	pkt[6], pkt[7] = 17, 64
+	pkt[8], pkt[23], pkt[24], pkt[39] = 0xfd, 1, 0xfd, 2
+	binary.BigEndian.PutUint16(pkt[40:42], 4433)
+	binary.BigEndian.PutUint16(pkt[42:44], 443)
+	pt := make([]byte, 1+HdrLen+len(pkt))
+	pt[0] = Marker
+	Hdr{Flags: FlagNeedsCsum, GSOType: GSOUDPL4, HdrLen: 48, GSOSize: uint16(mss), CsumStart: 40, CsumOffset: 6}.Put(pt[1:], binary.BigEndian)
+	copy(pt[1+HdrLen:], pkt)
+	return pt
+}
+
+// valid checks a transport checksum against the pseudo header.
+func valid(seg []byte, ipLen int, proto byte) bool {
+	l4 := seg[ipLen:]
+	var pseudo uint32
+	if seg[0]>>4 == 6 {
+		pseudo = sum(seg[8:40], uint32(proto)+uint32(len(l4)))
+	} else {
+		pseudo = sum(seg[12:20], uint32(proto)+uint32(len(l4)))
+	}
+	return fold(sum(l4, pseudo)) == 0xffff
+}
+
+func TestSegmentTCP(t *testing.T) {
+	var segs [][]byte
+	if err := Segment(tcp4(2500, 1000), func(p []byte) { segs = append(segs, append([]byte(nil), p...)) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 3 {
+		t.Fatalf("%d segments", len(segs))
+	}
+	for i, seg := range segs {
+		want := 1040
+		if i == 2 {
+			want = 540
+		}
+		if len(seg) != want || int(binary.BigEndian.Uint16(seg[2:4])) != want {
+			t.Fatalf("segment %d: %d bytes", i, len(seg))
+		}
+		if id := binary.BigEndian.Uint16(seg[4:6]); id != 0xfffe+uint16(i) {
+			t.Fatalf("segment %d: id %x", i, id)
+		}
+		if fold(sum(seg[:20], 0)) != 0xffff || !valid(seg, 20, 6) {
+			t.Fatalf("segment %d: bad checksum", i)
+		}
+		if seq := binary.BigEndian.Uint32(seg[24:28]); seq != 0xfffff000+uint32(i*1000) {
+			t.Fatalf("segment %d: seq %x", i, seq)
+		}
+		if seg[40] != byte(i*1000) {
+			t.Fatalf("segment %d: payload starts %d", i, seg[40])
+		}
+	}
+	if segs[0][33] != 0x80 || segs[1][33] != 0 || segs[2][33] != 0x09 {
+		t.Fatalf("flags %x %x %x", segs[0][33], segs[1][33], segs[2][33])
+	}
+}
+
+func TestSegmentUDP(t *testing.T) {
+	var lens []int
+	err := Segment(udp6(3000, 1200), func(p []byte) {
+		if !valid(p, 40, 17) || int(binary.BigEndian.Uint16(p[4:6])) != len(p)-40 || int(binary.BigEndian.Uint16(p[44:46])) != len(p)-40 {
+			t.Fatalf("bad segment of %d bytes", len(p))
+		}
+		lens = append(lens, len(p))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lens) != 3 || lens[0] != 1248 || lens[2] != 648 {
+		t.Fatalf("segments %v", lens)
+	}
+
+	for _, bad := range [][]byte{{0x45}, {Marker}, append([]byte{Marker}, make([]byte, HdrLen+20)...)} {
+		if Segment(bad, func([]byte) {}) == nil {
+			t.Fatalf("Segment(%x) accepted", bad)
+		}
+	}
+}
+
+func TestSegmentMalformed(t *testing.T) {
+	mutate := map[string]func(pt []byte){
+		"tcp data offset 0":   func(pt []byte) { pt[1+HdrLen+32] = 0 },
+		"tcp data offset 4":   func(pt []byte) { pt[1+HdrLen+32] = 4 << 4 },
+		"tcp header past end": func(pt []byte) { pt[1+HdrLen+32] = 15 << 4 },
+		"gso size 1":          func(pt []byte) { binary.BigEndian.PutUint16(pt[1+4:], 1) },
+		"gso size 0":          func(pt []byte) { binary.BigEndian.PutUint16(pt[1+4:], 0) },
+		"csum start past end": func(pt []byte) { binary.BigEndian.PutUint16(pt[1+6:], 60000) },
+		"ihl mismatch":        func(pt []byte) { pt[1+HdrLen] = 0x4f },
+	}
+	for name, fn := range mutate {
+		pt := tcp4(10, 1000)
+		fn(pt)
+		if Segment(pt, func([]byte) {}) == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	// Headers alone, with a tiny payload, must not reach past the segment.
+	pt := tcp4(0, 1000)
+	pt[1+HdrLen+32] = 0
+	if Segment(pt[:1+HdrLen+40], func([]byte) {}) == nil {
+		t.Error("zero data offset without payload accepted")
+	}
+	udp := udp6(100, 1200)
+	if Segment(udp[:1+HdrLen+44], func([]byte) {}) == nil {
+		t.Error("truncated UDP header accepted")
+	}
+}
+
+func TestFromTun(t *testing.T) {
+	// A lone UDP packet with a partial checksum comes out complete and
+	// without its header.
+	b := make([]byte, 1+HdrLen+28+4+1)
+	pkt := b[1+HdrLen : len(b)-1]
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[9] = 17
+	copy(pkt[12:20], []byte{10, 8, 0, 2, 1, 1, 1, 1})
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(len(pkt)-20))
+	copy(pkt[28:], "ping")
+	binary.BigEndian.PutUint16(pkt[26:28], fold(sum(pkt[12:20], 17+uint32(len(pkt)-20))))
+	Hdr{Flags: FlagNeedsCsum, CsumStart: 20, CsumOffset: 6}.Put(b[1:], binary.NativeEndian)
+	pt, err := FromTun(b, len(b)-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsSuper(pt) || len(pt) != 32 || pt[0] != 0x45 || !valid(pt, 20, 17) {
+		t.Fatalf("plain packet %x", pt)
+	}
+
+	super := tcp4(3000, 1000)
+	b = make([]byte, len(super)+1)
+	h, _ := Parse(super[1:], binary.BigEndian)
+	h.Put(b[1:], binary.NativeEndian)
+	copy(b[1+HdrLen:], super[1+HdrLen:])
+	if _, err := FromTun(b, len(b)-1); err == nil {
+		t.Fatal("read that filled the buffer accepted")
+	}
+	pt, err = FromTun(b, len(b)-2)
+	if err != nil || string(pt) != string(super) {
+		t.Fatalf("superpacket not kept: %v", err)
+	}
+	if len(Packet(pt)) != 3040 {
+		t.Fatalf("Packet() = %d bytes", len(Packet(pt)))
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	if !Accepts(tunTSO4|tunTSO6, GSOTCPv4|GSOECN) || Accepts(tunTSO4|tunTSO6, GSOUDPL4) || !Accepts(tunTSO6|tunUSO4|tunUSO6, GSOUDPL4) {
+		t.Fatal("wrong offload match")
+	}
+}
+
+type fakeTun struct{ super, ip [][]byte }
+
+func (f *fakeTun) WritePacket(p []byte) (int, error) {
+	f.super = append(f.super, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (f *fakeTun) WriteIP(p []byte) (int, error) {
+	f.ip = append(f.ip, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestToTun(t *testing.T) {
+	var plain fakeTun
+	if err := ToTun(&plain, 0, tcp4(3000, 1000)); err != nil || len(plain.ip) != 3 || len(plain.super) != 0 {
+		t.Fatalf("without offloads: %v, %d packets, %d superpackets", err, len(plain.ip), len(plain.super))
+	}
+	var vnet fakeTun
+	if err := ToTun(&vnet, tunTSO4|tunTSO6, tcp4(3000, 1000)); err != nil || len(vnet.super) != 1 {
+		t.Fatalf("with TSO: %v, %d superpackets", err, len(vnet.super))
+	}
+	if h, _ := Parse(vnet.super[0], binary.NativeEndian); h.GSOSize != 1000 || len(vnet.super[0]) != HdrLen+3040 {
+		t.Fatalf("superpacket header %+v", h)
+	}
+	if err := ToTun(&vnet, tunTSO4|tunTSO6, udp6(3000, 1200)); err != nil || len(vnet.ip) != 3 {
+		t.Fatalf("UDP without USO: %v, %d packets", err, len(vnet.ip))
+	}
+}
@@ -0,0 +1,115 @@
+// Package padding hides IP packet sizes inside data records. A padded
+// plaintext is pkt || zeros || PadLen(2): the trailer says how many bytes
+// before it are padding, so the receiver strips it after decryption.
+package padding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TrailerLen is the size of the padding-length trailer.
+const TrailerLen = 2
+
+// Mode selects how far plaintexts are padded.
+type Mode uint8
+
+const (
+	Off     Mode = 0 // no padding and no trailer
+	Buckets Mode = 1 // pad up to the smallest bucket that fits
+	Random  Mode = 2 // pad to a random size up to the MTU
+)
+
+// Policy is a session's padding setting, chosen by the server.
+type Policy struct {
+	Mode    Mode
+	Buckets []uint16 // padded sizes in ascending order, Buckets mode only
+}
+
+// Parse reads "off", "random" or a comma-separated list of bucket sizes,
+// e.g. "128,256,512,1024,1400".
+func Parse(s string) (Policy, error) {
+	switch s {
+	case "", "off":
+		return Policy{}, nil
+	case "random":
+		return Policy{Mode: Random}, nil
+	}
+	p := Policy{Mode: Buckets}
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+		if err != nil || n <= TrailerLen {
+			return Policy{}, fmt.Errorf("padding: bad bucket size %q", f)
+		}
+		p.Buckets = append(p.Buckets, uint16(n))
+	}
+	if len(p.Buckets) > 255 {
+		return Policy{}, errors.New("padding: at most 255 buckets")
+	}
+	sort.Slice(p.Buckets, func(i, j int) bool { return p.Buckets[i] < p.Buckets[j] })
+	return p, nil
+}
+
+func (p Policy) String() string {
+	switch p.Mode {
+	case Off:
+		return "off"
+	case Random:
+		return "random"
+	}
+	sizes := make([]string, len(p.Buckets))
+	for i, b := range p.Buckets {
+		sizes[i] = strconv.Itoa(int(b))
+	}
+	return strings.Join(sizes, ",")
+}
+
+// Size returns the padded plaintext size, trailer included, for an n-byte
+// packet on a tunnel with the given MTU. Packets larger than every bucket or
+// than the MTU only get the trailer.
+func (p Policy) Size(n, mtu int) int {
+	min := n + TrailerLen
+	switch p.Mode {
+	case Off:
+		return n
+	case Buckets:
+		for _, b := range p.Buckets {
+			if int(b) >= min {
+				return int(b)
+			}
+		}
+	case Random:
+		if mtu > min {
+			return min + rand.IntN(mtu-min+1)
+		}
+	}
+	return min
+}
+
+// Pad appends pkt padded to size bytes to dst. size comes from Size.
+func Pad(dst, pkt []byte, size int) []byte {
+	pad := size - len(pkt) - TrailerLen
+	dst = append(dst, pkt...)
+	for i := 0; i < pad; i++ {
+		dst = append(dst, 0)
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(pad))
+}
+
+// Unpad returns the packet inside a padded plaintext.
+func Unpad(pt []byte) ([]byte, error) {
+	if len(pt) < TrailerLen {
+		return nil, errors.New("padding: short plaintext")
+	}
+	end := len(pt) - TrailerLen
+	pad := int(binary.BigEndian.Uint16(pt[end:]))
+	if pad > end {
+		return nil, errors.New("padding: length exceeds plaintext")
+	}
+	return pt[:end-pad], nil
+}
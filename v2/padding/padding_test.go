@@ -0,0 +1,76 @@
+package padding
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                "off",
+		"off":             "off",
+		"random":          "random",
+		"1400,256,512":    "256,512,1400",
+		"128, 1024, 1400": "128,1024,1400",
+	} {
+		p, err := Parse(in)
+		if err != nil || p.String() != want {
+			t.Fatalf("Parse(%q) = %v %v, want %s", in, p, err, want)
+		}
+	}
+	for _, bad := range []string{"2", "abc", "70000", "128,,256"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("Parse(%q) accepted", bad)
+		}
+	}
+}
+
+func TestBucketSizes(t *testing.T) {
+	p, _ := Parse("128,512,1400")
+	for n, want := range map[int]int{0: 128, 100: 128, 126: 128, 127: 512, 1398: 1400, 1399: 1401, 2000: 2002} {
+		if got := p.Size(n, 1400); got != want {
+			t.Fatalf("Size(%d) = %d, want %d", n, got, want)
+		}
+	}
+	if got := (Policy{}).Size(100, 1400); got != 100 {
+		t.Fatalf("off: Size(100) = %d", got)
+	}
+}
+
+func TestRandomWithinMTU(t *testing.T) {
+	p := Policy{Mode: Random}
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		s := p.Size(100, 200)
+		if s < 102 || s > 200 {
+			t.Fatalf("size %d outside [102, 200]", s)
+		}
+		seen[s] = true
+	}
+	if len(seen) < 20 {
+		t.Fatalf("only %d distinct sizes", len(seen))
+	}
+	if s := p.Size(1400, 1400); s != 1402 {
+		t.Fatalf("full-size packet padded to %d", s)
+	}
+}
+
+func TestPadRoundTrip(t *testing.T) {
+	pkt := []byte("an ip packet")
+	for _, size := range []int{len(pkt) + TrailerLen, 64, 1400} {
+		pt := Pad(nil, pkt, size)
+		if len(pt) != size {
+			t.Fatalf("padded to %d, want %d", len(pt), size)
+		}
+		got, err := Unpad(pt)
+		if err != nil || !bytes.Equal(got, pkt) {
+			t.Fatalf("unpad: %q %v", got, err)
+		}
+	}
+	if _, err := Unpad([]byte{0, 1, 0, 9}); err == nil {
+		t.Fatal("oversized pad length accepted")
+	}
+	if _, err := Unpad([]byte{1}); err == nil {
+		t.Fatal("short plaintext accepted")
+	}
+}
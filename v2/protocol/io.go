@@ -4,35 +4,107 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
+	"sync"
 )
 
+const (
+	// RecordHeaderLen is the record length prefix plus the frame header.
+	RecordHeaderLen = 2 + 6
+	// MaxRecordLen is the largest record on the wire, length prefix included.
+	MaxRecordLen = 2 + 65535
+)
+
+var bufPool = sync.Pool{New: func() any {
+	b := make([]byte, MaxRecordLen)
+	return &b
+}}
+
+// GetBuffer returns a MaxRecordLen buffer from the record pool.
+func GetBuffer() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+// PutBuffer returns b, resliced or not, to the record pool.
+func PutBuffer(b *[]byte) {
+	*b = (*b)[:cap(*b)]
+	bufPool.Put(b)
+}
+
+// PutRecordHeader fills the first RecordHeaderLen bytes of rec with the length
+// prefix and frame header for the payload after them, so rec can be written
+// as it is.
+func PutRecordHeader(rec []byte, kind uint8) error {
+	if len(rec) < RecordHeaderLen || len(rec) > MaxRecordLen {
+		return fmt.Errorf("frame too large")
+	}
+	binary.BigEndian.PutUint16(rec[0:2], uint16(len(rec)-2))
+	rec[2] = Version
+	rec[3] = kind
+	binary.BigEndian.PutUint16(rec[4:6], 0) // reserved
+	binary.BigEndian.PutUint16(rec[6:8], uint16(len(rec)-RecordHeaderLen))
+	return nil
+}
+
 // WriteRecord writes a length-prefixed frame to w.
 func WriteRecord(w io.Writer, f Frame) error {
-	raw, err := Encode(f)
-	if err != nil {
-		return err
-	}
-	if len(raw) > 65535 {
+	if 6+len(f.Payload) > 65535 {
 		return fmt.Errorf("frame too large")
 	}
-	lenBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBuf, uint16(len(raw)))
-	if _, err := w.Write(lenBuf); err != nil {
+	var hdr [RecordHeaderLen]byte
+	binary.BigEndian.PutUint16(hdr[0:2], uint16(6+len(f.Payload)))
+	hdr[2] = f.Version
+	hdr[3] = f.Kind
+	binary.BigEndian.PutUint16(hdr[6:8], uint16(len(f.Payload)))
+	// One Write per record: datagram transports send each Write as a packet.
+	// Plain sockets take header and payload in a single writev.
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers{hdr[:], f.Payload}
+		_, err := bufs.WriteTo(w)
 		return err
 	}
-	_, err = w.Write(raw)
+	bp := GetBuffer()
+	defer PutBuffer(bp)
+	rec := (*bp)[:RecordHeaderLen+len(f.Payload)]
+	copy(rec, hdr[:])
+	copy(rec[RecordHeaderLen:], f.Payload)
+	_, err := w.Write(rec)
 	return err
 }
 
-// ReadRecord reads a length-prefixed frame.
+// ReadRecord reads a length-prefixed frame. The payload is the caller's;
+// loops over a connection should use a Reader instead.
 func ReadRecord(r io.Reader) (Frame, error) {
-	lenBuf := make([]byte, 2)
-	if _, err := io.ReadFull(r, lenBuf); err != nil {
+	bp := GetBuffer()
+	defer PutBuffer(bp)
+	rd := Reader{r: r, buf: *bp}
+	f, err := rd.Read()
+	if err != nil {
+		return Frame{}, err
+	}
+	f.Payload = append([]byte(nil), f.Payload...)
+	return f, nil
+}
+
+// Reader reads records into one buffer it reuses, so reading does not
+// allocate. A frame's Payload is only valid until the next Read.
+type Reader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buf: make([]byte, MaxRecordLen)}
+}
+
+// Read reads the next record.
+func (r *Reader) Read() (Frame, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:2]); err != nil {
 		return Frame{}, err
 	}
-	size := binary.BigEndian.Uint16(lenBuf)
-	raw := make([]byte, size)
-	if _, err := io.ReadFull(r, raw); err != nil {
+	raw := r.buf[2 : 2+int(binary.BigEndian.Uint16(r.buf[:2]))]
+	if _, err := io.ReadFull(r.r, raw); err != nil {
 		return Frame{}, err
 	}
 	return Decode(raw)
@@ -20,6 +20,18 @@ const (
 	CapMTUNeg      uint16 = 0x0004
 	CapQUIC        uint16 = 0x0008
 	CapReplayGuard uint16 = 0x0010
+	CapChaCha20    uint16 = 0x0020 // data suite ChaCha20-Poly1305
+	CapAESGCM      uint16 = 0x0040 // data suite AES-256-GCM
+	CapPadding     uint16 = 0x0080 // data plaintexts may carry padding
+	CapResume      uint16 = 0x0100 // client stores resumption tickets
+	CapBatch       uint16 = 0x0200 // data plaintexts may coalesce several packets
+	CapGSO         uint16 = 0x0400 // data plaintexts may carry GSO superpackets
+)
+
+// Data cipher suites selected in ASSIGN_IP.
+const (
+	SuiteChaCha20Poly1305 uint8 = 0x01
+	SuiteAES256GCM        uint8 = 0x02
 )
 
 // Control opcodes.
@@ -31,6 +43,24 @@ const (
 	CtrlRekey     uint8 = 0x05
 	CtrlClose     uint8 = 0x06
 	CtrlError     uint8 = 0x07
+	CtrlConfirm   uint8 = 0x08
+	CtrlRetry     uint8 = 0x09
+	CtrlJoin      uint8 = 0x0A
+	CtrlTicket    uint8 = 0x0B
+	CtrlResume    uint8 = 0x0C
+	CtrlRekeyAck  uint8 = 0x0D
+)
+
+// Reason codes carried in ERROR and CLOSE.
+const (
+	CodeBadHello   uint16 = 0x0001
+	CodeVersion    uint16 = 0x0002
+	CodeIPAM       uint16 = 0x0003
+	CodeHandshake  uint16 = 0x0004
+	CodeAuthFailed uint16 = 0x0005
+	CodeRevoked    uint16 = 0x0006
+	CodeNoSession  uint16 = 0x0007
+	CodeTicket     uint16 = 0x0008
 )
 
 // Frame is the common header for every record before encryption.
@@ -68,12 +98,15 @@ func Decode(data []byte) (Frame, error) {
 	return f, nil
 }
 
-// Hello carries client capabilities and nonce.
+// Hello carries client capabilities, nonce and the IK handshake fields.
 type Hello struct {
 	Capabilities uint16
 	SessionID    [8]byte
 	ClientNonce  [16]byte
 	DesiredMTU   uint16
+	Ephemeral    [32]byte // client ephemeral X25519 public key
+	Static       [48]byte // client static public key, sealed under es
+	Cookie       [16]byte // echo of a RETRY cookie, zero if none
 }
 
 // AssignIP assigns IPv4 and negotiated MTU.
@@ -83,8 +116,19 @@ type AssignIP struct {
 	PrefixLen   uint8
 	MTU         uint16
 	ServerNonce [16]byte
+	Ephemeral   [32]byte // server ephemeral X25519 public key
+	Auth        [16]byte // proves possession of the server static key
+	Suite       uint8    // data cipher suite chosen by the server
+	PadMode     uint8    // padding.Mode for both directions; 0 = none
+	PadBuckets  []uint16 // bucket sizes when PadMode is buckets
+	Granted     uint16   // offered capabilities the server enabled; sent only when non-zero
 }
 
+const (
+	helloLen  = 2 + 8 + 16 + 2 + 32 + 48 + 16
+	assignLen = 8 + 4 + 1 + 2 + 16 + 32 + 16 + 1
+)
+
 // Routes announces server-pushed routes.
 type Routes struct {
 	Nets []Route
@@ -107,6 +151,45 @@ type Rekey struct {
 	Nonce [16]byte
 }
 
+// RekeyAck confirms a REKEY; Tag proves the sender holds the session.
+type RekeyAck struct {
+	Epoch uint32
+	Tag   [16]byte
+}
+
+// Retry asks the client to resend HELLO with Cookie set.
+type Retry struct {
+	Cookie [16]byte
+}
+
+// Confirm carries the sealed transcript hash that closes the handshake.
+type Confirm struct {
+	Sealed [48]byte
+}
+
+// Join attaches another connection to an established session. The client
+// tag and the server's echo prove knowledge of the session keys.
+type Join struct {
+	SessionID [8]byte
+	Nonce     [16]byte
+	Tag       [16]byte
+}
+
+// Ticket hands the client an opaque resumption ticket after the handshake.
+type Ticket struct {
+	Lifetime uint32 // seconds
+	Opaque   []byte
+}
+
+// Resume replaces HELLO when the client holds a ticket.
+type Resume struct {
+	Capabilities uint16
+	SessionID    [8]byte
+	ClientNonce  [16]byte
+	DesiredMTU   uint16
+	Ticket       []byte
+}
+
 // Close notifies with a reason.
 type Close struct {
 	Code   uint16
@@ -121,17 +204,20 @@ type ErrorCode struct {
 
 // EncodeHello returns TLV payload for HELLO.
 func EncodeHello(h Hello) []byte {
-	buf := make([]byte, 8+16+2+2)
+	buf := make([]byte, helloLen)
 	binary.BigEndian.PutUint16(buf[0:], h.Capabilities)
 	copy(buf[2:10], h.SessionID[:])
 	copy(buf[10:26], h.ClientNonce[:])
 	binary.BigEndian.PutUint16(buf[26:], h.DesiredMTU)
+	copy(buf[28:60], h.Ephemeral[:])
+	copy(buf[60:108], h.Static[:])
+	copy(buf[108:124], h.Cookie[:])
 	return buf
 }
 
 // DecodeHello parses HELLO payload.
 func DecodeHello(p []byte) (Hello, error) {
-	if len(p) != 28 {
+	if len(p) != helloLen {
 		return Hello{}, errors.New("hello len")
 	}
 	var h Hello
@@ -139,23 +225,45 @@ func DecodeHello(p []byte) (Hello, error) {
 	copy(h.SessionID[:], p[2:10])
 	copy(h.ClientNonce[:], p[10:26])
 	h.DesiredMTU = binary.BigEndian.Uint16(p[26:28])
+	copy(h.Ephemeral[:], p[28:60])
+	copy(h.Static[:], p[60:108])
+	copy(h.Cookie[:], p[108:124])
 	return h, nil
 }
 
 // EncodeAssign serialises AssignIP payload.
 func EncodeAssign(a AssignIP) []byte {
-	buf := make([]byte, 8+4+1+2+16)
+	if len(a.PadBuckets) > 255 {
+		return nil
+	}
+	n := assignLen + 2 + 2*len(a.PadBuckets)
+	buf := make([]byte, n, n+2)
 	copy(buf[0:8], a.SessionID[:])
 	copy(buf[8:12], a.IPv4[:])
 	buf[12] = a.PrefixLen
 	binary.BigEndian.PutUint16(buf[13:15], a.MTU)
-	copy(buf[15:], a.ServerNonce[:])
+	copy(buf[15:31], a.ServerNonce[:])
+	copy(buf[31:63], a.Ephemeral[:])
+	copy(buf[63:79], a.Auth[:])
+	buf[79] = a.Suite
+	buf[80] = a.PadMode
+	buf[81] = byte(len(a.PadBuckets))
+	for i, b := range a.PadBuckets {
+		binary.BigEndian.PutUint16(buf[82+2*i:], b)
+	}
+	if a.Granted != 0 {
+		buf = binary.BigEndian.AppendUint16(buf, a.Granted)
+	}
 	return buf
 }
 
 // DecodeAssign parses AssignIP payload.
 func DecodeAssign(p []byte) (AssignIP, error) {
-	if len(p) != 8+4+1+2+16 {
+	if len(p) < assignLen+2 {
+		return AssignIP{}, errors.New("assign len")
+	}
+	n := assignLen + 2 + 2*int(p[assignLen+1])
+	if len(p) != n && len(p) != n+2 {
 		return AssignIP{}, errors.New("assign len")
 	}
 	var a AssignIP
@@ -163,7 +271,17 @@ func DecodeAssign(p []byte) (AssignIP, error) {
 	copy(a.IPv4[:], p[8:12])
 	a.PrefixLen = p[12]
 	a.MTU = binary.BigEndian.Uint16(p[13:15])
-	copy(a.ServerNonce[:], p[15:])
+	copy(a.ServerNonce[:], p[15:31])
+	copy(a.Ephemeral[:], p[31:63])
+	copy(a.Auth[:], p[63:79])
+	a.Suite = p[79]
+	a.PadMode = p[80]
+	for i := 0; i < int(p[81]); i++ {
+		a.PadBuckets = append(a.PadBuckets, binary.BigEndian.Uint16(p[82+2*i:]))
+	}
+	if len(p) == n+2 {
+		a.Granted = binary.BigEndian.Uint16(p[n:])
+	}
 	return a, nil
 }
 
@@ -238,6 +356,113 @@ func DecodeRekey(p []byte) (Rekey, error) {
 	return r, nil
 }
 
+// EncodeRekeyAck serialises REKEY_ACK.
+func EncodeRekeyAck(a RekeyAck) []byte {
+	buf := make([]byte, 4+16)
+	binary.BigEndian.PutUint32(buf[0:4], a.Epoch)
+	copy(buf[4:], a.Tag[:])
+	return buf
+}
+
+// DecodeRekeyAck parses REKEY_ACK.
+func DecodeRekeyAck(p []byte) (RekeyAck, error) {
+	if len(p) != 20 {
+		return RekeyAck{}, errors.New("rekey ack len")
+	}
+	var a RekeyAck
+	a.Epoch = binary.BigEndian.Uint32(p[0:4])
+	copy(a.Tag[:], p[4:])
+	return a, nil
+}
+
+// EncodeRetry serialises RETRY.
+func EncodeRetry(r Retry) []byte {
+	return append([]byte(nil), r.Cookie[:]...)
+}
+
+// DecodeRetry parses RETRY.
+func DecodeRetry(p []byte) (Retry, error) {
+	if len(p) != 16 {
+		return Retry{}, errors.New("retry len")
+	}
+	var r Retry
+	copy(r.Cookie[:], p)
+	return r, nil
+}
+
+// EncodeJoin serialises JOIN.
+func EncodeJoin(j Join) []byte {
+	buf := make([]byte, 0, 40)
+	buf = append(buf, j.SessionID[:]...)
+	buf = append(buf, j.Nonce[:]...)
+	return append(buf, j.Tag[:]...)
+}
+
+// DecodeJoin parses JOIN.
+func DecodeJoin(p []byte) (Join, error) {
+	if len(p) != 40 {
+		return Join{}, errors.New("join len")
+	}
+	var j Join
+	copy(j.SessionID[:], p[0:8])
+	copy(j.Nonce[:], p[8:24])
+	copy(j.Tag[:], p[24:40])
+	return j, nil
+}
+
+// EncodeTicket serialises TICKET.
+func EncodeTicket(t Ticket) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, t.Lifetime)
+	return append(buf, t.Opaque...)
+}
+
+// DecodeTicket parses TICKET.
+func DecodeTicket(p []byte) (Ticket, error) {
+	if len(p) < 5 {
+		return Ticket{}, errors.New("ticket len")
+	}
+	return Ticket{Lifetime: binary.BigEndian.Uint32(p[0:4]), Opaque: append([]byte(nil), p[4:]...)}, nil
+}
+
+// EncodeResume serialises RESUME.
+func EncodeResume(r Resume) []byte {
+	buf := make([]byte, 0, 30+len(r.Ticket))
+	buf = binary.BigEndian.AppendUint16(buf, r.Capabilities)
+	buf = append(buf, r.SessionID[:]...)
+	buf = append(buf, r.ClientNonce[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, r.DesiredMTU)
+	return append(buf, r.Ticket...)
+}
+
+// DecodeResume parses RESUME.
+func DecodeResume(p []byte) (Resume, error) {
+	if len(p) < 29 {
+		return Resume{}, errors.New("resume len")
+	}
+	var r Resume
+	r.Capabilities = binary.BigEndian.Uint16(p[0:2])
+	copy(r.SessionID[:], p[2:10])
+	copy(r.ClientNonce[:], p[10:26])
+	r.DesiredMTU = binary.BigEndian.Uint16(p[26:28])
+	r.Ticket = append([]byte(nil), p[28:]...)
+	return r, nil
+}
+
+// EncodeConfirm serialises CONFIRM.
+func EncodeConfirm(c Confirm) []byte {
+	return append([]byte(nil), c.Sealed[:]...)
+}
+
+// DecodeConfirm parses CONFIRM.
+func DecodeConfirm(p []byte) (Confirm, error) {
+	if len(p) != 48 {
+		return Confirm{}, errors.New("confirm len")
+	}
+	var c Confirm
+	copy(c.Sealed[:], p)
+	return c, nil
+}
+
 // EncodeClose encodes CLOSE/ERROR reasons.
 func EncodeClose(c Close) []byte {
 	reason := []byte(c.Reason)
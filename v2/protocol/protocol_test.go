@@ -1,6 +1,10 @@
 package protocol
 
-import "testing"
+import (
+	"bytes"
+	"net"
+	"testing"
+)
 
 func TestEncodeDecodeFrame(t *testing.T) {
 	f := Frame{Version: Version, Kind: KindControl, Payload: []byte{1, 2, 3}}
@@ -17,18 +21,120 @@ func TestEncodeDecodeFrame(t *testing.T) {
 	}
 }
 
+func TestRecords(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Vectored on a TCP socket.
+		WriteRecord(c, Frame{Version: Version, Kind: KindControl, Payload: []byte{CtrlHeartbeat, 0, 0, 0, 1}})
+		rec := append(make([]byte, RecordHeaderLen), "data"...)
+		PutRecordHeader(rec, KindData)
+		c.Write(rec)
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := NewReader(conn)
+	f, err := rd.Read()
+	if err != nil || f.Kind != KindControl || len(f.Payload) != 5 || f.Payload[4] != 1 {
+		t.Fatalf("control record: %+v %v", f, err)
+	}
+	f, err = rd.Read()
+	if err != nil || f.Kind != KindData || string(f.Payload) != "data" {
+		t.Fatalf("data record: %+v %v", f, err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRecord(&buf, Frame{Version: Version, Kind: KindData, Payload: []byte("x")}); err != nil || buf.Len() != RecordHeaderLen+1 {
+		t.Fatalf("buffered write: %d bytes, %v", buf.Len(), err)
+	}
+	if err := WriteRecord(&buf, Frame{Payload: make([]byte, 65530)}); err == nil {
+		t.Fatal("oversized frame written")
+	}
+	if PutRecordHeader(make([]byte, MaxRecordLen+1), KindData) == nil {
+		t.Fatal("oversized record framed")
+	}
+}
+
 func TestHelloRoundtrip(t *testing.T) {
 	var h Hello
 	h.Capabilities = CapMTUNeg | CapReplayGuard
 	h.SessionID[0] = 1
 	h.ClientNonce[0] = 2
 	h.DesiredMTU = 1400
+	h.Ephemeral[31] = 3
+	h.Static[47] = 4
+	h.Cookie[15] = 5
 	raw := EncodeHello(h)
 	got, err := DecodeHello(raw)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got.Capabilities != h.Capabilities || got.DesiredMTU != h.DesiredMTU {
+	if got != h {
 		t.Fatalf("roundtrip failed")
 	}
 }
+
+func TestAssignRoundtrip(t *testing.T) {
+	a := AssignIP{PrefixLen: 24, MTU: 1400, Suite: SuiteAES256GCM, PadMode: 1, PadBuckets: []uint16{256, 1400}}
+	a.IPv4 = [4]byte{10, 8, 0, 2}
+	a.Auth[15] = 6
+	raw := EncodeAssign(a)
+	got, err := DecodeAssign(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IPv4 != a.IPv4 || got.Auth != a.Auth || got.PadMode != 1 || len(got.PadBuckets) != 2 || got.PadBuckets[1] != 1400 {
+		t.Fatalf("roundtrip failed: %+v", got)
+	}
+	if _, err := DecodeAssign(raw[:len(raw)-1]); err == nil {
+		t.Fatal("truncated bucket list accepted")
+	}
+	if got.Granted != 0 {
+		t.Fatalf("granted %#x without the field", got.Granted)
+	}
+	a.Granted = CapBatch
+	raw = EncodeAssign(a)
+	if got, err = DecodeAssign(raw); err != nil || got.Granted != CapBatch || len(got.PadBuckets) != 2 {
+		t.Fatalf("granted roundtrip: %+v %v", got, err)
+	}
+	if _, err := DecodeAssign(append(raw, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+}
+
+func TestJoinRoundtrip(t *testing.T) {
+	j := Join{SessionID: [8]byte{1}, Nonce: [16]byte{2}, Tag: [16]byte{15: 3}}
+	got, err := DecodeJoin(EncodeJoin(j))
+	if err != nil || got != j {
+		t.Fatalf("roundtrip failed: %+v %v", got, err)
+	}
+	if _, err := DecodeJoin(make([]byte, 39)); err == nil {
+		t.Fatal("short join accepted")
+	}
+}
+
+func TestResumeAndTicketRoundtrip(t *testing.T) {
+	r := Resume{Capabilities: CapRekey, SessionID: [8]byte{1}, ClientNonce: [16]byte{2}, DesiredMTU: 1350, Ticket: []byte("opaque")}
+	got, err := DecodeResume(EncodeResume(r))
+	if err != nil || got.SessionID != r.SessionID || got.DesiredMTU != 1350 || string(got.Ticket) != "opaque" {
+		t.Fatalf("resume roundtrip: %+v %v", got, err)
+	}
+	if _, err := DecodeResume(EncodeResume(Resume{})); err == nil {
+		t.Fatal("resume without ticket accepted")
+	}
+	tk, err := DecodeTicket(EncodeTicket(Ticket{Lifetime: 3600, Opaque: []byte{9}}))
+	if err != nil || tk.Lifetime != 3600 || tk.Opaque[0] != 9 {
+		t.Fatalf("ticket roundtrip: %+v %v", tk, err)
+	}
+}
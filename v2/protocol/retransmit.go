@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrHandshakeTimeout is returned when no reply arrives before the deadline.
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// HandshakeConn is the part of a connection the Retransmitter needs.
+type HandshakeConn interface {
+	io.ReadWriter
+	SetReadDeadline(time.Time) error
+}
+
+// Retransmitter drives one side of the handshake. It remembers the last
+// flight sent and, while waiting for a reply, re-sends it whenever the
+// retransmission timeout expires, doubling the timeout each time. A zero RTO
+// disables retransmission for reliable transports.
+type Retransmitter struct {
+	conn     HandshakeConn
+	rto      time.Duration
+	deadline time.Time
+	flight   []Frame
+	sent     int
+}
+
+// NewRetransmitter gives up on reads once deadline passes.
+func NewRetransmitter(conn HandshakeConn, rto time.Duration, deadline time.Time) *Retransmitter {
+	return &Retransmitter{conn: conn, rto: rto, deadline: deadline}
+}
+
+// Send writes frames and makes them the flight to retransmit.
+func (r *Retransmitter) Send(frames ...Frame) error {
+	r.flight = frames
+	return r.Resend()
+}
+
+// Resend writes the current flight again.
+func (r *Retransmitter) Resend() error {
+	for _, f := range r.flight {
+		if err := WriteRecord(r.conn, f); err != nil {
+			return err
+		}
+	}
+	r.sent++
+	return nil
+}
+
+// Retransmits returns how many times a flight was sent beyond the first.
+func (r *Retransmitter) Retransmits() int {
+	if r.sent == 0 {
+		return 0
+	}
+	return r.sent - 1
+}
+
+// Read returns the next record, retransmitting the flight on timeouts.
+func (r *Retransmitter) Read() (Frame, error) {
+	for {
+		wait := time.Until(r.deadline)
+		if wait <= 0 {
+			return Frame{}, ErrHandshakeTimeout
+		}
+		if r.rto > 0 && r.rto < wait {
+			wait = r.rto
+		}
+		if err := r.conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return Frame{}, err
+		}
+		f, err := ReadRecord(r.conn)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return Frame{}, err
+		}
+		if r.rto == 0 || !time.Now().Before(r.deadline) {
+			return Frame{}, ErrHandshakeTimeout
+		}
+		r.rto *= 2
+		if err := r.Resend(); err != nil {
+			return Frame{}, err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"nox-core/pkg/keys"
+	"nox-core/v2/padding"
+)
+
+// Peer is one client identity known to the server.
+type Peer struct {
+	Name      string
+	PublicKey [32]byte
+	Allowed   bool
+	Address   net.IP          // optional fixed tunnel address
+	Padding   *padding.Policy // optional override of the server padding policy
+}
+
+// Fingerprint returns a short hex fingerprint of the peer public key.
+func (p Peer) Fingerprint() string {
+	return keys.Fingerprint(p.PublicKey[:])
+}
+
+// Registry is a file-backed set of peers keyed by static public key.
+//
+// File format, one peer per line, '#' starts a comment:
+//
+//	<name> <pubkey-hex> [allow|deny] [fixed-ipv4] [pad=<policy>]
+//
+// pad= overrides the server's padding policy for the peer: off, random, or a
+// comma-separated list of bucket sizes such as 128,256,512,1024,1400.
+type Registry struct {
+	mu    sync.RWMutex
+	path  string
+	peers map[[32]byte]Peer
+}
+
+// Load reads the registry file at path.
+func Load(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the backing file. On error the previous contents are kept.
+func (r *Registry) Reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	peers, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	r.mu.Lock()
+	r.peers = peers
+	r.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the peer registered for pub.
+func (r *Registry) Lookup(pub []byte) (Peer, bool) {
+	if len(pub) != 32 {
+		return Peer{}, false
+	}
+	var k [32]byte
+	copy(k[:], pub)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[k]
+	return p, ok
+}
+
+// FixedAddresses lists the fixed addresses of all peers.
+func (r *Registry) FixedAddresses() []net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []net.IP
+	for _, p := range r.peers {
+		if p.Address != nil {
+			out = append(out, p.Address)
+		}
+	}
+	return out
+}
+
+// Len returns the number of registered peers.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.peers)
+}
+
+// Parse reads peers in the registry file format.
+func Parse(rd io.Reader) (map[[32]byte]Peer, error) {
+	peers := make(map[[32]byte]Peer)
+	names := make(map[string]bool)
+	sc := bufio.NewScanner(rd)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 5 {
+			return nil, fmt.Errorf("line %d: expected <name> <pubkey> [allow|deny] [ip] [pad=policy]", line)
+		}
+		p := Peer{Name: fields[0], Allowed: true}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("line %d: public key must be 64 hex chars", line)
+		}
+		copy(p.PublicKey[:], key)
+		for _, f := range fields[2:] {
+			switch f {
+			case "allow":
+				p.Allowed = true
+			case "deny":
+				p.Allowed = false
+			default:
+				if v, ok := strings.CutPrefix(f, "pad="); ok {
+					pol, err := padding.Parse(v)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %v", line, err)
+					}
+					p.Padding = &pol
+					continue
+				}
+				ip := net.ParseIP(f).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("line %d: bad field %q", line, f)
+				}
+				p.Address = ip
+			}
+		}
+		if _, dup := peers[p.PublicKey]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key for %s", line, p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("line %d: duplicate name %s", line, p.Name)
+		}
+		names[p.Name] = true
+		peers[p.PublicKey] = p
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no peers")
+	}
+	return peers, nil
+}
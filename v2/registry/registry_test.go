@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	hexA = "970090a7b524599197bc7f8a58f27718522330fd9cefcff95c67d99a43e05e21"
+	hexB = "0101010101010101010101010101010101010101010101010101010101010101"
+)
+
+func TestParse(t *testing.T) {
+	in := "# peers\nalice " + hexA + " allow 10.8.0.10 pad=random\nbob " + hexB + " deny\n\n"
+	peers, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers", len(peers))
+	}
+	for _, p := range peers {
+		switch p.Name {
+		case "alice":
+			if !p.Allowed || p.Address.String() != "10.8.0.10" || p.Padding == nil || p.Padding.String() != "random" {
+				t.Fatalf("alice parsed as %+v", p)
+			}
+		case "bob":
+			if p.Allowed || p.Address != nil || p.Padding != nil {
+				t.Fatalf("bob parsed as %+v", p)
+			}
+		}
+	}
+	if _, err := Parse(strings.NewReader("carol " + hexA + " pad=1")); err == nil {
+		t.Fatalf("bad padding accepted")
+	}
+	if _, err := Parse(strings.NewReader("carol abcd")); err == nil {
+		t.Fatalf("short key accepted")
+	}
+	if _, err := Parse(strings.NewReader("a " + hexB + "\nb " + hexB)); err == nil {
+		t.Fatalf("duplicate key accepted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	if err := os.WriteFile(path, []byte("alice "+hexA+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub [32]byte
+	for k := range r.peers {
+		pub = k
+	}
+	if p, ok := r.Lookup(pub[:]); !ok || !p.Allowed {
+		t.Fatalf("alice not allowed")
+	}
+	if err := os.WriteFile(path, []byte("alice "+hexA+" deny\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := r.Lookup(pub[:]); p.Allowed {
+		t.Fatalf("reload did not apply deny")
+	}
+	if err := os.WriteFile(path, []byte("garbage\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatalf("bad file accepted")
+	}
+	if _, ok := r.Lookup(pub[:]); !ok {
+		t.Fatalf("failed reload dropped previous peers")
+	}
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"nox-core/pkg/keys"
+)
+
+// Revocations is a file-backed deny list of session IDs and client key
+// fingerprints. A missing file is an empty list.
+//
+// File format, one entry per line, '#' starts a comment:
+//
+//	session <session-id-hex>
+//	key <fingerprint-hex | pubkey-hex>
+//
+// Clients choose their own session IDs, so a session entry only ends that
+// session: the device can come back under a new ID. Revoke a lost device by
+// its key.
+type Revocations struct {
+	mu       sync.RWMutex
+	path     string
+	sessions map[[8]byte]bool
+	keys     map[string]bool // fingerprints
+}
+
+// LoadRevocations reads the revocation file at path.
+func LoadRevocations(path string) (*Revocations, error) {
+	r := &Revocations{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the backing file. On error the previous contents are kept.
+func (r *Revocations) Reload() error {
+	f, err := os.Open(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.mu.Lock()
+		r.sessions, r.keys = nil, nil
+		r.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sessions, fps, err := ParseRevocations(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	r.mu.Lock()
+	r.sessions, r.keys = sessions, fps
+	r.mu.Unlock()
+	return nil
+}
+
+// Revoked reports whether the session ID or the client public key is listed.
+func (r *Revocations) Revoked(session [8]byte, pub []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sessions[session] || (len(r.keys) > 0 && r.keys[keys.Fingerprint(pub)])
+}
+
+// Len returns the number of entries.
+func (r *Revocations) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions) + len(r.keys)
+}
+
+// ParseRevocations reads entries in the revocation file format. Full public
+// keys are stored by fingerprint.
+func ParseRevocations(rd io.Reader) (map[[8]byte]bool, map[string]bool, error) {
+	sessions := make(map[[8]byte]bool)
+	fps := make(map[string]bool)
+	sc := bufio.NewScanner(rd)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected session|key <hex>", line)
+		}
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: bad hex", line)
+		}
+		switch {
+		case fields[0] == "session" && len(raw) == 8:
+			var sid [8]byte
+			copy(sid[:], raw)
+			sessions[sid] = true
+		case fields[0] == "key" && len(raw) == 8:
+			fps[strings.ToLower(fields[1])] = true
+		case fields[0] == "key" && len(raw) == keys.Size:
+			fps[keys.Fingerprint(raw)] = true
+		default:
+			return nil, nil, fmt.Errorf("line %d: bad entry %q", line, fields[0]+" "+fields[1])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return sessions, fps, nil
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nox-core/pkg/keys"
+)
+
+func TestRevocations(t *testing.T) {
+	pubA, _ := hex.DecodeString(hexA)
+	pubB, _ := hex.DecodeString(hexB)
+	sid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	path := filepath.Join(t.TempDir(), "revoked")
+	r, err := LoadRevocations(path)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if r.Revoked(sid, pubA) {
+		t.Fatalf("empty list revoked something")
+	}
+
+	in := "# lost laptop\nsession 0102030405060708\nkey " + keys.Fingerprint(pubB) + "\n"
+	if err := os.WriteFile(path, []byte(in), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Revoked(sid, pubA) || !r.Revoked([8]byte{}, pubB) || r.Revoked([8]byte{}, pubA) {
+		t.Fatalf("wrong matches after reload")
+	}
+
+	if err := os.WriteFile(path, []byte("key "+hexA+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Revoked([8]byte{}, pubA) || r.Revoked(sid, pubB) {
+		t.Fatalf("full-key entry not applied")
+	}
+
+	if err := os.WriteFile(path, []byte("session abcd\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatalf("short session id accepted")
+	}
+	if !r.Revoked([8]byte{}, pubA) {
+		t.Fatalf("failed reload dropped previous entries")
+	}
+	if _, _, err := ParseRevocations(strings.NewReader("peer " + hexA)); err == nil {
+		t.Fatalf("unknown entry type accepted")
+	}
+}
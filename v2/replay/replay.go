@@ -1,21 +1,53 @@
 package replay
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
-// Window implements a sliding window replay detector.
+// Window sizes, in packets.
+const (
+	DefaultSize = 1024
+	MaxSize     = 8192
+)
+
+const wordBits = 64
+
+// Window implements a sliding window replay detector over a ring of 64-bit
+// words. Advancing the window clears whole words, so Check costs O(1) apart
+// from large jumps, which touch each ring word at most once.
 type Window struct {
 	mu     sync.Mutex
 	maxSeq uint64
-	window uint64
-	seen   uint64
+	size   uint64
+	ring   []uint64 // length is a power of two
+	mask   uint64
+
+	duplicates atomic.Uint64
+	tooOld     atomic.Uint64
 }
 
-// New returns a replay window with a given size (<=64).
+// New returns a replay window accepting sequence numbers up to size-1 behind
+// the highest one seen. Zero selects DefaultSize; size is capped at MaxSize.
 func New(size uint64) *Window {
-	if size == 0 || size > 64 {
-		size = 64
+	if size == 0 {
+		size = DefaultSize
+	}
+	if size > MaxSize {
+		size = MaxSize
 	}
-	return &Window{window: size}
+	// One spare word so the oldest in-window bits survive while the word
+	// holding maxSeq is being filled.
+	words := uint64(1)
+	for words < (size+wordBits-1)/wordBits+1 {
+		words <<= 1
+	}
+	return &Window{size: size, ring: make([]uint64, words), mask: words - 1}
+}
+
+// Size returns the window size in packets.
+func (w *Window) Size() uint64 {
+	return w.size
 }
 
 // Check returns false if the sequence is a replay or too old.
@@ -24,25 +56,36 @@ func (w *Window) Check(seq uint64) bool {
 	defer w.mu.Unlock()
 
 	if seq > w.maxSeq {
-		shift := seq - w.maxSeq
-		if shift >= 64 {
-			w.seen = 1 // only current bit
-		} else {
-			w.seen = (w.seen << shift) | 1
+		cur, next := w.maxSeq/wordBits, seq/wordBits
+		n := next - cur
+		if n > uint64(len(w.ring)) {
+			n = uint64(len(w.ring))
+		}
+		for i := uint64(1); i <= n; i++ {
+			w.ring[(cur+i)&w.mask] = 0
 		}
 		w.maxSeq = seq
-		return true
-	}
-
-	// seq <= maxSeq
-	offset := w.maxSeq - seq
-	if offset >= w.window {
+	} else if w.maxSeq-seq >= w.size {
+		w.tooOld.Add(1)
 		return false
 	}
-	mask := uint64(1) << offset
-	if w.seen&mask != 0 {
+
+	word := &w.ring[(seq/wordBits)&w.mask]
+	bit := uint64(1) << (seq % wordBits)
+	if *word&bit != 0 {
+		w.duplicates.Add(1)
 		return false
 	}
-	w.seen |= mask
+	*word |= bit
 	return true
 }
+
+// Duplicates returns how many sequence numbers were rejected as already seen.
+func (w *Window) Duplicates() uint64 {
+	return w.duplicates.Load()
+}
+
+// TooOld returns how many sequence numbers were rejected as behind the window.
+func (w *Window) TooOld() uint64 {
+	return w.tooOld.Load()
+}
@@ -18,4 +18,65 @@ func TestReplayWindow(t *testing.T) {
 	if !w.Check(100) {
 		t.Fatalf("far future seq rejected")
 	}
+	if w.Check(92) {
+		t.Fatalf("seq behind window accepted")
+	}
+	if w.Duplicates() != 2 || w.TooOld() != 1 {
+		t.Fatalf("counters dup=%d old=%d, want 2/1", w.Duplicates(), w.TooOld())
+	}
+}
+
+func TestReplayWindowLarge(t *testing.T) {
+	const size = 4096
+	w := New(size)
+	if w.Size() != size {
+		t.Fatalf("size %d", w.Size())
+	}
+	// Deliver a full window in reverse order.
+	top := uint64(2 * size)
+	if !w.Check(top) {
+		t.Fatalf("top rejected")
+	}
+	for seq := top - 1; seq > top-size; seq-- {
+		if !w.Check(seq) {
+			t.Fatalf("in-window seq %d rejected", seq)
+		}
+	}
+	if w.Check(top - size) {
+		t.Fatalf("seq exactly size behind accepted")
+	}
+	for seq := top - size + 1; seq <= top; seq += 97 {
+		if w.Check(seq) {
+			t.Fatalf("duplicate %d accepted", seq)
+		}
+	}
+	// Advance by less than a word, then by many words; old bits must not leak.
+	if !w.Check(top + 10) {
+		t.Fatalf("advance rejected")
+	}
+	if !w.Check(top + 3*size) {
+		t.Fatalf("jump rejected")
+	}
+	for seq := top + 2*size + 1; seq < top+3*size; seq += 61 {
+		if !w.Check(seq) {
+			t.Fatalf("fresh seq %d after jump rejected", seq)
+		}
+	}
+}
+
+func TestReplayWindowSizeBounds(t *testing.T) {
+	if got := New(0).Size(); got != DefaultSize {
+		t.Fatalf("default size %d", got)
+	}
+	if got := New(1 << 20).Size(); got != MaxSize {
+		t.Fatalf("capped size %d", got)
+	}
+}
+
+func BenchmarkCheckInOrder(b *testing.B) {
+	w := New(DefaultSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Check(uint64(i))
+	}
 }
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"nox-core/v2/crypto"
+	"nox-core/v2/protocol"
+)
+
+const cookieRotation = 2 * time.Minute
+
+// cookieJar issues stateless RETRY cookies: a MAC over the source address and
+// the HELLO fields under a secret that rotates every cookieRotation. Cookies
+// from the current and previous secret are accepted.
+type cookieJar struct {
+	mu      sync.Mutex
+	cur     []byte
+	prev    []byte
+	rotated time.Time
+	now     func() time.Time
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{now: time.Now}
+}
+
+func (j *cookieJar) secrets() (cur, prev []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cur == nil || j.now().Sub(j.rotated) >= cookieRotation {
+		fresh, err := crypto.RandomBytes(32)
+		if err == nil {
+			if j.cur != nil && j.now().Sub(j.rotated) < 2*cookieRotation {
+				j.prev = j.cur
+			} else {
+				j.prev = nil
+			}
+			j.cur, j.rotated = fresh, j.now()
+		}
+	}
+	return j.cur, j.prev
+}
+
+// Make returns the cookie for a HELLO from addr.
+func (j *cookieJar) Make(addr string, h protocol.Hello) [16]byte {
+	cur, _ := j.secrets()
+	return cookieMAC(cur, addr, h)
+}
+
+// Valid reports whether h carries a cookie issued to addr.
+func (j *cookieJar) Valid(addr string, h protocol.Hello) bool {
+	cur, prev := j.secrets()
+	want := cookieMAC(cur, addr, h)
+	if hmac.Equal(want[:], h.Cookie[:]) {
+		return true
+	}
+	if prev == nil {
+		return false
+	}
+	want = cookieMAC(prev, addr, h)
+	return hmac.Equal(want[:], h.Cookie[:])
+}
+
+func cookieMAC(secret []byte, addr string, h protocol.Hello) [16]byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(addr))
+	m.Write(h.SessionID[:])
+	m.Write(h.ClientNonce[:])
+	m.Write(h.Ephemeral[:])
+	var out [16]byte
+	copy(out[:], m.Sum(nil))
+	return out
+}
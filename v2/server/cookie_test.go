@@ -0,0 +1,103 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"nox-core/v2/protocol"
+	"nox-core/v2/transport"
+)
+
+func TestCookieJar(t *testing.T) {
+	now := time.Unix(1000, 0)
+	j := newCookieJar()
+	j.now = func() time.Time { return now }
+
+	var h protocol.Hello
+	h.SessionID[0] = 1
+	h.ClientNonce[0] = 2
+	if j.Valid("192.0.2.1:4000", h) {
+		t.Fatalf("empty cookie accepted")
+	}
+	h.Cookie = j.Make("192.0.2.1:4000", h)
+	if !j.Valid("192.0.2.1:4000", h) {
+		t.Fatalf("fresh cookie rejected")
+	}
+	if j.Valid("192.0.2.2:4000", h) {
+		t.Fatalf("cookie accepted from another address")
+	}
+	other := h
+	other.ClientNonce[0] = 3
+	if j.Valid("192.0.2.1:4000", other) {
+		t.Fatalf("cookie accepted for another hello")
+	}
+
+	now = now.Add(cookieRotation)
+	if !j.Valid("192.0.2.1:4000", h) {
+		t.Fatalf("cookie from previous secret rejected")
+	}
+	now = now.Add(cookieRotation)
+	if j.Valid("192.0.2.1:4000", h) {
+		t.Fatalf("expired cookie accepted")
+	}
+}
+
+func TestUDPRetryIsStateless(t *testing.T) {
+	s := &Server{opts: Options{RequireCookie: true}, cookies: newCookieJar()}
+	ln, err := transport.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.SetGate(s.screen)
+	accepted := make(chan transport.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := transport.UDPDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var h protocol.Hello
+	h.SessionID[0] = 1
+	hello := func() protocol.Frame {
+		return protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlHello}, protocol.EncodeHello(h)...)}
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := protocol.WriteRecord(c, hello()); err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.ReadRecord(c)
+	if err != nil || len(f.Payload) == 0 || f.Payload[0] != protocol.CtrlRetry {
+		t.Fatalf("no RETRY: %v %+v", err, f)
+	}
+	// Exactly one RETRY, and no connection for the cookie-less HELLO.
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := protocol.ReadRecord(c); err == nil {
+		t.Fatal("RETRY retransmitted")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("connection created before the cookie was echoed")
+	default:
+	}
+
+	retry, _ := protocol.DecodeRetry(f.Payload[1:])
+	h.Cookie = retry.Cookie
+	if err := protocol.WriteRecord(c, hello()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sc := <-accepted:
+		sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if f, err := protocol.ReadRecord(sc); err != nil || f.Payload[0] != protocol.CtrlHello {
+			t.Fatalf("echo not delivered: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("echo with a valid cookie not admitted")
+	}
+}
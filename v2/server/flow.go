@@ -0,0 +1,29 @@
+package server
+
+import "encoding/binary"
+
+// flowHash hashes an IPv4 packet's addresses and, for TCP and UDP, ports.
+// It is symmetric, so both directions of a flow hash alike: the server writes
+// a flow's inbound packets to the TUN queue the hash picks, which makes the
+// kernel's flow table steer the replies to that same queue and reader.
+func flowHash(pkt []byte) uint32 {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return 0
+	}
+	a := binary.BigEndian.Uint32(pkt[12:16])
+	b := binary.BigEndian.Uint32(pkt[16:20])
+	h := a ^ b
+	ihl := int(pkt[0]&0x0f) * 4
+	fragment := binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0
+	if proto := pkt[9]; (proto == 6 || proto == 17) && !fragment && len(pkt) >= ihl+4 {
+		h ^= uint32(binary.BigEndian.Uint16(pkt[ihl:])) ^ uint32(binary.BigEndian.Uint16(pkt[ihl+2:]))
+		h ^= uint32(proto) << 24
+	}
+	// Finalise (murmur3 fmix32) so nearby addresses spread over the queues.
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
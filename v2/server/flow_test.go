@@ -0,0 +1,45 @@
+package server
+
+import "testing"
+
+func udpPacket(src, dst [4]byte, sport, dport uint16) []byte {
+	pkt := make([]byte, 28)
+	pkt[0] = 0x45
+	pkt[9] = 17
+	copy(pkt[12:16], src[:])
+	copy(pkt[16:20], dst[:])
+	pkt[20], pkt[21] = byte(sport>>8), byte(sport)
+	pkt[22], pkt[23] = byte(dport>>8), byte(dport)
+	return pkt
+}
+
+func TestFlowHash(t *testing.T) {
+	a, b := [4]byte{10, 8, 0, 2}, [4]byte{1, 1, 1, 1}
+	out := flowHash(udpPacket(a, b, 40000, 53))
+	if in := flowHash(udpPacket(b, a, 53, 40000)); in != out {
+		t.Fatalf("asymmetric: %x vs %x", out, in)
+	}
+	if flowHash(udpPacket(a, b, 40001, 53)) == out {
+		t.Fatal("ports ignored")
+	}
+
+	// Later fragments carry no ports and must stay with the first.
+	first := udpPacket(a, b, 40000, 53)
+	first[6] = 0x20 // MF
+	later := udpPacket(a, b, 0, 0)
+	later[7] = 0x10
+	if flowHash(first) != flowHash(later) {
+		t.Fatal("fragments of one datagram split")
+	}
+
+	seen := map[uint32]bool{}
+	for port := uint16(1000); port < 1400; port++ {
+		seen[flowHash(udpPacket(a, b, port, 443))%4] = true
+	}
+	if len(seen) != 4 {
+		t.Fatalf("flows reach only %d of 4 queues", len(seen))
+	}
+	if flowHash([]byte{0x60}) != 0 {
+		t.Fatal("short packet hashed")
+	}
+}
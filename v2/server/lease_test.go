@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"nox-core/v2/ipam"
+	"nox-core/v2/registry"
+	"nox-core/v2/transport"
+)
+
+func TestRegisterSessionKeepsOtherClients(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.8.0.0/24")
+	ipmgr, _ := ipam.New(subnet, time.Minute)
+	s := &Server{ipam: ipmgr, sessions: make(map[string]*session)}
+	sid := [8]byte{7}
+	lease, _ := ipmgr.Allocate(sid)
+
+	newSession := func(key byte) (*session, net.Conn) {
+		local, remote := net.Pipe()
+		sess := &session{peer: registry.Peer{Name: "p", PublicKey: [32]byte{key}}, lease: lease}
+		sess.links = []transport.Conn{local}
+		return sess, remote
+	}
+	first, firstLink := newSession(1)
+	if !s.registerSession(first) {
+		t.Fatal("first session refused")
+	}
+
+	// Another key that picked the same session ID must not take the address.
+	other, _ := newSession(2)
+	if s.registerSession(other) || s.leaseFree(lease, other.peer) {
+		t.Fatal("another client's session evicted the live one")
+	}
+	s.release(sid)
+	if l, err := ipmgr.Allocate([8]byte{8}); err != nil || l.IP.Equal(lease.IP) {
+		t.Fatalf("live lease released: %v %v", l.IP, err)
+	}
+
+	// The same client reconnecting replaces its old session, even while
+	// the old one's writer is stuck on a link nobody reads.
+	sent := make(chan struct{})
+	go func() {
+		first.send(make([]byte, 64))
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	again, _ := newSession(1)
+	if !s.leaseFree(lease, again.peer) || !s.registerSession(again) {
+		t.Fatal("reconnect refused")
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("replaced session's write still blocked")
+	}
+	firstLink.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := firstLink.Read(make([]byte, 1)); err == nil {
+		t.Fatal("replaced session still open")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"nox-core/v2/protocol"
+)
+
+// DropPolicy decides which packet a full send queue gives up.
+type DropPolicy uint8
+
+const (
+	DropTail   DropPolicy = iota // discard the arriving packet
+	DropOldest                   // discard the packet that has waited longest
+)
+
+// ParseDropPolicy reads "tail" or "oldest".
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "", "tail":
+		return DropTail, nil
+	case "oldest":
+		return DropOldest, nil
+	}
+	return 0, fmt.Errorf("unknown drop policy %q (tail or oldest)", s)
+}
+
+func (p DropPolicy) String() string {
+	if p == DropOldest {
+		return "oldest"
+	}
+	return "tail"
+}
+
+// sendQueue buffers a session's outbound data records for its writer, so a
+// slow client only backs up its own queue. Pushing never blocks. Records are
+// pooled buffers (see protocol.GetBuffer) holding one framed record each;
+// dropped ones go back to the pool.
+type sendQueue struct {
+	ch     chan *[]byte
+	policy DropPolicy
+	drops  atomic.Uint64
+}
+
+func newSendQueue(size int, policy DropPolicy) *sendQueue {
+	return &sendQueue{ch: make(chan *[]byte, size), policy: policy}
+}
+
+// push enqueues rec, dropping per the policy when the queue is full.
+func (q *sendQueue) push(rec *[]byte) {
+	for {
+		select {
+		case q.ch <- rec:
+			return
+		default:
+		}
+		if q.policy == DropTail {
+			protocol.PutBuffer(rec)
+			q.drops.Add(1)
+			return
+		}
+		// Make room; another producer may take the slot first, so retry.
+		select {
+		case old := <-q.ch:
+			protocol.PutBuffer(old)
+			q.drops.Add(1)
+		default:
+		}
+	}
+}
+
+// Len returns the number of queued records.
+func (q *sendQueue) Len() int {
+	return len(q.ch)
+}
+
+// Drops returns the number of records discarded so far.
+func (q *sendQueue) Drops() uint64 {
+	return q.drops.Load()
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+
+	"nox-core/v2/protocol"
+)
+
+func recordN(n byte) *[]byte {
+	rec := protocol.GetBuffer()
+	*rec = append((*rec)[:protocol.RecordHeaderLen], n)
+	protocol.PutRecordHeader(*rec, protocol.KindData)
+	return rec
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy DropPolicy
+		first  byte
+	}{{DropTail, 0}, {DropOldest, 2}} {
+		q := newSendQueue(3, tc.policy)
+		for i := byte(0); i < 5; i++ {
+			q.push(recordN(i))
+		}
+		if q.Len() != 3 || q.Drops() != 2 {
+			t.Fatalf("%s: len %d drops %d", tc.policy, q.Len(), q.Drops())
+		}
+		if rec := <-q.ch; (*rec)[protocol.RecordHeaderLen] != tc.first {
+			t.Fatalf("%s: head is %d, want %d", tc.policy, (*rec)[protocol.RecordHeaderLen], tc.first)
+		}
+	}
+	for in, want := range map[string]DropPolicy{"": DropTail, "tail": DropTail, "oldest": DropOldest} {
+		if p, err := ParseDropPolicy(in); err != nil || p != want {
+			t.Fatalf("ParseDropPolicy(%q) = %v %v", in, p, err)
+		}
+	}
+	if _, err := ParseDropPolicy("head"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"nox-core/v2/crypto"
+	"nox-core/v2/protocol"
+	"nox-core/v2/transport"
+)
+
+func TestBlockedSessionDoesNotStallPump(t *testing.T) {
+	keys, err := crypto.NewSession(crypto.SessionParams{Secret: make([]byte, 32), ClientNonce: make([]byte, 16), ServerNonce: make([]byte, 16), IsServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every record makes the epoch due, and nobody reads the link yet.
+	s := &Server{opts: Options{RekeyInterval: time.Nanosecond, RekeyBytes: 1 << 30}}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	sess := &session{keys: keys, rekey: true, links: []transport.Conn{local}}
+	sess.queue = newSendQueue(4, DropTail)
+	sess.kick = make(chan struct{}, 1)
+	sess.done = make(chan struct{})
+	defer close(sess.done)
+	go s.writer(sess)
+
+	pumped := make(chan struct{})
+	go func() {
+		for range 100 {
+			rec := protocol.GetBuffer()
+			copy((*rec)[dataHeadroom:], []byte{0x45, 0, 0, 20})
+			s.queueData(sess, rec, 20)
+			s.requestRekey(sess)
+		}
+		close(pumped)
+	}()
+	select {
+	case <-pumped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pump stalled on a session whose link blocks")
+	}
+
+	// Once the link drains, the writer sends the REKEY.
+	_ = remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		f, err := protocol.ReadRecord(remote)
+		if err != nil {
+			t.Fatalf("no REKEY: %v", err)
+		}
+		if f.Kind == protocol.KindControl && len(f.Payload) > 0 && f.Payload[0] == protocol.CtrlRekey {
+			break
+		}
+	}
+}
+
+func TestRekeyRepeatedUntilAcked(t *testing.T) {
+	params := crypto.SessionParams{Secret: make([]byte, 32), ClientNonce: make([]byte, 16), ServerNonce: make([]byte, 16), IsServer: true}
+	keys, err := crypto.NewSession(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.IsServer = false
+	client, err := crypto.NewSession(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{opts: Options{RekeyInterval: time.Nanosecond, IdleTimeout: time.Minute}}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	sess := &session{keys: keys, rekey: true, links: []transport.Conn{local}, kick: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.runLink(sess, local, nil)
+
+	rekeys := make(chan protocol.Rekey, 2)
+	go func() {
+		for {
+			f, err := protocol.ReadRecord(remote)
+			if err != nil {
+				return
+			}
+			if rk, err := protocol.DecodeRekey(f.Payload[1:]); err == nil && f.Payload[0] == protocol.CtrlRekey {
+				rekeys <- rk
+			}
+		}
+	}()
+	s.maybeRekey(sess)
+	first := <-rekeys // lost
+	if !keys.RekeyPending() {
+		t.Fatal("rekey confirmed without an acknowledgement")
+	}
+	s.maybeRekey(sess)
+	select {
+	case <-rekeys:
+		t.Fatal("REKEY repeated before rekeyRetry")
+	default:
+	}
+	sess.rekeySent = time.Now().Add(-rekeyRetry)
+	s.maybeRekey(sess)
+	if again := <-rekeys; again != first {
+		t.Fatalf("repeated REKEY %+v, want %+v", again, first)
+	}
+
+	if err := client.Rekey(first.Epoch, first.Nonce[:]); err != nil {
+		t.Fatal(err)
+	}
+	ack := protocol.RekeyAck{Epoch: first.Epoch, Tag: client.RekeyTag(first.Epoch, first.Nonce[:])}
+	payload := append([]byte{protocol.CtrlRekeyAck}, protocol.EncodeRekeyAck(ack)...)
+	if err := protocol.WriteRecord(remote, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); keys.RekeyPending(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledgement not taken")
+		}
+	}
+	sealed, err := keys.SealData([]byte("new epoch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := client.OpenData(sealed); err != nil || string(pt) != "new epoch" {
+		t.Fatalf("client cannot open the new epoch: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nox-core/v2/ipam"
+	"nox-core/v2/protocol"
+	"nox-core/v2/registry"
+	"nox-core/v2/transport"
+)
+
+func TestReloadPeersClosesDenied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	var alice, bob [32]byte
+	alice[0], bob[0] = 1, 2
+	write := func(bobState string) {
+		line := "alice " + hex.EncodeToString(alice[:]) + " allow\nbob " + hex.EncodeToString(bob[:]) + " " + bobState + "\n"
+		if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("allow")
+	peers, err := registry.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.8.0.0/24")
+	ipmgr, _ := ipam.New(subnet, time.Minute)
+	s := &Server{opts: Options{Peers: peers}, ipam: ipmgr, sessions: make(map[string]*session)}
+
+	link := func(name string, pub [32]byte, ip byte) net.Conn {
+		local, remote := net.Pipe()
+		sess := &session{peer: registry.Peer{Name: name, PublicKey: pub}, lease: ipam.Lease{IP: net.IPv4(10, 8, 0, ip)}}
+		sess.links = []transport.Conn{local}
+		s.sessions[addrKey(sess.lease.IP)] = sess
+		return remote
+	}
+	aliceLink := link("alice", alice, 2)
+	bobLink := link("bob", bob, 3)
+	defer aliceLink.Close()
+
+	write("deny")
+	closed := make(chan protocol.Frame, 1)
+	go func() {
+		f, _ := protocol.ReadRecord(bobLink)
+		closed <- f
+	}()
+	n, err := s.ReloadPeers()
+	if err != nil || n != 1 {
+		t.Fatalf("ReloadPeers = %d, %v", n, err)
+	}
+	f := <-closed
+	if f.Kind != protocol.KindControl || len(f.Payload) == 0 || f.Payload[0] != protocol.CtrlClose {
+		t.Fatalf("denied peer got %+v", f)
+	}
+	if c, err := protocol.DecodeClose(f.Payload[1:]); err != nil || c.Code != protocol.CodeAuthFailed {
+		t.Fatalf("close %+v, %v", c, err)
+	}
+	if _, err := bobLink.Read(make([]byte, 1)); err == nil {
+		t.Fatal("denied peer's link still open")
+	}
+
+	// Removing a peer from the file closes its session too.
+	os.WriteFile(path, []byte("bob "+hex.EncodeToString(bob[:])+" allow\n"), 0o600)
+	go protocol.ReadRecord(aliceLink)
+	if n, err := s.ReloadPeers(); err != nil || n != 1 {
+		t.Fatalf("ReloadPeers after removal = %d, %v", n, err)
+	}
+}
+
+func TestReloadPeersClosesStalledSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	var bob [32]byte
+	bob[0] = 2
+	if err := os.WriteFile(path, []byte("bob "+hex.EncodeToString(bob[:])+" allow\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := registry.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.8.0.0/24")
+	ipmgr, _ := ipam.New(subnet, time.Minute)
+	s := &Server{opts: Options{Peers: peers}, ipam: ipmgr, sessions: make(map[string]*session)}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	sess := &session{peer: registry.Peer{Name: "bob", PublicKey: bob}, lease: ipam.Lease{IP: net.IPv4(10, 8, 0, 3)}}
+	sess.links = []transport.Conn{local}
+	s.sessions[addrKey(sess.lease.IP)] = sess
+
+	// bob stopped reading: the writer blocks in the middle of a record.
+	sent := make(chan struct{})
+	go func() {
+		sess.send(make([]byte, 64))
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	os.WriteFile(path, []byte("bob "+hex.EncodeToString(bob[:])+" deny\n"), 0o600)
+	reloaded := make(chan struct{})
+	go func() {
+		s.ReloadPeers()
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload hung behind the stalled write")
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("stalled write not released")
+	}
+}
@@ -1,71 +1,276 @@
 package server
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/hmac"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"nox-core/v2/batch"
 	"nox-core/v2/crypto"
 	"nox-core/v2/ipam"
+	"nox-core/v2/offload"
+	"nox-core/v2/padding"
 	"nox-core/v2/protocol"
-	"nox-core/v2/replay"
+	"nox-core/v2/registry"
 	"nox-core/v2/transport"
 	"nox-core/v2/tun"
 )
 
-// FSM (server): Init -> HelloRecv -> AssignSent -> Ready -> Rekeying? -> Closing.
+// FSM (server): Init -> HelloRecv -> AssignSent -> Confirmed -> Ready -> Rekeying? -> Closing.
 // Data frames are accepted only in Ready/Rekeying.
 
 type Options struct {
-	Key              []byte
+	PrivateKey       []byte // server static X25519 key
+	PreviousKey      []byte // rotated-out static key, accepted until PreviousUntil
+	PreviousUntil    time.Time
+	Peers            *registry.Registry    // authorised client identities
+	Revoked          *registry.Revocations // optional session/key deny list
 	Subnet           *net.IPNet
 	MTU              int
 	HandshakeTimeout time.Duration
+	RekeyInterval    time.Duration  // rekey after this long in one epoch
+	RekeyBytes       uint64         // or after this many bytes in either direction
+	RekeyOverlap     time.Duration  // how long the previous epoch stays valid
+	CookieLoad       int            // in-flight handshakes above which HELLO needs a cookie
+	RequireCookie    bool           // always demand a cookie
+	Suites           []crypto.Suite // data suite preference, best first
+	ReplayWindow     uint64         // packets of reordering tolerated; 0 = replay.DefaultSize
+	IdleTimeout      time.Duration  // datagram sessions silent this long are dropped
+	Padding          padding.Policy // for clients offering CapPadding; peers may override
+	MaxLinks         int            // connections one session may bond; default 8
+	TicketLifetime   time.Duration  // resumption ticket validity; default 12h, negative disables
+	SendQueue        int            // outbound data records buffered per session; default 256
+	DropPolicy       DropPolicy     // what a full send queue discards
+	TunQueues        int            // nox0 queues, each with its own reader; default 1
+	BatchDelay       time.Duration  // wait for more packets to batch; 0 batches queued ones, negative disables
+	Offload          bool           // open nox0 with TSO/USO and pass superpackets to CapGSO peers
+	OpenTun          tun.Opener     // opens nox0; default tun.Manager.Ensure
 }
 
 type Server struct {
 	opts     Options
+	pub      []byte
+	cookies  *cookieJar
+	tickets  *ticketJar   // nil when resumption is disabled
+	pending  atomic.Int32 // handshakes in progress
 	ipam     *ipam.Manager
 	tun      *tun.Device
 	mu       sync.Mutex
-	sessions map[string]*session
+	sessions map[string]*session // by addrKey of the leased address
+	pumpOnce sync.Once
 }
 
 type session struct {
-	conn     net.Conn
-	lease    ipam.Lease
-	cipherTx *crypto.CipherState
-	cipherRx *crypto.CipherState
-	replay   *replay.Window
-	epoch    uint32
+	peer  registry.Peer
+	lease ipam.Lease
+	keys  *crypto.Session
+	rekey bool // peer advertised CapRekey
+
+	wmu     sync.Mutex       // serialises writes; every write is bounded by a deadline
+	lmu     sync.Mutex       // guards links and joins; never held across a write
+	links   []transport.Conn // bonded connections, the handshake one first
+	nlinks  atomic.Int32     // len(links), for Stats
+	next    int              // round-robin position for data; guarded by wmu
+	joins   map[[16]byte]bool
+	closing atomic.Bool // close has begun; data is no longer sent
+
+	queue *sendQueue    // data records waiting for the writer
+	kick  chan struct{} // wakes an idle writer for a due rekey
+	done  chan struct{} // closed with the last link; stops the writer
+	stop  sync.Once
+
+	rekeyMsg  protocol.Frame // REKEY of a pending rekey; owned by the writer
+	rekeySent time.Time
+
+	batch   *batch.Collector // owned by the writer; nil unless CapBatch was granted
+	txSizes batch.Histogram  // packets per data record sent, when batching
+	rxSizes batch.Histogram  // and received
+	gso     bool             // CapGSO granted: superpackets go out whole when they fit a record
 }
 
 func New(opts Options) (*Server, error) {
-	if len(opts.Key) != 32 {
-		return nil, fmt.Errorf("key must be 32 bytes")
+	pub, err := crypto.PublicKey(opts.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("server key: %w", err)
+	}
+	if opts.Peers == nil {
+		return nil, fmt.Errorf("peer registry required")
 	}
 	if opts.HandshakeTimeout == 0 {
 		opts.HandshakeTimeout = 5 * time.Second
 	}
-	ipmgr, err := ipam.New(opts.Subnet, 10*time.Minute)
+	if opts.RekeyInterval == 0 {
+		opts.RekeyInterval = 10 * time.Minute
+	}
+	if opts.RekeyBytes == 0 {
+		opts.RekeyBytes = 1 << 30
+	}
+	if opts.RekeyOverlap == 0 {
+		opts.RekeyOverlap = crypto.DefaultRekeyOverlap
+	}
+	if opts.CookieLoad == 0 {
+		opts.CookieLoad = 32
+	}
+	if len(opts.Suites) == 0 {
+		opts.Suites = crypto.DefaultSuites()
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 90 * time.Second
+	}
+	if opts.MaxLinks == 0 {
+		opts.MaxLinks = 8
+	}
+	if opts.SendQueue == 0 {
+		opts.SendQueue = 256
+	}
+	if opts.SendQueue < 0 {
+		return nil, fmt.Errorf("send queue size %d", opts.SendQueue)
+	}
+	if opts.TunQueues == 0 {
+		opts.TunQueues = 1
+	}
+	if opts.TunQueues < 0 {
+		return nil, fmt.Errorf("tun queues %d", opts.TunQueues)
+	}
+	if opts.TicketLifetime == 0 {
+		opts.TicketLifetime = 12 * time.Hour
+	}
+	var tickets *ticketJar
+	if opts.TicketLifetime > 0 {
+		if tickets, err = newTicketJar(opts.TicketLifetime); err != nil {
+			return nil, err
+		}
+	}
+	ipmgr, err := ipam.New(opts.Subnet, leaseTTL)
 	if err != nil {
 		return nil, err
 	}
-	mgr := tun.NewManager()
-	dev, err := mgr.Ensure(tun.Config{Name: "nox0", CIDR: opts.Subnet, MTU: opts.MTU})
+	if opts.OpenTun == nil {
+		opts.OpenTun = tun.NewManager().Ensure
+	}
+	dev, err := opts.OpenTun(tun.Config{Name: "nox0", CIDR: opts.Subnet, MTU: opts.MTU, Queues: opts.TunQueues, Offload: opts.Offload})
 	if err != nil {
 		return nil, err
 	}
-	return &Server{opts: opts, ipam: ipmgr, tun: dev, sessions: make(map[string]*session)}, nil
+	if opts.Offload && dev.Offload == 0 {
+		log.Printf("nox0: kernel lacks TUN offloads, packets are read one by one")
+	}
+	ipmgr.Reserve(opts.Peers.FixedAddresses())
+	return &Server{opts: opts, pub: pub, cookies: newCookieJar(), tickets: tickets, ipam: ipmgr, tun: dev, sessions: make(map[string]*session)}, nil
+}
+
+// PublicKey returns the server static public key clients must be configured with.
+func (s *Server) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
+}
+
+// ReloadPeers re-reads the peer registry; new handshakes see the result.
+// Live sessions of peers that were removed or denied are closed. It returns
+// the number of sessions closed.
+func (s *Server) ReloadPeers() (int, error) {
+	if err := s.opts.Peers.Reload(); err != nil {
+		return 0, err
+	}
+	s.ipam.Reserve(s.opts.Peers.FixedAddresses())
+	victims := s.sessionsWhere(func(sess *session) bool {
+		peer, ok := s.opts.Peers.Lookup(sess.peer.PublicKey[:])
+		return !ok || !peer.Allowed
+	})
+	for _, sess := range victims {
+		log.Printf("closing session %x of peer %s, no longer allowed", sess.lease.Session, sess.peer.Name)
+	}
+	closeSessions(victims, protocol.CodeAuthFailed, "peer disabled")
+	return len(victims), nil
+}
+
+// ReloadRevocations re-reads the revocation list and closes live sessions
+// that now match it. It returns the number of sessions closed.
+func (s *Server) ReloadRevocations() (int, error) {
+	if s.opts.Revoked == nil {
+		return 0, nil
+	}
+	if err := s.opts.Revoked.Reload(); err != nil {
+		return 0, err
+	}
+	victims := s.sessionsWhere(func(sess *session) bool {
+		return s.revoked(sess.lease.Session, sess.peer.PublicKey[:])
+	})
+	for _, sess := range victims {
+		log.Printf("closing revoked peer %s session %x", sess.peer.Name, sess.lease.Session)
+	}
+	closeSessions(victims, protocol.CodeRevoked, "revoked")
+	return len(victims), nil
+}
+
+// sessionsWhere returns the live sessions match selects.
+func (s *Server) sessionsWhere(match func(*session) bool) []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*session
+	for _, sess := range s.sessions {
+		if match(sess) {
+			out = append(out, sess)
+		}
+	}
+	return out
+}
+
+// close sends CLOSE with code on every link and closes them, which ends the
+// session. A write stalled on a client that stopped reading is cut short
+// first, so close waits at most about twice closeTimeout.
+func (sess *session) close(code uint16, reason string) {
+	payload := append([]byte{protocol.CtrlClose}, protocol.EncodeClose(protocol.Close{Code: code, Reason: reason})...)
+	sess.closing.Store(true)
+	links := sess.snapshot()
+	for _, conn := range links {
+		_ = conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+	sess.wmu.Lock()
+	sess.broadcast(protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}, closeTimeout)
+	sess.wmu.Unlock()
+	for _, conn := range links {
+		conn.Close()
+	}
+}
+
+// closeSessions closes sessions concurrently, so one stalled client does not
+// hold up the others.
+func closeSessions(sessions []*session, code uint16, reason string) {
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.close(code, reason)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) revoked(session [8]byte, pub []byte) bool {
+	return s.opts.Revoked != nil && s.opts.Revoked.Revoked(session, pub)
 }
 
-func (s *Server) Serve(listener *transport.TCPListener) error {
-	go s.pumpTun()
+// Serve accepts sessions from listener. It may be called for several
+// listeners at once, e.g. TCP and UDP on the same port.
+func (s *Server) Serve(listener transport.Listener) error {
+	s.pumpOnce.Do(func() {
+		for _, q := range s.tun.Queues {
+			go s.pumpTun(q)
+		}
+		go s.renewLeases()
+	})
+	if g, ok := listener.(transport.Gated); ok {
+		g.SetGate(s.screen)
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -75,30 +280,108 @@ func (s *Server) Serve(listener *transport.TCPListener) error {
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+func (s *Server) handle(conn transport.Conn) {
 	defer conn.Close()
-	if err := conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout)); err != nil {
+	s.pending.Add(1)
+	handshakeDone := sync.OnceFunc(func() { s.pending.Add(-1) })
+	defer handshakeDone()
+
+	deadline := time.Now().Add(s.opts.HandshakeTimeout)
+	if err := conn.SetDeadline(deadline); err != nil {
 		log.Printf("conn deadline: %v", err)
 	}
-	frame, err := protocol.ReadRecord(conn)
+	var rto time.Duration
+	if transport.IsDatagram(conn) {
+		rto = transport.HandshakeRTO
+	}
+	rt := protocol.NewRetransmitter(conn, rto, deadline)
+	frame, err := rt.Read()
 	if err != nil {
 		return
 	}
-	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlHello {
+	if frame.Kind == protocol.KindControl && len(frame.Payload) > 0 && frame.Payload[0] == protocol.CtrlJoin {
+		handshakeDone()
+		s.join(conn, frame)
 		return
 	}
-	hello, err := protocol.DecodeHello(frame.Payload[1:])
+	if frame.Kind == protocol.KindControl && len(frame.Payload) > 0 && frame.Payload[0] == protocol.CtrlResume {
+		s.resume(conn, rt, frame, handshakeDone)
+		return
+	}
+	hello, ok := s.parseHello(conn, frame)
+	if !ok {
+		return
+	}
+	// Under load, prove the client sees our replies before doing any DH,
+	// nonce generation or IPAM work on its behalf.
+	addr := conn.RemoteAddr().String()
+	if s.cookieRequired() && !s.cookies.Valid(addr, hello) {
+		retry := s.retry(addr, hello)
+		if transport.IsDatagram(conn) {
+			// Load rose after the listener screened this HELLO. Stay as
+			// stateless as it is: the client's HELLO retransmits recover a
+			// lost RETRY, and its echo opens a new connection.
+			_ = protocol.WriteRecord(conn, retry)
+			return
+		}
+		if err := rt.Send(retry); err != nil {
+			return
+		}
+		for {
+			if frame, hello, ok = s.readHello(conn, rt); !ok {
+				return
+			}
+			if s.cookies.Valid(addr, hello) {
+				break
+			}
+			if hello.Cookie != ([16]byte{}) {
+				log.Printf("bad cookie echo from %s", addr)
+				return
+			}
+			// The original HELLO again: our RETRY was lost.
+			if err := rt.Resend(); err != nil {
+				return
+			}
+		}
+	}
+	hs, clientPub, err := s.respond(hello)
 	if err != nil {
-		s.sendError(conn, 0x0001, "bad hello")
+		s.sendError(conn, protocol.CodeHandshake, "handshake failed")
 		return
 	}
-	if frame.Version != protocol.Version {
-		s.sendError(conn, 0x0002, "version mismatch")
+	peer, ok := s.opts.Peers.Lookup(clientPub)
+	if !ok {
+		log.Printf("reject unknown client key %x from %s", clientPub, conn.RemoteAddr())
+		s.sendError(conn, protocol.CodeAuthFailed, "unknown client")
 		return
 	}
-	lease, err := s.ipam.Allocate(hello.SessionID)
+	if !peer.Allowed {
+		log.Printf("reject disabled peer %s from %s", peer.Name, conn.RemoteAddr())
+		s.sendError(conn, protocol.CodeAuthFailed, "peer disabled")
+		return
+	}
+	if s.revoked(hello.SessionID, clientPub) {
+		log.Printf("reject revoked peer %s session %x from %s", peer.Name, hello.SessionID, conn.RemoteAddr())
+		s.sendError(conn, protocol.CodeRevoked, "revoked")
+		return
+	}
+	suite, ok := crypto.SelectSuite(s.opts.Suites, offeredSuites(hello.Capabilities))
+	if !ok {
+		s.sendError(conn, protocol.CodeHandshake, "no common cipher suite")
+		return
+	}
+	var lease ipam.Lease
+	if peer.Address != nil {
+		lease, err = s.ipam.AllocateIP(hello.SessionID, peer.Address)
+	} else {
+		lease, err = s.ipam.Allocate(hello.SessionID)
+	}
 	if err != nil {
-		s.sendError(conn, 0x0003, "ipam: "+err.Error())
+		s.sendError(conn, protocol.CodeIPAM, "ipam: "+err.Error())
+		return
+	}
+	if !s.leaseFree(lease, peer) {
+		s.sendError(conn, protocol.CodeIPAM, "address in use")
 		return
 	}
 	mtu := s.opts.MTU
@@ -108,117 +391,885 @@ func (s *Server) handle(conn net.Conn) {
 	if hello.DesiredMTU != 0 && int(hello.DesiredMTU) < mtu {
 		mtu = int(hello.DesiredMTU)
 	}
+	g := grant{peer: peer, lease: lease, mtu: linkMTU(conn, mtu), suite: suite, caps: hello.Capabilities, clientNonce: hello.ClientNonce[:]}
+	assign := s.assignment(g)
+	if assign.Ephemeral, assign.Auth, err = hs.WriteAssign(); err != nil {
+		s.release(hello.SessionID)
+		return
+	}
+	s.establish(conn, rt, handshakeDone, frame, assign, g, hs.Secret())
+}
+
+// quicMTU is the largest tunnel MTU whose full-size data records, padding
+// trailer included, still go out as one QUIC datagram.
+const quicMTU = transport.QUICMaxRecord - protocol.RecordHeaderLen - crypto.DataOverhead - padding.TrailerLen
+
+// linkMTU caps mtu to what conn carries without falling back to a stream.
+func linkMTU(conn transport.Conn, mtu int) int {
+	if transport.IsQUIC(conn) && mtu > quicMTU {
+		return quicMTU
+	}
+	return mtu
+}
+
+// grant is what a handshake or resumption settled on for a session.
+type grant struct {
+	peer        registry.Peer
+	lease       ipam.Lease
+	mtu         int
+	suite       crypto.Suite
+	caps        uint16
+	clientNonce []byte
+	resumed     bool
+}
+
+// assignment builds ASSIGN_IP for g with a fresh server nonce. The full
+// handshake adds its ephemeral key and auth tag; resumption leaves them zero.
+func (s *Server) assignment(g grant) protocol.AssignIP {
 	var assign protocol.AssignIP
-	assign.SessionID = hello.SessionID
-	copy(assign.IPv4[:], lease.IP.To4())
+	assign.SessionID = g.lease.Session
+	copy(assign.IPv4[:], g.lease.IP.To4())
 	ones, _ := s.opts.Subnet.Mask.Size()
 	assign.PrefixLen = uint8(ones)
-	assign.MTU = uint16(mtu)
+	assign.MTU = uint16(g.mtu)
+	assign.Suite = uint8(g.suite)
+	pad := s.padding(g.peer, g.caps)
+	assign.PadMode = uint8(pad.Mode)
+	assign.PadBuckets = pad.Buckets
+	if g.caps&protocol.CapBatch != 0 && s.opts.BatchDelay >= 0 {
+		assign.Granted |= protocol.CapBatch
+	}
+	if g.caps&protocol.CapGSO != 0 && s.opts.Offload {
+		assign.Granted |= protocol.CapGSO
+	}
 	serverNonce, _ := crypto.RandomBytes(16)
 	copy(assign.ServerNonce[:], serverNonce)
+	return assign
+}
 
-	// Respond HELLO -> ASSIGN
-	payload := append([]byte{protocol.CtrlAssignIP}, protocol.EncodeAssign(assign)...)
+// establish sends ASSIGN_IP, confirms the transcript of request and assign
+// under secret, and runs the resulting session on conn.
+func (s *Server) establish(conn transport.Conn, rt *protocol.Retransmitter, handshakeDone func(), request protocol.Frame, assign protocol.AssignIP, g grant, secret []byte) {
+	sid := g.lease.Session
+	assignFrame := protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlAssignIP}, protocol.EncodeAssign(assign)...)}
+	requestRaw, _ := protocol.Encode(request)
+	assignRaw, _ := protocol.Encode(assignFrame)
+	transcript := crypto.TranscriptHash(requestRaw, assignRaw)
+	if err := s.confirm(rt, requestRaw, assignFrame, secret, transcript); err != nil {
+		log.Printf("peer %s from %s: %v", g.peer.Name, conn.RemoteAddr(), err)
+		s.sendError(conn, protocol.CodeHandshake, "confirmation failed")
+		s.release(sid)
+		return
+	}
 	_ = conn.SetDeadline(time.Time{})
-	if err := protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}); err != nil {
-		s.ipam.Release(hello.SessionID)
+	handshakeDone()
+
+	pad := padding.Policy{Mode: padding.Mode(assign.PadMode), Buckets: assign.PadBuckets}
+	keys, err := crypto.NewSession(crypto.SessionParams{
+		Secret:       secret,
+		Transcript:   transcript,
+		SessionID:    sid,
+		ClientNonce:  g.clientNonce,
+		ServerNonce:  assign.ServerNonce[:],
+		IsServer:     true,
+		Suite:        g.suite,
+		Overlap:      s.opts.RekeyOverlap,
+		ReplayWindow: s.opts.ReplayWindow,
+		Padding:      pad,
+		MTU:          g.mtu,
+	})
+	if err != nil {
+		s.release(sid)
 		return
 	}
 
-	txKey, rxKey, err := crypto.DeriveSessionKeys(s.opts.Key, hello.SessionID, hello.ClientNonce[:], assign.ServerNonce[:], true)
+	how := "session"
+	if g.resumed {
+		how = "resumed session"
+	}
+	log.Printf("peer %s %s %x lease %s suite %s padding %s batching %t gso %t", g.peer.Name, how, sid, g.lease.IP, g.suite, pad, assign.Granted&protocol.CapBatch != 0, assign.Granted&protocol.CapGSO != 0)
+	sess := &session{peer: g.peer, lease: g.lease, keys: keys, rekey: g.caps&protocol.CapRekey != 0}
+	sess.links = []transport.Conn{conn}
+	sess.nlinks.Store(1)
+	sess.queue = newSendQueue(s.opts.SendQueue, s.opts.DropPolicy)
+	sess.kick = make(chan struct{}, 1)
+	sess.done = make(chan struct{})
+	// Clients offer CapGSO only on stream transports, which carry records of
+	// any size.
+	sess.gso = assign.Granted&protocol.CapGSO != 0 && !transport.IsDatagram(conn)
+	if assign.Granted&protocol.CapBatch != 0 {
+		sess.batch = &batch.Collector{Off: dataHeadroom, Limit: g.mtu, Delay: s.opts.BatchDelay, Wake: sess.kick}
+	}
+	if !s.registerSession(sess) {
+		log.Printf("peer %s session %x: %s was taken meanwhile", g.peer.Name, sid, g.lease.IP)
+		s.sendError(conn, protocol.CodeIPAM, "address in use")
+		s.release(sid)
+		return
+	}
+	go s.writer(sess)
+	// A reload that raced the handshake has not seen this session.
+	if s.revoked(sid, g.peer.PublicKey[:]) {
+		log.Printf("closing revoked peer %s session %x", g.peer.Name, sid)
+		sess.close(protocol.CodeRevoked, "revoked")
+		s.dropLink(sess, conn)
+		return
+	}
+	if g.caps&protocol.CapResume != 0 {
+		s.issueTicket(sess, conn, g.mtu, g.suite)
+	}
+
+	s.runLink(sess, conn, nil)
+}
+
+// resume restores a session from a ticket in one round trip: the lease,
+// MTU and suite come from the ticket, the keys from its resume secret and
+// fresh nonces. Any problem with the ticket answers CodeTicket so the client
+// falls back to a full handshake.
+func (s *Server) resume(conn transport.Conn, rt *protocol.Retransmitter, frame protocol.Frame, handshakeDone func()) {
+	r, err := protocol.DecodeResume(frame.Payload[1:])
 	if err != nil {
-		s.ipam.Release(hello.SessionID)
+		s.sendError(conn, protocol.CodeBadHello, "bad resume")
 		return
 	}
-	txCipher, _ := crypto.NewCipherState(txKey, 1)
-	rxCipher, _ := crypto.NewCipherState(rxKey, 1)
+	if frame.Version != protocol.Version {
+		s.sendError(conn, protocol.CodeVersion, "version mismatch")
+		return
+	}
+	if s.tickets == nil {
+		s.sendError(conn, protocol.CodeTicket, "resumption disabled")
+		return
+	}
+	st, err := s.tickets.Redeem(r.Ticket)
+	if err == nil && st.Session != r.SessionID {
+		err = errors.New("ticket for another session")
+	}
+	if err != nil {
+		log.Printf("resume from %s: %v", conn.RemoteAddr(), err)
+		s.sendError(conn, protocol.CodeTicket, "ticket rejected")
+		return
+	}
+	peer, ok := s.opts.Peers.Lookup(st.Peer[:])
+	if !ok || !peer.Allowed {
+		log.Printf("reject resume of session %x: peer unknown or disabled", st.Session)
+		s.sendError(conn, protocol.CodeAuthFailed, "peer disabled")
+		return
+	}
+	if s.revoked(st.Session, st.Peer[:]) {
+		log.Printf("reject revoked peer %s session %x from %s", peer.Name, st.Session, conn.RemoteAddr())
+		s.sendError(conn, protocol.CodeRevoked, "revoked")
+		return
+	}
+	// The ticket's terms must still be on offer: a changed fixed address or
+	// suite list means a full handshake.
+	if _, ok := crypto.SelectSuite(s.opts.Suites, []crypto.Suite{st.Suite}); !ok || (peer.Address != nil && !peer.Address.Equal(st.IP)) {
+		s.sendError(conn, protocol.CodeTicket, "ticket terms changed")
+		return
+	}
+	lease, err := s.ipam.AllocateIP(st.Session, st.IP)
+	if err != nil {
+		log.Printf("resume peer %s: lease %s: %v", peer.Name, st.IP, err)
+		s.sendError(conn, protocol.CodeTicket, "lease gone")
+		return
+	}
+	if !s.leaseFree(lease, peer) {
+		s.sendError(conn, protocol.CodeTicket, "lease gone")
+		return
+	}
+	// The ticket may come from a session on another transport.
+	g := grant{peer: peer, lease: lease, mtu: linkMTU(conn, st.MTU), suite: st.Suite, caps: r.Capabilities, clientNonce: r.ClientNonce[:], resumed: true}
+	assign := s.assignment(g)
+	secret, err := crypto.ResumedSecret(st.Secret, r.ClientNonce[:], assign.ServerNonce[:])
+	if err != nil {
+		s.release(st.Session)
+		return
+	}
+	s.establish(conn, rt, handshakeDone, frame, assign, g, secret)
+}
+
+// issueTicket sends the client a ticket for resuming sess.
+func (s *Server) issueTicket(sess *session, conn transport.Conn, mtu int, suite crypto.Suite) {
+	if s.tickets == nil {
+		return
+	}
+	opaque, err := s.tickets.Issue(ticketState{Session: sess.lease.Session, Peer: sess.peer.PublicKey, IP: sess.lease.IP, MTU: mtu, Suite: suite, Secret: sess.keys.ResumeSecret()})
+	if err != nil {
+		log.Printf("ticket for %s: %v", sess.peer.Name, err)
+		return
+	}
+	t := protocol.Ticket{Lifetime: uint32(s.opts.TicketLifetime / time.Second), Opaque: opaque}
+	payload := append([]byte{protocol.CtrlTicket}, protocol.EncodeTicket(t)...)
+	sess.wmu.Lock()
+	_ = writeRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}, writeTimeout)
+	sess.wmu.Unlock()
+}
+
+// join attaches conn to the live session named in a JOIN record, so one
+// session can stripe its data over several connections.
+func (s *Server) join(conn transport.Conn, frame protocol.Frame) {
+	j, err := protocol.DecodeJoin(frame.Payload[1:])
+	if err != nil {
+		s.sendError(conn, protocol.CodeBadHello, "bad join")
+		return
+	}
+	sess := s.sessionByID(j.SessionID)
+	if sess == nil {
+		s.sendError(conn, protocol.CodeNoSession, "unknown session")
+		return
+	}
+	if tag := sess.keys.JoinTag(true, j.Nonce[:]); !hmac.Equal(j.Tag[:], tag[:]) {
+		log.Printf("bad join tag for session %x from %s", j.SessionID, conn.RemoteAddr())
+		s.sendError(conn, protocol.CodeNoSession, "unknown session")
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	j.Tag = sess.keys.JoinTag(false, j.Nonce[:])
+	ack := protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: append([]byte{protocol.CtrlJoin}, protocol.EncodeJoin(j)...)}
+	sess.lmu.Lock()
+	switch {
+	case sess.joins[j.Nonce]:
+		err = errors.New("replayed join")
+	case len(sess.links) == 0:
+		err = errors.New("session closing")
+	case len(sess.links) >= s.opts.MaxLinks:
+		err = fmt.Errorf("already %d links", len(sess.links))
+	default:
+		if sess.joins == nil {
+			sess.joins = make(map[[16]byte]bool)
+		}
+		sess.joins[j.Nonce] = true
+	}
+	sess.lmu.Unlock()
+	// The answer goes out before the link joins, so before it carries data.
+	if err == nil {
+		err = writeRecord(conn, ack, writeTimeout)
+	}
+	n := 0
+	if err == nil {
+		sess.lmu.Lock()
+		if len(sess.links) == 0 {
+			err = errors.New("session closing")
+		} else {
+			sess.links = append(sess.links, conn)
+			sess.nlinks.Store(int32(len(sess.links)))
+		}
+		n = len(sess.links)
+		sess.lmu.Unlock()
+	}
+	if err != nil {
+		log.Printf("peer %s join from %s: %v", sess.peer.Name, conn.RemoteAddr(), err)
+		s.sendError(conn, protocol.CodeNoSession, "join refused")
+		return
+	}
+	log.Printf("peer %s session %x link %d from %s", sess.peer.Name, j.SessionID, n, conn.RemoteAddr())
+	s.runLink(sess, conn, &ack)
+}
+
+// respond processes HELLO with the current static key, falling back to the
+// previous key while its rotation grace period lasts.
+func (s *Server) respond(hello protocol.Hello) (*crypto.Handshake, []byte, error) {
+	hs, err := crypto.NewResponder(s.opts.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientPub, err := hs.ReadHello(hello.Ephemeral, hello.Static)
+	if err == nil || s.opts.PreviousKey == nil || time.Now().After(s.opts.PreviousUntil) {
+		return hs, clientPub, err
+	}
+	if hs, err = crypto.NewResponder(s.opts.PreviousKey); err != nil {
+		return nil, nil, err
+	}
+	clientPub, err = hs.ReadHello(hello.Ephemeral, hello.Static)
+	return hs, clientPub, err
+}
+
+// padding picks the session's padding policy: the peer's own if the registry
+// sets one, the server's otherwise, and none for clients that cannot strip it.
+func (s *Server) padding(peer registry.Peer, caps uint16) padding.Policy {
+	if caps&protocol.CapPadding == 0 {
+		return padding.Policy{}
+	}
+	if peer.Padding != nil {
+		return *peer.Padding
+	}
+	return s.opts.Padding
+}
+
+// offeredSuites maps HELLO capability bits to suites. Clients that set no
+// suite bit only speak ChaCha20-Poly1305.
+func offeredSuites(caps uint16) []crypto.Suite {
+	var out []crypto.Suite
+	if caps&protocol.CapChaCha20 != 0 || caps&(protocol.CapChaCha20|protocol.CapAESGCM) == 0 {
+		out = append(out, crypto.SuiteChaCha20Poly1305)
+	}
+	if caps&protocol.CapAESGCM != 0 {
+		out = append(out, crypto.SuiteAES256GCM)
+	}
+	return out
+}
+
+// retry builds the RETRY answering hello from addr.
+func (s *Server) retry(addr string, hello protocol.Hello) protocol.Frame {
+	retry := protocol.Retry{Cookie: s.cookies.Make(addr, hello)}
+	payload := append([]byte{protocol.CtrlRetry}, protocol.EncodeRetry(retry)...)
+	return protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}
+}
+
+// screen is the Gate of datagram listeners. Under load it answers a HELLO
+// without a valid cookie with RETRY before the listener creates a
+// connection, so spoofed sources cost no state and one datagram each.
+func (s *Server) screen(from net.Addr, rec []byte) (bool, []byte) {
+	if !s.cookieRequired() {
+		return true, nil
+	}
+	frame, err := protocol.Decode(rec[2:])
+	if err != nil || frame.Kind != protocol.KindControl || len(frame.Payload) == 0 {
+		return false, nil
+	}
+	if frame.Payload[0] != protocol.CtrlHello {
+		return true, nil // JOIN and RESUME authenticate themselves
+	}
+	hello, err := protocol.DecodeHello(frame.Payload[1:])
+	if err != nil || frame.Version != protocol.Version {
+		return false, nil
+	}
+	addr := from.String()
+	if s.cookies.Valid(addr, hello) {
+		return true, nil
+	}
+	var reply bytes.Buffer
+	if protocol.WriteRecord(&reply, s.retry(addr, hello)) != nil {
+		return false, nil
+	}
+	return false, reply.Bytes()
+}
+
+// readHello reads and validates a HELLO record.
+func (s *Server) readHello(conn transport.Conn, rt *protocol.Retransmitter) (protocol.Frame, protocol.Hello, bool) {
+	frame, err := rt.Read()
+	if err != nil {
+		return frame, protocol.Hello{}, false
+	}
+	hello, ok := s.parseHello(conn, frame)
+	return frame, hello, ok
+}
+
+// parseHello validates a HELLO record.
+func (s *Server) parseHello(conn transport.Conn, frame protocol.Frame) (protocol.Hello, bool) {
+	if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 || frame.Payload[0] != protocol.CtrlHello {
+		return protocol.Hello{}, false
+	}
+	hello, err := protocol.DecodeHello(frame.Payload[1:])
+	if err != nil {
+		s.sendError(conn, protocol.CodeBadHello, "bad hello")
+		return hello, false
+	}
+	if frame.Version != protocol.Version {
+		s.sendError(conn, protocol.CodeVersion, "version mismatch")
+		return hello, false
+	}
+	return hello, true
+}
 
-	sess := &session{conn: conn, lease: lease, cipherTx: txCipher, cipherRx: rxCipher, replay: replay.New(64), epoch: 1}
-	s.registerSession(sess)
-	defer s.unregisterSession(sess)
+func (s *Server) cookieRequired() bool {
+	return s.opts.RequireCookie || int(s.pending.Load()) > s.opts.CookieLoad
+}
 
-	s.runSession(sess)
+// confirm sends ASSIGN_IP and the server CONFIRM as one flight and waits for
+// a matching client CONFIRM. A repeated HELLO or RESUME means the flight was
+// lost; data arriving first means the client CONFIRM was, and the flight
+// timer recovers.
+func (s *Server) confirm(rt *protocol.Retransmitter, requestRaw []byte, assign protocol.Frame, secret, transcript []byte) error {
+	sealed, err := crypto.SealConfirm(secret, transcript, true)
+	if err != nil {
+		return err
+	}
+	var c protocol.Confirm
+	copy(c.Sealed[:], sealed)
+	payload := append([]byte{protocol.CtrlConfirm}, protocol.EncodeConfirm(c)...)
+	if err := rt.Send(assign, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}); err != nil {
+		return err
+	}
+	var frame protocol.Frame
+	for {
+		if frame, err = rt.Read(); err != nil {
+			return err
+		}
+		if frame.Kind == protocol.KindData {
+			continue
+		}
+		if frame.Kind != protocol.KindControl || len(frame.Payload) == 0 {
+			return errors.New("expected CONFIRM")
+		}
+		if frame.Payload[0] == protocol.CtrlConfirm {
+			break
+		}
+		if raw, _ := protocol.Encode(frame); bytes.Equal(raw, requestRaw) {
+			if err := rt.Resend(); err != nil {
+				return err
+			}
+			continue
+		}
+		if frame.Payload[0] == protocol.CtrlHello {
+			continue // sent before RETRY and delayed
+		}
+		return errors.New("expected CONFIRM")
+	}
+	c, err = protocol.DecodeConfirm(frame.Payload[1:])
+	if err != nil {
+		return err
+	}
+	return crypto.OpenConfirm(secret, transcript, c.Sealed[:], false)
 }
 
-func (s *Server) runSession(sess *session) {
+// runLink reads one of the session's connections until it fails. ack, if
+// set, is the JOIN answer to repeat when the client retransmits its JOIN.
+func (s *Server) runLink(sess *session, conn transport.Conn, ack *protocol.Frame) {
+	defer s.dropLink(sess, conn)
+	dc, datagram := conn.(transport.DatagramConn)
+	rd := protocol.NewReader(conn)
 	for {
-		frame, err := protocol.ReadRecord(sess.conn)
+		if datagram {
+			_ = conn.SetReadDeadline(time.Now().Add(s.opts.IdleTimeout))
+		}
+		frame, err := rd.Read()
 		if err != nil {
-			if !errors.Is(err, io.EOF) {
+			switch {
+			case datagram && errors.Is(err, os.ErrDeadlineExceeded):
+				log.Printf("peer %s idle for %s, dropping session", sess.peer.Name, s.opts.IdleTimeout)
+			case !errors.Is(err, io.EOF):
 				log.Printf("read frame: %v", err)
 			}
 			return
 		}
-		if frame.Kind != protocol.KindData {
+		if frame.Kind == protocol.KindControl && len(frame.Payload) > 0 && frame.Payload[0] == protocol.CtrlJoin && ack != nil {
+			sess.wmu.Lock()
+			_ = writeRecord(conn, *ack, writeTimeout)
+			sess.wmu.Unlock()
 			continue
 		}
-		if len(frame.Payload) < 8 {
+		if frame.Kind == protocol.KindControl && len(frame.Payload) > 0 && frame.Payload[0] == protocol.CtrlRekeyAck {
+			if a, err := protocol.DecodeRekeyAck(frame.Payload[1:]); err == nil && sess.keys.FinishRekey(a.Epoch, a.Tag) {
+				log.Printf("peer %s rekeyed to epoch %d", sess.peer.Name, a.Epoch)
+			}
 			continue
 		}
-		seq := binary.BigEndian.Uint64(frame.Payload[:8])
-		if !sess.replay.Check(seq) {
+		if frame.Kind != protocol.KindData {
 			continue
 		}
-		pt, err := sess.cipherRx.Open(seq, nil, frame.Payload[8:])
+		pt, err := sess.keys.OpenInPlace(frame.Payload)
 		if err != nil {
 			continue
 		}
-		_, _ = s.tun.Tun.WritePacket(pt)
+		if datagram {
+			dc.ConfirmPeer()
+		}
+		if sess.batch != nil && batch.IsBatch(pt) {
+			count := 0
+			if batch.Split(pt, func(pkt []byte) { s.writeTun(pkt); count++ }) == nil {
+				sess.rxSizes.Observe(count)
+			}
+		} else {
+			if sess.batch != nil {
+				sess.rxSizes.Observe(1)
+			}
+			s.writeTun(pt)
+		}
+		s.requestRekey(sess)
 	}
 }
 
-func (s *Server) pumpTun() {
-	buf := make([]byte, 65535)
+// writeTun writes an inbound packet or superpacket to the TUN queue its
+// flow hashes to.
+func (s *Server) writeTun(pt []byte) {
+	q := s.tun.Queues[flowHash(offload.Packet(pt))%uint32(len(s.tun.Queues))]
+	_ = offload.ToTun(q, s.tun.Offload, pt)
+}
+
+// dataHeadroom is the space in front of a packet read from the TUN for the
+// record header and sequence number, so it is sealed and framed in place.
+const dataHeadroom = protocol.RecordHeaderLen + 8
+
+// pumpTun reads one TUN queue, seals, and queues each packet for its session.
+// The kernel keeps a flow on one queue, so one pump sees all of a flow's
+// packets and hands them to the session in order. Packets are read into
+// pooled record buffers that the writer returns once they are sent. For a
+// batching session the writer seals instead, once it has coalesced them.
+// With offloads on, a queue yields superpackets; those a session cannot take
+// whole are split here.
+func (s *Server) pumpTun(q tun.Queue) {
+	off := dataHeadroom
+	if q.Vnet() {
+		off++ // room for the superpacket marker
+	}
 	for {
-		n, err := s.tun.Tun.ReadPacket(buf)
+		rec := protocol.GetBuffer()
+		buf := *rec
+		n, err := q.ReadPacket(buf[off:])
 		if err != nil {
+			protocol.PutBuffer(rec)
 			return
 		}
-		pkt := append([]byte{}, buf[:n]...)
-		dest := ipv4Dest(pkt)
-		if dest == nil {
-			continue
+		pt := buf[dataHeadroom : dataHeadroom+n]
+		if q.Vnet() {
+			if pt, err = offload.FromTun(buf[dataHeadroom:], n); err != nil {
+				protocol.PutBuffer(rec)
+				continue
+			}
 		}
-		sess := s.sessionByIP(dest.String())
+		sess := s.sessionByDest(offload.Packet(pt))
 		if sess == nil {
+			protocol.PutBuffer(rec)
+			continue
+		}
+		if offload.IsSuper(pt) && (!sess.gso || len(offload.Packet(pt)) > offload.MaxPacket) {
+			_ = offload.Segment(pt, func(pkt []byte) {
+				seg := protocol.GetBuffer()
+				s.queueData(sess, seg, copy((*seg)[dataHeadroom:], pkt))
+			})
+			protocol.PutBuffer(rec)
 			continue
 		}
-		seq := sess.cipherTx.Seq()
-		ct := sess.cipherTx.Seal(nil, pkt)
-		payload := make([]byte, 8+len(ct))
-		binary.BigEndian.PutUint64(payload[0:8], seq)
-		copy(payload[8:], ct)
-		_ = protocol.WriteRecord(sess.conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: payload})
+		s.queueData(sess, rec, len(pt))
+	}
+}
+
+// queueData queues the n-byte plaintext at (*rec)[dataHeadroom:] for sess,
+// sealed and framed unless the session batches.
+func (s *Server) queueData(sess *session, rec *[]byte, n int) {
+	buf := *rec
+	if sess.batch != nil {
+		*rec = buf[:dataHeadroom+n]
+		sess.queue.push(rec)
+		return
+	}
+	payload, err := sess.keys.SealInPlace(buf[protocol.RecordHeaderLen:dataHeadroom+n], n)
+	if err == nil {
+		*rec = buf[:protocol.RecordHeaderLen+len(payload)]
+		err = protocol.PutRecordHeader(*rec, protocol.KindData)
+	}
+	if err != nil {
+		protocol.PutBuffer(rec)
+		return
+	}
+	sess.queue.push(rec)
+}
+
+// writer drains the session's queue until the session ends, and rekeys
+// when the epoch is due, so a session whose links stall blocks only itself.
+// Control records are written directly under wmu, so they never split a
+// data record.
+func (s *Server) writer(sess *session) {
+	if sess.batch != nil {
+		s.batchWriter(sess)
+		return
+	}
+	for {
+		select {
+		case rec := <-sess.queue.ch:
+			sess.send(*rec)
+			protocol.PutBuffer(rec)
+		case <-sess.kick:
+		case <-sess.done:
+			return
+		}
+		s.maybeRekey(sess)
 	}
 }
 
-func (s *Server) sendError(conn net.Conn, code uint16, reason string) {
+// batchWriter coalesces the session's queued packets, seals each batch in
+// the buffer of its first packet and sends it.
+func (s *Server) batchWriter(sess *session) {
+	defer sess.batch.Release()
+	for {
+		rec, count, ok := sess.batch.Next(sess.queue.ch, sess.done)
+		if !ok {
+			return
+		}
+		if rec == nil { // woken by kick
+			s.maybeRekey(sess)
+			continue
+		}
+		buf := *rec
+		payload, err := sess.keys.SealInPlace(buf[protocol.RecordHeaderLen:], len(buf)-dataHeadroom)
+		if err == nil {
+			buf = buf[:protocol.RecordHeaderLen+len(payload)]
+			err = protocol.PutRecordHeader(buf, protocol.KindData)
+		}
+		if err == nil {
+			sess.txSizes.Observe(count)
+			sess.send(buf)
+		}
+		protocol.PutBuffer(rec)
+		s.maybeRekey(sess)
+	}
+}
+
+// writeTimeout bounds every record write to a link. A client that stops
+// reading for that long loses the link rather than stalling its session's
+// writer, and with it anyone waiting on wmu.
+const writeTimeout = 10 * time.Second
+
+// closeTimeout bounds the CLOSE written when the server ends a session.
+const closeTimeout = time.Second
+
+// writeRecord writes f to conn within timeout.
+func writeRecord(conn transport.Conn, f protocol.Frame, timeout time.Duration) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	return protocol.WriteRecord(conn, f)
+}
+
+// snapshot returns the session's current links.
+func (sess *session) snapshot() []transport.Conn {
+	sess.lmu.Lock()
+	defer sess.lmu.Unlock()
+	return append([]transport.Conn(nil), sess.links...)
+}
+
+// send writes a framed data record to the next link in turn. A link that
+// fails or times out is closed, which ends its reader, and the record goes
+// to the one after it.
+func (sess *session) send(rec []byte) {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	links := sess.snapshot()
+	for range links {
+		if sess.closing.Load() {
+			return
+		}
+		conn := links[sess.next%len(links)]
+		sess.next++
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(rec); err == nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// broadcast writes a control record on every link, each write bounded by
+// timeout. Callers hold wmu.
+func (sess *session) broadcast(f protocol.Frame, timeout time.Duration) bool {
+	ok := false
+	for _, conn := range sess.snapshot() {
+		if writeRecord(conn, f, timeout) == nil {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// dropLink removes conn from the session and ends the session with its last link.
+func (s *Server) dropLink(sess *session, conn transport.Conn) {
+	conn.Close()
+	sess.lmu.Lock()
+	for i, c := range sess.links {
+		if c == conn {
+			sess.links = append(sess.links[:i], sess.links[i+1:]...)
+			break
+		}
+	}
+	last := len(sess.links) == 0
+	sess.nlinks.Store(int32(len(sess.links)))
+	sess.lmu.Unlock()
+	if last {
+		sess.stop.Do(func() { close(sess.done) })
+		s.unregisterSession(sess)
+	}
+}
+
+// rekeyRetry is how long a REKEY goes unconfirmed before it is sent again.
+const rekeyRetry = time.Second
+
+// wake wakes the writer without blocking.
+func (sess *session) wake() {
+	select {
+	case sess.kick <- struct{}{}:
+	default:
+	}
+}
+
+// requestRekey wakes the writer when the epoch is due by what was received.
+func (s *Server) requestRekey(sess *session) {
+	if sess.rekey && sess.keys.RekeyDue(s.opts.RekeyInterval, s.opts.RekeyBytes) {
+		sess.wake()
+	}
+}
+
+// maybeRekey starts a new epoch once the current one is due. The new rx key
+// is installed before REKEY goes out, but records are sealed in the old
+// epoch until the client confirms, by REKEY_ACK or by sending in the new
+// one, so a lost REKEY only delays the switch; REKEY is repeated meanwhile.
+// Only the session's writer calls it.
+func (s *Server) maybeRekey(sess *session) {
+	if !sess.rekey {
+		return
+	}
+	if sess.keys.RekeyPending() {
+		if time.Since(sess.rekeySent) >= rekeyRetry {
+			sess.sendRekey()
+		}
+		return
+	}
+	if !sess.keys.RekeyDue(s.opts.RekeyInterval, s.opts.RekeyBytes) {
+		return
+	}
+	rk := protocol.Rekey{Epoch: sess.keys.Epoch() + 1}
+	nonce, err := crypto.RandomBytes(len(rk.Nonce))
+	if err != nil {
+		return
+	}
+	copy(rk.Nonce[:], nonce)
+	if err := sess.keys.BeginRekey(rk.Epoch, rk.Nonce[:]); err != nil {
+		log.Printf("rekey %s: %v", sess.peer.Name, err)
+		return
+	}
+	payload := append([]byte{protocol.CtrlRekey}, protocol.EncodeRekey(rk)...)
+	sess.rekeyMsg = protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload}
+	sess.sendRekey()
+}
+
+// sendRekey writes the pending REKEY on every link and has the writer woken
+// to repeat it should it stay unconfirmed.
+func (sess *session) sendRekey() {
+	sess.wmu.Lock()
+	sess.broadcast(sess.rekeyMsg, writeTimeout)
+	sess.wmu.Unlock()
+	sess.rekeySent = time.Now()
+	time.AfterFunc(rekeyRetry, sess.wake)
+}
+
+// SessionStats describes one live session.
+type SessionStats struct {
+	Peer      string
+	Session   [8]byte
+	IP        net.IP
+	Links     int
+	Queued    int    // data records waiting in the send queue
+	Dropped   uint64 // data records the send queue discarded
+	Batched   bool   // CapBatch granted; TxBatches and RxBatches are kept
+	TxBatches batch.Sizes
+	RxBatches batch.Sizes
+	crypto.Stats
+}
+
+// Stats returns counters for all live sessions.
+func (s *Server) Stats() []SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]SessionStats, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		out = append(out, SessionStats{Peer: sess.peer.Name, Session: sess.lease.Session, IP: sess.lease.IP, Links: int(sess.nlinks.Load()), Queued: sess.queue.Len(), Dropped: sess.queue.Drops(), Batched: sess.batch != nil, TxBatches: sess.txSizes.Sizes(), RxBatches: sess.rxSizes.Sizes(), Stats: sess.keys.Stats()})
+	}
+	return out
+}
+
+func (s *Server) sendError(conn transport.Conn, code uint16, reason string) {
 	payload := append([]byte{protocol.CtrlError}, protocol.EncodeClose(protocol.Close{Code: code, Reason: reason})...)
 	_ = protocol.WriteRecord(conn, protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: payload})
 }
 
-func ipv4Dest(pkt []byte) net.IP {
-	if len(pkt) < 20 {
-		return nil
+// addrKey is the sessions map key for an IPv4 address: its four bytes.
+func addrKey(ip net.IP) string {
+	return string(ip.To4())
+}
+
+// leaseTTL is how long an address stays leased after its session was last
+// seen alive; renewLeases refreshes live sessions well before that.
+const leaseTTL = 10 * time.Minute
+
+// renewLeases keeps the leases of live sessions from expiring, so their
+// addresses are never handed to another session.
+func (s *Server) renewLeases() {
+	for range time.Tick(leaseTTL / 4) {
+		for _, sess := range s.sessionsWhere(func(*session) bool { return true }) {
+			s.ipam.Renew(sess.lease.Session)
+		}
 	}
-	return net.IPv4(pkt[16], pkt[17], pkt[18], pkt[19])
 }
 
-func (s *Server) registerSession(sess *session) {
+// sameClient reports whether sess is an earlier session of the client with
+// session ID sid and static key pub, which a new one may replace.
+func (sess *session) sameClient(sid [8]byte, pub [32]byte) bool {
+	return sess.lease.Session == sid && sess.peer.PublicKey == pub
+}
+
+// leaseFree reports whether lease may go to peer: no live session of another
+// client holds its address. Session IDs are chosen by clients, so a lease
+// found by ID alone may belong to someone else. A lease that is not free is
+// left alone.
+func (s *Server) leaseFree(lease ipam.Lease, peer registry.Peer) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.sessions[sess.lease.IP.String()] = sess
+	old := s.sessions[addrKey(lease.IP)]
+	s.mu.Unlock()
+	if old == nil || old.sameClient(lease.Session, peer.PublicKey) {
+		return true
+	}
+	log.Printf("reject peer %s session %x: %s belongs to peer %s session %x", peer.Name, lease.Session, lease.IP, old.peer.Name, old.lease.Session)
+	if old.lease.Session != lease.Session {
+		s.ipam.Release(lease.Session)
+	}
+	return false
+}
+
+// release gives up the lease of a handshake that failed, unless a live
+// session holds it, e.g. the one a reconnecting client meant to replace.
+func (s *Server) release(sid [8]byte) {
+	if s.sessionByID(sid) == nil {
+		s.ipam.Release(sid)
+	}
+}
+
+// registerSession makes sess the owner of its address. A session it replaces
+// must be an earlier one of the same client, e.g. the one a client resumed
+// before noticing its old link died; it is closed. If the address belongs to
+// another client's session, nothing changes and registerSession reports false.
+func (s *Server) registerSession(sess *session) bool {
+	s.mu.Lock()
+	old := s.sessions[addrKey(sess.lease.IP)]
+	if old != nil && !old.sameClient(sess.lease.Session, sess.peer.PublicKey) {
+		s.mu.Unlock()
+		return false
+	}
+	s.sessions[addrKey(sess.lease.IP)] = sess
+	s.mu.Unlock()
+	if old != nil && old != sess {
+		// Closing the links releases a write stalled on them; wmu is not
+		// needed and may be held by that write.
+		old.closing.Store(true)
+		for _, conn := range old.snapshot() {
+			conn.Close()
+		}
+	}
+	return true
 }
 
 func (s *Server) unregisterSession(sess *session) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.sessions, sess.lease.IP.String())
+	if s.sessions[addrKey(sess.lease.IP)] != sess {
+		return // superseded; the lease belongs to the new session
+	}
+	delete(s.sessions, addrKey(sess.lease.IP))
 	s.ipam.Release(sess.lease.Session)
 }
 
-func (s *Server) sessionByIP(ip string) *session {
+func (s *Server) sessionByID(id [8]byte) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.lease.Session == id {
+			return sess
+		}
+	}
+	return nil
+}
+
+// sessionByDest returns the session owning an IPv4 packet's destination.
+func (s *Server) sessionByDest(pkt []byte) *session {
+	if len(pkt) < 20 {
+		return nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.sessions[ip]
+	return s.sessions[string(pkt[16:20])]
 }
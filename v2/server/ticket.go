@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"nox-core/v2/crypto"
+)
+
+// ticketLen is the sealed state: ID(16) Expires(8) Session(8) Peer(32) IP(4)
+// MTU(2) Suite(1) Secret(32).
+const ticketLen = 16 + 8 + 8 + 32 + 4 + 2 + 1 + 32
+
+var errTicket = errors.New("invalid, expired or used ticket")
+
+// ticketState is what a resumption ticket restores.
+type ticketState struct {
+	ID      [16]byte
+	Expires time.Time
+	Session [8]byte
+	Peer    [32]byte // client static public key
+	IP      net.IP
+	MTU     int
+	Suite   crypto.Suite
+	Secret  []byte // the session's resume secret
+}
+
+// ticketJar seals resumption tickets under a key that lives as long as the
+// process, so a restart invalidates every outstanding ticket. Redeemed IDs
+// are remembered until the ticket would have expired, making each ticket
+// single-use.
+type ticketJar struct {
+	mu       sync.Mutex
+	aead     cipher.AEAD
+	lifetime time.Duration
+	used     map[[16]byte]time.Time
+	now      func() time.Time
+}
+
+func newTicketJar(lifetime time.Duration) (*ticketJar, error) {
+	key, err := crypto.RandomBytes(chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ticketJar{aead: aead, lifetime: lifetime, used: make(map[[16]byte]time.Time), now: time.Now}, nil
+}
+
+// Issue seals st with a fresh ID and the jar's lifetime.
+func (j *ticketJar) Issue(st ticketState) ([]byte, error) {
+	id, err := crypto.RandomBytes(len(st.ID))
+	if err != nil {
+		return nil, err
+	}
+	copy(st.ID[:], id)
+	st.Expires = j.now().Add(j.lifetime)
+
+	pt := make([]byte, 0, ticketLen)
+	pt = append(pt, st.ID[:]...)
+	pt = binary.BigEndian.AppendUint64(pt, uint64(st.Expires.Unix()))
+	pt = append(pt, st.Session[:]...)
+	pt = append(pt, st.Peer[:]...)
+	pt = append(pt, st.IP.To4()...)
+	pt = binary.BigEndian.AppendUint16(pt, uint16(st.MTU))
+	pt = append(pt, byte(st.Suite))
+	pt = append(pt, st.Secret...)
+	if len(pt) != ticketLen {
+		return nil, errors.New("ticket state incomplete")
+	}
+	nonce, err := crypto.RandomBytes(j.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return j.aead.Seal(nonce, nonce, pt, nil), nil
+}
+
+// Redeem opens a ticket and marks it used. It fails for tickets that were
+// not sealed by this jar, have expired or were redeemed before.
+func (j *ticketJar) Redeem(opaque []byte) (ticketState, error) {
+	ns := j.aead.NonceSize()
+	if len(opaque) != ns+ticketLen+j.aead.Overhead() {
+		return ticketState{}, errTicket
+	}
+	pt, err := j.aead.Open(nil, opaque[:ns], opaque[ns:], nil)
+	if err != nil {
+		return ticketState{}, errTicket
+	}
+	var st ticketState
+	copy(st.ID[:], pt[0:16])
+	st.Expires = time.Unix(int64(binary.BigEndian.Uint64(pt[16:24])), 0)
+	copy(st.Session[:], pt[24:32])
+	copy(st.Peer[:], pt[32:64])
+	st.IP = net.IPv4(pt[64], pt[65], pt[66], pt[67]).To4()
+	st.MTU = int(binary.BigEndian.Uint16(pt[68:70]))
+	st.Suite = crypto.Suite(pt[70])
+	st.Secret = pt[71:]
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	for id, exp := range j.used {
+		if !now.Before(exp) {
+			delete(j.used, id)
+		}
+	}
+	if _, ok := j.used[st.ID]; ok || !now.Before(st.Expires) {
+		return ticketState{}, errTicket
+	}
+	j.used[st.ID] = st.Expires
+	return st, nil
+}
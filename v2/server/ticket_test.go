@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"nox-core/v2/crypto"
+)
+
+func TestTicketJar(t *testing.T) {
+	now := time.Unix(1000, 0)
+	j, err := newTicketJar(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.now = func() time.Time { return now }
+
+	st := ticketState{Session: [8]byte{1}, Peer: [32]byte{2}, IP: net.IPv4(10, 8, 0, 5), MTU: 1380, Suite: crypto.SuiteAES256GCM, Secret: bytes.Repeat([]byte{3}, 32)}
+	opaque, err := j.Issue(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := j.Redeem(opaque)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Session != st.Session || got.Peer != st.Peer || !got.IP.Equal(st.IP) || got.MTU != 1380 || got.Suite != st.Suite || !bytes.Equal(got.Secret, st.Secret) {
+		t.Fatalf("redeemed %+v", got)
+	}
+	if _, err := j.Redeem(opaque); err == nil {
+		t.Fatal("ticket redeemed twice")
+	}
+
+	tampered, _ := j.Issue(st)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := j.Redeem(tampered); err == nil {
+		t.Fatal("tampered ticket accepted")
+	}
+	other, _ := newTicketJar(time.Hour)
+	if _, err := other.Redeem(tampered); err == nil {
+		t.Fatal("ticket accepted by another jar")
+	}
+
+	late, _ := j.Issue(st)
+	now = now.Add(time.Hour)
+	if _, err := j.Redeem(late); err == nil {
+		t.Fatal("expired ticket accepted")
+	}
+	if len(j.used) != 0 {
+		t.Fatalf("%d expired IDs kept", len(j.used))
+	}
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// In-memory listeners live in a process-wide namespace, so a test can run a
+// server and client over "mem://name" without sockets.
+var (
+	memMu        sync.Mutex
+	memListeners = make(map[string]*MemListener)
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// MemListener accepts connections dialled with MemDialer under its name.
+type MemListener struct {
+	name   string
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func ListenMem(name string) (*MemListener, error) {
+	memMu.Lock()
+	defer memMu.Unlock()
+	if _, dup := memListeners[name]; dup {
+		return nil, fmt.Errorf("mem://%s: address in use", name)
+	}
+	l := &MemListener{name: name, accept: make(chan net.Conn), done: make(chan struct{})}
+	memListeners[name] = l
+	return l, nil
+}
+
+func (l *MemListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *MemListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		memMu.Lock()
+		delete(memListeners, l.name)
+		memMu.Unlock()
+	})
+	return nil
+}
+
+func (l *MemListener) Addr() net.Addr { return memAddr(l.name) }
+
+// MemDialer connects to a MemListener through a synchronous net.Pipe.
+type MemDialer struct{}
+
+func (MemDialer) Dial(name string) (Conn, error) {
+	memMu.Lock()
+	l := memListeners[name]
+	memMu.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("mem://%s: connection refused", name)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("mem://%s: connection refused", name)
+	}
+}
@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"fmt"
+
+	"nox-core/pkg/proxy"
+)
+
+// WithProxy returns d set to reach servers through p. Only TCP-based
+// transports (tcp, tls, ws, wss) can be proxied; a nil p returns d as is.
+func WithProxy(d Dialer, p *proxy.Proxy) (Dialer, error) {
+	if p == nil {
+		return d, nil
+	}
+	switch d := d.(type) {
+	case TCPDialer:
+		d.Proxy = p
+		return d, nil
+	case TLSDialer:
+		d.Proxy = p
+		return d, nil
+	case WSDialer:
+		d.Proxy = p
+		return d, nil
+	}
+	return nil, fmt.Errorf("transport %T cannot use proxy %s", d, p)
+}
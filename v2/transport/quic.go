@@ -0,0 +1,416 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the ALPN protocol id of NOX over QUIC.
+const QUICALPN = "noxv2"
+
+// kindData mirrors protocol.KindData; the record's Kind byte follows the
+// 2-byte length and the Version byte.
+const kindData = 0x02
+
+const quicIdleTimeout = 60 * time.Second
+
+// addrCheckInterval is how often a QUIC client looks for a new local address.
+const addrCheckInterval = 2 * time.Second
+
+// quicPacketSize is the QUIC packet size used before path MTU discovery.
+const quicPacketSize = 1280
+
+// QUICMaxRecord is the largest record sent as a QUIC datagram: what fits one
+// packet of quicPacketSize after the short header (at most 21 bytes), the
+// AEAD tag and the DATAGRAM frame header. quic-go accepts larger datagrams
+// once discovery raises its estimate, but they are not reliably delivered,
+// so records are held to this size on every path and larger ones use the
+// stream.
+const QUICMaxRecord = quicPacketSize - 21 - 16 - 3
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:   true,
+		InitialPacketSize: quicPacketSize,
+		MaxIdleTimeout:    quicIdleTimeout,
+		KeepAlivePeriod:   quicIdleTimeout / 3,
+	}
+}
+
+// QUICConn carries control records on one reliable stream and data records
+// as unreliable QUIC datagrams. Data records too large for a datagram on the
+// current path fall back to the stream. The inner NOX handshake authenticates
+// the peers, so the QUIC TLS layer is not relied on for identity.
+type QUICConn struct {
+	qc     *quic.Conn
+	stream *quic.Stream
+	wmu    sync.Mutex
+	*inbox
+	once sync.Once
+
+	// Client side only: the UDP sockets of every path, for migration.
+	raddr      *net.UDPAddr
+	transports []*quic.Transport
+	localIP    net.IP
+	migrations atomic.Uint32
+
+	datagrams atomic.Uint64
+	fallbacks atomic.Uint64
+}
+
+// IsQUIC reports whether conn runs over QUIC.
+func IsQUIC(conn Conn) bool {
+	_, ok := conn.(*QUICConn)
+	return ok
+}
+
+func newQUICConn(qc *quic.Conn, stream *quic.Stream) *QUICConn {
+	c := &QUICConn{qc: qc, stream: stream, inbox: newInbox()}
+	go c.readStream()
+	go c.readDatagrams()
+	return c
+}
+
+func (c *QUICConn) readStream() {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(c.stream, hdr[:]); err != nil {
+			c.Close()
+			return
+		}
+		rec := make([]byte, 2+int(binary.BigEndian.Uint16(hdr[:])))
+		copy(rec, hdr[:])
+		if _, err := io.ReadFull(c.stream, rec[2:]); err != nil {
+			c.Close()
+			return
+		}
+		// Control records must not be dropped; block rather than lose them.
+		select {
+		case c.in <- datagram{b: rec}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *QUICConn) readDatagrams() {
+	for {
+		b, err := c.qc.ReceiveDatagram(context.Background())
+		if err != nil {
+			c.Close()
+			return
+		}
+		if validRecord(b) {
+			c.deliver(datagram{b: b})
+		}
+	}
+}
+
+func (c *QUICConn) Read(p []byte) (int, error) {
+	n, _, err := c.read(p)
+	return n, err
+}
+
+// Write sends one record: data records as a datagram when they fit, all
+// others on the stream.
+func (c *QUICConn) Write(p []byte) (int, error) {
+	if len(p) >= 4 && p[3] == kindData {
+		if len(p) <= QUICMaxRecord {
+			err := c.qc.SendDatagram(p)
+			if err == nil {
+				c.datagrams.Add(1)
+				return len(p), nil
+			}
+			var tooLarge *quic.DatagramTooLargeError
+			if !errors.As(err, &tooLarge) {
+				return 0, err
+			}
+		}
+		c.fallbacks.Add(1)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.stream.Write(p)
+}
+
+// Datagrams returns how many data records went out as datagrams and how many
+// had to fall back to the stream because the path MTU was too small.
+func (c *QUICConn) Datagrams() (sent, fallbacks uint64) {
+	return c.datagrams.Load(), c.fallbacks.Load()
+}
+
+func (c *QUICConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.qc.CloseWithError(0, "")
+		c.wmu.Lock()
+		transports := c.transports
+		c.transports = nil
+		c.wmu.Unlock()
+		for _, tr := range transports {
+			tr.Close()
+		}
+	})
+	return nil
+}
+
+func (c *QUICConn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *QUICConn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// Migrate moves the connection to a fresh UDP socket, as after the client's
+// address changed, and keeps the old socket until the connection closes.
+func (c *QUICConn) Migrate(ctx context.Context) error {
+	if c.raddr == nil {
+		return errors.New("quic: only the client can migrate")
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udp}
+	path, err := c.qc.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		return err
+	}
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		tr.Close()
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		tr.Close()
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		// Close already released the sockets it knew of.
+		tr.Close()
+		return net.ErrClosed
+	default:
+	}
+	c.transports = append(c.transports, tr)
+	c.migrations.Add(1)
+	return nil
+}
+
+// Migrations returns how many times the connection changed path.
+func (c *QUICConn) Migrations() uint32 {
+	return c.migrations.Load()
+}
+
+// watchAddress migrates whenever the local address used to reach the server
+// changes, e.g. when a laptop moves from Wi-Fi to LTE.
+func (c *QUICConn) watchAddress() {
+	t := time.NewTicker(addrCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		ip := localIPFor(c.raddr)
+		if ip == nil || ip.Equal(c.localIP) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := c.Migrate(ctx); err == nil {
+			c.localIP = ip
+		}
+		cancel()
+	}
+}
+
+// localIPFor returns the source address the kernel would pick for raddr.
+// Connecting a UDP socket sends nothing.
+func localIPFor(raddr *net.UDPAddr) net.IP {
+	probe, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).IP
+}
+
+// QUICDialer opens client QUIC connections.
+type QUICDialer struct {
+	Timeout time.Duration
+	TLS     *tls.Config // nil: no certificate verification, NOX authenticates the server
+}
+
+func (d QUICDialer) Dial(addr string) (Conn, error) {
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Second
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := d.TLS
+	if tlsConf == nil {
+		tlsConf = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICALPN}}
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	qc, err := tr.Dial(ctx, raddr, tlsConf, quicConfig())
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		tr.Close()
+		return nil, err
+	}
+	c := newQUICConn(qc, stream)
+	c.raddr = raddr
+	c.transports = []*quic.Transport{tr}
+	c.localIP = localIPFor(raddr)
+	go c.watchAddress()
+	return c, nil
+}
+
+// QUICListener accepts QUIC connections and hands them out once the client
+// has opened its control stream.
+type QUICListener struct {
+	ln     *quic.Listener
+	tr     *quic.Transport
+	accept chan *QUICConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// ListenQUIC listens on a UDP address. A nil cert generates a throwaway
+// self-signed one; clients do not verify it by default.
+func ListenQUIC(addr string, cert *tls.Certificate) (*QUICListener, error) {
+	if cert == nil {
+		c, err := selfSigned()
+		if err != nil {
+			return nil, err
+		}
+		cert = &c
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{*cert}, NextProtos: []string{QUICALPN}, MinVersion: tls.VersionTLS13}
+	ln, err := tr.Listen(tlsConf, quicConfig())
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	l := &QUICListener{ln: ln, tr: tr, accept: make(chan *QUICConn, 64), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *QUICListener) acceptLoop() {
+	for {
+		qc, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(qc.Context(), 10*time.Second)
+			defer cancel()
+			stream, err := qc.AcceptStream(ctx)
+			if err != nil {
+				qc.CloseWithError(0, "no control stream")
+				return
+			}
+			select {
+			case l.accept <- newQUICConn(qc, stream):
+			case <-l.done:
+				qc.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+func (l *QUICListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *QUICListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.ln.Close()
+		l.tr.Close()
+	})
+	return nil
+}
+
+func (l *QUICListener) Addr() net.Addr { return l.ln.Addr() }
+
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nox-core/v2/crypto"
+	"nox-core/v2/padding"
+	"nox-core/v2/protocol"
+)
+
+func quicPair(t *testing.T) (*QUICConn, *QUICConn) {
+	t.Helper()
+	ln, err := ListenQUIC("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	c, err := QUICDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	// The server only sees the connection once the stream carries a byte.
+	control := protocol.Frame{Version: protocol.Version, Kind: protocol.KindControl, Payload: []byte{protocol.CtrlHeartbeat}}
+	if err := protocol.WriteRecord(c, control); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+	sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if f, err := protocol.ReadRecord(sc); err != nil || f.Kind != protocol.KindControl {
+		t.Fatalf("control record: %v %v", err, f)
+	}
+	return c.(*QUICConn), sc.(*QUICConn)
+}
+
+func TestQUICDataAsDatagrams(t *testing.T) {
+	c, sc := quicPair(t)
+	if err := protocol.WriteRecord(c, record(5)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.ReadRecord(sc)
+	if err != nil || f.Kind != protocol.KindData || f.Payload[0] != 5 {
+		t.Fatalf("data record: %v %v", err, f)
+	}
+	if sent, fallbacks := c.Datagrams(); sent != 1 || fallbacks != 0 {
+		t.Fatalf("datagrams %d, fallbacks %d", sent, fallbacks)
+	}
+
+	big := protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: make([]byte, 4000)}
+	if err := protocol.WriteRecord(c, big); err != nil {
+		t.Fatal(err)
+	}
+	f, err = protocol.ReadRecord(sc)
+	if err != nil || len(f.Payload) != 4000 {
+		t.Fatalf("oversized record: %v %d", err, len(f.Payload))
+	}
+	if _, fallbacks := c.Datagrams(); fallbacks != 1 {
+		t.Fatalf("oversized record did not fall back to the stream")
+	}
+}
+
+func TestQUICDatagramsAtTunnelMTU(t *testing.T) {
+	c, sc := quicPair(t)
+	// A full-size packet of the largest MTU a QUIC session negotiates.
+	mtu := QUICMaxRecord - protocol.RecordHeaderLen - crypto.DataOverhead - padding.TrailerLen
+	full := protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: make([]byte, mtu+crypto.DataOverhead+padding.TrailerLen)}
+	// Before path MTU discovery, and after it has had time to run.
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			full.Payload[0] = byte(i)
+			if err := protocol.WriteRecord(c, full); err != nil {
+				t.Fatal(err)
+			}
+			sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+			f, err := protocol.ReadRecord(sc)
+			if err != nil || len(f.Payload) != len(full.Payload) || f.Payload[0] != byte(i) {
+				t.Fatalf("round %d record %d: %v", round, i, err)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	if sent, fallbacks := c.Datagrams(); sent != 40 || fallbacks != 0 {
+		t.Fatalf("datagrams %d, fallbacks %d", sent, fallbacks)
+	}
+}
+
+func TestQUICMigrate(t *testing.T) {
+	c, sc := quicPair(t)
+	before := sc.RemoteAddr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteRecord(c, record(9)); err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if f, err := protocol.ReadRecord(sc); err != nil || f.Payload[0] != 9 {
+		t.Fatalf("after migration: %v %v", err, f)
+	}
+	if sc.RemoteAddr().String() == before {
+		t.Fatalf("server still sees %s", before)
+	}
+	if err := protocol.WriteRecord(sc, record(10)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if f, err := protocol.ReadRecord(c); err != nil || f.Payload[0] != 10 {
+		t.Fatalf("reply after migration: %v %v", err, f)
+	}
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// SourceDialer is implemented by dialers that can pin the local side of a
+// connection, so bonded links can leave through different interfaces.
+type SourceDialer interface {
+	Dialer
+	// DialFrom dials addr from source: a local IP address or an interface name.
+	DialFrom(source, addr string) (Conn, error)
+}
+
+// DialFrom dials addr with d, from source when it is not empty.
+func DialFrom(d Dialer, source, addr string) (Conn, error) {
+	if source == "" {
+		return d.Dial(addr)
+	}
+	sd, ok := d.(SourceDialer)
+	if !ok {
+		return nil, fmt.Errorf("transport %T cannot dial from %s", d, source)
+	}
+	return sd.DialFrom(source, addr)
+}
+
+// netDialer returns a net.Dialer bound to source for network ("tcp" or "udp").
+func netDialer(network, source string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if source == "" {
+		return d
+	}
+	if ip := net.ParseIP(source); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		return d
+	}
+	d.Control = func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = bindToDevice(fd, source) }); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("bind to %s: %w", source, err)
+		}
+		return nil
+	}
+	return d
+}
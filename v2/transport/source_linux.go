@@ -0,0 +1,9 @@
+//go:build linux
+
+package transport
+
+import "golang.org/x/sys/unix"
+
+func bindToDevice(fd uintptr, dev string) error {
+	return unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, dev)
+}
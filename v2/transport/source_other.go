@@ -0,0 +1,9 @@
+//go:build !linux
+
+package transport
+
+import "errors"
+
+func bindToDevice(fd uintptr, dev string) error {
+	return errors.New("binding to an interface is only supported on linux")
+}
@@ -3,18 +3,25 @@ package transport
 import (
 	"net"
 	"time"
+
+	"nox-core/pkg/proxy"
 )
 
-// TCPDialer dials TCP endpoints with timeouts.
+// TCPDialer dials TCP endpoints with timeouts, through Proxy when set.
 type TCPDialer struct {
 	Timeout time.Duration
+	Proxy   *proxy.Proxy
+}
+
+func (d TCPDialer) Dial(addr string) (Conn, error) {
+	return d.DialFrom("", addr)
 }
 
-func (d TCPDialer) Dial(addr string) (net.Conn, error) {
+func (d TCPDialer) DialFrom(source, addr string) (Conn, error) {
 	if d.Timeout == 0 {
 		d.Timeout = 10 * time.Second
 	}
-	return net.DialTimeout("tcp", addr, d.Timeout)
+	return d.Proxy.Dial(netDialer("tcp", source, d.Timeout), addr)
 }
 
 // TCPListener wraps net.Listener.
@@ -29,3 +36,7 @@ func ListenTCP(addr string) (*TCPListener, error) {
 	}
 	return &TCPListener{Listener: ln}, nil
 }
+
+func (l *TCPListener) Accept() (Conn, error) {
+	return l.Listener.Accept()
+}
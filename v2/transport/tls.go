@@ -0,0 +1,209 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultALPN is offered and accepted when the address sets no alpn option.
+const defaultALPN = "http/1.1"
+
+// splitQuery separates "host:port?opts" into the address and its options.
+func splitQuery(addr string) (string, url.Values, error) {
+	host, query, _ := strings.Cut(addr, "?")
+	q, err := url.ParseQuery(query)
+	return host, q, err
+}
+
+func alpnList(q url.Values) []string {
+	if v := q.Get("alpn"); v != "" {
+		return strings.Split(v, ",")
+	}
+	return []string{defaultALPN}
+}
+
+// loadCert reads the cert= and key= options, or makes up a self-signed
+// certificate when both are absent.
+func loadCert(q url.Values) (tls.Certificate, error) {
+	if q.Get("cert") == "" && q.Get("key") == "" {
+		return selfSigned()
+	}
+	return tls.LoadX509KeyPair(q.Get("cert"), q.Get("key"))
+}
+
+// CertPins returns the pins of a DER certificate in the form the pin option
+// takes: "spki:<sha256-hex>" survives re-issuing with the same key,
+// "cert:<sha256-hex>" matches this certificate only.
+func CertPins(der []byte) ([]string, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	whole := sha256.Sum256(der)
+	return []string{"spki:" + hex.EncodeToString(spki[:]), "cert:" + hex.EncodeToString(whole[:])}, nil
+}
+
+type pin struct {
+	spki bool
+	hash []byte
+}
+
+func parsePins(values []string) ([]pin, error) {
+	var pins []pin
+	for _, v := range values {
+		kind, h, _ := strings.Cut(v, ":")
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != sha256.Size || (kind != "spki" && kind != "cert") {
+			return nil, fmt.Errorf("tls: bad pin %q, want spki:<sha256-hex> or cert:<sha256-hex>", v)
+		}
+		pins = append(pins, pin{spki: kind == "spki", hash: b})
+	}
+	return pins, nil
+}
+
+// verifyPins accepts the server if its leaf certificate matches any pin.
+// Pinning replaces CA validation, so self-signed certificates work.
+func verifyPins(pins []pin) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("tls: no server certificate")
+		}
+		cert, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return err
+		}
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		whole := sha256.Sum256(raw[0])
+		for _, p := range pins {
+			if p.spki && bytes.Equal(p.hash, spki[:]) || !p.spki && bytes.Equal(p.hash, whole[:]) {
+				return nil
+			}
+		}
+		return errors.New("tls: server certificate matches no pin")
+	}
+}
+
+// applyPins makes conf accept only a server certificate matching one of the
+// pin= options. Without pins the address must opt out of the check with
+// insecure=1, which is logged: the NOX handshake still authenticates the
+// server, but anyone can then terminate the TLS layer.
+func applyPins(conf *tls.Config, q url.Values, addr string) error {
+	pins, err := parsePins(q["pin"])
+	if err != nil {
+		return err
+	}
+	conf.InsecureSkipVerify = true
+	switch {
+	case len(pins) > 0:
+		conf.VerifyPeerCertificate = verifyPins(pins)
+	case q.Get("insecure") == "1":
+		log.Printf("%s: insecure=1, server certificate not checked", addr)
+	default:
+		return errors.New("tls: no pin= for the server certificate; set insecure=1 to skip the check")
+	}
+	return nil
+}
+
+// TLSDialer runs TCPDialer connections through TLS 1.3. Options come from the
+// address query:
+//
+//	sni=name        server name to send (default: the host)
+//	pin=kind:hash   accepted server certificate, repeatable; see CertPins
+//	insecure=1      accept any certificate when there is no pin
+//	alpn=a,b        protocols to offer (default http/1.1)
+//
+// One of pin= or insecure=1 is required.
+type TLSDialer struct {
+	TCPDialer
+}
+
+func (d TLSDialer) Dial(addr string) (Conn, error) {
+	return d.DialFrom("", addr)
+}
+
+func (d TLSDialer) DialFrom(source, addr string) (Conn, error) {
+	host, q, err := splitQuery(addr)
+	if err != nil {
+		return nil, err
+	}
+	sni := q.Get("sni")
+	if sni == "" {
+		if sni, _, err = net.SplitHostPort(host); err != nil {
+			return nil, err
+		}
+	}
+	conf := &tls.Config{
+		ServerName: sni,
+		NextProtos: alpnList(q),
+		MinVersion: tls.VersionTLS13,
+	}
+	if err := applyPins(conf, q, host); err != nil {
+		return nil, err
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Second
+	}
+	raw, err := d.TCPDialer.DialFrom(source, host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, conf)
+	raw.SetDeadline(time.Now().Add(d.Timeout))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// TLSListener terminates TLS 1.3 on accepted TCP connections. The handshake
+// runs on the first read, under the server's handshake deadline.
+type TLSListener struct {
+	*TCPListener
+	conf *tls.Config
+}
+
+// ListenTLS listens on "host:port?opts". Options:
+//
+//	cert=file, key=file   PEM certificate and key (default: self-signed)
+//	alpn=a,b              protocols to accept (default http/1.1)
+func ListenTLS(addr string) (*TLSListener, error) {
+	host, q, err := splitQuery(addr)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCert(q)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := ListenTCP(host)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   alpnList(q),
+		MinVersion:   tls.VersionTLS13,
+	}
+	return &TLSListener{TCPListener: ln, conf: conf}, nil
+}
+
+func (l *TLSListener) Accept() (Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.conf), nil
+}
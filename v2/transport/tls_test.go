@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nox-core/v2/protocol"
+)
+
+// writeCert stores a self-signed pair under dir and returns its pins.
+func writeCert(t *testing.T, dir string) (certPath, keyPath string, pins []string) {
+	t.Helper()
+	cert, err := selfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if pins, err = CertPins(cert.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, pins
+}
+
+func TestTLSPinning(t *testing.T) {
+	certPath, keyPath, pins := writeCert(t, t.TempDir())
+	ln, err := Listen("tls://127.0.0.1:0?alpn=h2&cert=" + certPath + "&key=" + keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(2 * time.Second))
+				if f, err := protocol.ReadRecord(c); err == nil {
+					protocol.WriteRecord(c, f)
+				}
+			}()
+		}
+	}()
+
+	base := "tls://" + ln.Addr().String() + "?alpn=h2&sni=www.example.com"
+	for _, p := range pins {
+		c, err := Dial(base + "&pin=" + p)
+		if err != nil {
+			t.Fatalf("pin %s: %v", p, err)
+		}
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		protocol.WriteRecord(c, record(3))
+		if f, err := protocol.ReadRecord(c); err != nil || f.Payload[0] != 3 {
+			t.Fatalf("echo: %v %v", err, f.Payload)
+		}
+		c.Close()
+	}
+
+	wrong := "spki:" + strings.Repeat("00", 32)
+	if _, err := Dial(base + "&pin=" + wrong); err == nil || !strings.Contains(err.Error(), "no pin") {
+		t.Fatalf("wrong pin: %v", err)
+	}
+	// Any matching pin is enough, so a new key can be pinned before rotation.
+	c, err := Dial(base + "&pin=" + wrong + "&pin=" + pins[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := Dial(base + "&pin=sha1:abc"); err == nil {
+		t.Fatal("malformed pin accepted")
+	}
+	// No pin is an error unless the check is skipped explicitly.
+	if _, err := Dial(base); err == nil {
+		t.Fatal("unpinned dial accepted")
+	}
+	c, err = Dial(base + "&insecure=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
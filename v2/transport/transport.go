@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Conn is a connection carrying v2 records. Stream transports deliver them
+// as a byte stream; see DatagramConn for the datagram variant.
+type Conn interface {
+	net.Conn
+}
+
+// Listener accepts inbound connections for a server.
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// Dialer opens client connections.
+type Dialer interface {
+	Dial(addr string) (Conn, error)
+}
+
+// ListenFunc opens a listener on a scheme-specific address.
+type ListenFunc func(addr string) (Listener, error)
+
+type scheme struct {
+	listen ListenFunc
+	dialer Dialer
+}
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = make(map[string]scheme)
+)
+
+// DefaultScheme is assumed for addresses without a "scheme://" prefix.
+const DefaultScheme = "tcp"
+
+// Register makes a transport available under scheme, e.g. "tcp" for
+// "tcp://host:port". It panics if the scheme is already taken.
+func Register(name string, listen ListenFunc, dialer Dialer) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if _, dup := schemes[name]; dup {
+		panic("transport: duplicate scheme " + name)
+	}
+	schemes[name] = scheme{listen: listen, dialer: dialer}
+}
+
+// Schemes lists the registered scheme names.
+func Schemes() []string {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	out := make([]string, 0, len(schemes))
+	for name := range schemes {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Split separates "scheme://addr" into its parts; a bare address belongs to
+// DefaultScheme.
+func Split(address string) (name, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return DefaultScheme, address
+}
+
+func lookup(address string) (scheme, string, error) {
+	name, addr := Split(address)
+	schemesMu.RLock()
+	s, ok := schemes[name]
+	schemesMu.RUnlock()
+	if !ok {
+		return scheme{}, "", fmt.Errorf("transport: unknown scheme %q in %q", name, address)
+	}
+	return s, addr, nil
+}
+
+// Listen opens a listener for a "scheme://addr" address.
+func Listen(address string) (Listener, error) {
+	s, addr, err := lookup(address)
+	if err != nil {
+		return nil, err
+	}
+	return s.listen(addr)
+}
+
+// Resolve returns the dialer registered for address's scheme and the address
+// to pass to it.
+func Resolve(address string) (Dialer, string, error) {
+	s, addr, err := lookup(address)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.dialer, addr, nil
+}
+
+// Dial connects to a "scheme://addr" address.
+func Dial(address string) (Conn, error) {
+	d, addr, err := Resolve(address)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial(addr)
+}
+
+func init() {
+	Register("tcp", func(addr string) (Listener, error) { return ListenTCP(addr) }, TCPDialer{})
+	Register("tls", func(addr string) (Listener, error) { return ListenTLS(addr) }, TLSDialer{})
+	Register("udp", func(addr string) (Listener, error) { return ListenUDP(addr) }, UDPDialer{})
+	Register("quic", func(addr string) (Listener, error) { return ListenQUIC(addr, nil) }, QUICDialer{})
+	Register("ws", func(addr string) (Listener, error) { return ListenWS(addr, false) }, WSDialer{})
+	Register("wss", func(addr string) (Listener, error) { return ListenWS(addr, true) }, WSDialer{Secure: true})
+	Register("unix", func(addr string) (Listener, error) { return ListenUnix(addr) }, UnixDialer{})
+	Register("mem", func(addr string) (Listener, error) { return ListenMem(addr) }, MemDialer{})
+}
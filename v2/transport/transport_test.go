@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nox-core/pkg/proxy"
+	"nox-core/v2/protocol"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct{ in, scheme, addr string }{
+		{"1.2.3.4:9000", "tcp", "1.2.3.4:9000"},
+		{"udp://[::1]:9000", "udp", "[::1]:9000"},
+		{"unix:///run/nox.sock", "unix", "/run/nox.sock"},
+		{"mem://srv", "mem", "srv"},
+	}
+	for _, c := range cases {
+		if s, a := Split(c.in); s != c.scheme || a != c.addr {
+			t.Errorf("Split(%q) = %q, %q", c.in, s, a)
+		}
+	}
+	if _, err := Listen("carrier-pigeon://x"); err == nil {
+		t.Fatalf("unknown scheme accepted")
+	}
+}
+
+// roundTrip echoes a record over address; dialOpts is the query the client
+// dials with.
+func roundTrip(t *testing.T, address, dialOpts string) {
+	t.Helper()
+	ln, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if f, err := protocol.ReadRecord(c); err == nil {
+			protocol.WriteRecord(c, f)
+		}
+	}()
+	scheme, _ := Split(address)
+	c, err := Dial(scheme + "://" + ln.Addr().String() + dialOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := protocol.WriteRecord(c, record(9)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.ReadRecord(c)
+	if err != nil || f.Payload[0] != 9 {
+		t.Fatalf("%s echo: %v %v", address, err, f.Payload)
+	}
+}
+
+func TestSchemesRoundTrip(t *testing.T) {
+	roundTrip(t, "mem://echo", "")
+	roundTrip(t, "unix://"+filepath.Join(t.TempDir(), "nox.sock"), "")
+	roundTrip(t, "tcp://127.0.0.1:0", "")
+	roundTrip(t, "tls://127.0.0.1:0", "?insecure=1")
+	roundTrip(t, "ws://127.0.0.1:0", "")
+}
+
+func TestMemAddressInUse(t *testing.T) {
+	ln, err := Listen("mem://dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("mem://dup"); err == nil {
+		t.Fatalf("second listener on same name")
+	}
+	ln.Close()
+	if _, err := Dial("mem://dup"); err == nil {
+		t.Fatalf("dial after close succeeded")
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	ln, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := DialFrom(TCPDialer{}, "127.0.0.2", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := c.LocalAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+		t.Fatalf("dialled from %s", ip)
+	}
+	if _, err := DialFrom(MemDialer{}, "127.0.0.2", "x"); err == nil {
+		t.Fatal("mem transport accepted a source")
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	p, _ := proxy.Parse("socks5://127.0.0.1:1080")
+	d, err := WithProxy(TLSDialer{}, p)
+	if err != nil || d.(TLSDialer).Proxy != p {
+		t.Fatalf("tls: %v %v", d, err)
+	}
+	if _, err := WithProxy(QUICDialer{}, p); err == nil {
+		t.Fatal("quic accepted a proxy")
+	}
+	if d, err := WithProxy(UDPDialer{}, nil); err != nil || d != (UDPDialer{}) {
+		t.Fatalf("nil proxy: %v %v", d, err)
+	}
+}
@@ -0,0 +1,470 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// CIDLen is the size of the connection ID that prefixes every UDP datagram.
+const CIDLen = 8
+
+// HandshakeRTO is the initial handshake retransmission timeout on datagram
+// transports; it doubles on every retransmit.
+const HandshakeRTO = 250 * time.Millisecond
+
+// udpQueue bounds the datagrams buffered per connection before new ones are
+// dropped, as the network would.
+const udpQueue = 256
+
+// maxDatagram is a connection ID and the largest record.
+const maxDatagram = CIDLen + 2 + 65535
+
+// datagramPool holds maxDatagram buffers for sending and receiving, so the
+// UDP data path does not allocate per record.
+var datagramPool = sync.Pool{New: func() any {
+	b := make([]byte, maxDatagram)
+	return &b
+}}
+
+// DatagramConn is a connection that carries every record in its own datagram,
+// without delivery or ordering guarantees.
+type DatagramConn interface {
+	Conn
+	// ConfirmPeer makes replies follow the source address of the last record
+	// read. Call it once that record has authenticated.
+	ConfirmPeer()
+}
+
+// IsDatagram reports whether conn may lose or reorder records.
+func IsDatagram(conn Conn) bool {
+	_, ok := conn.(DatagramConn)
+	return ok
+}
+
+type datagram struct {
+	b    []byte
+	from net.Addr
+	buf  *[]byte // pooled buffer holding b, returned once b is read; may be nil
+}
+
+// UDPConn is one connection ID's view of a UDP socket. Each Write must hold
+// exactly one length-prefixed record; Read returns the records of successive
+// datagrams as a byte stream, so the record reader works unchanged.
+type UDPConn struct {
+	cid   [CIDLen]byte
+	pc    net.PacketConn
+	ln    *UDPListener // nil on the dialing side
+	local net.Addr
+
+	mu    sync.Mutex
+	raddr net.Addr
+	from  net.Addr // source of the datagram being read
+
+	*inbox
+	once sync.Once
+
+	// Listener side, owned by the listener's read loop: the last source
+	// address seen, so an unchanged one is not converted again.
+	lastFrom netip.AddrPort
+	lastAddr net.Addr
+}
+
+func newUDPConn(cid [CIDLen]byte, pc net.PacketConn, raddr net.Addr) *UDPConn {
+	return &UDPConn{
+		cid:   cid,
+		pc:    pc,
+		local: pc.LocalAddr(),
+		raddr: raddr,
+		from:  raddr,
+		inbox: newInbox(),
+	}
+}
+
+// CID returns the connection ID.
+func (c *UDPConn) CID() [CIDLen]byte {
+	return c.cid
+}
+
+func (c *UDPConn) Read(p []byte) (int, error) {
+	n, from, err := c.read(p)
+	if from != nil {
+		c.mu.Lock()
+		c.from = from
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *UDPConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if CIDLen+len(p) > maxDatagram {
+		return 0, errors.New("udp: record too large")
+	}
+	buf := datagramPool.Get().(*[]byte)
+	defer datagramPool.Put(buf)
+	b := (*buf)[:CIDLen+len(p)]
+	copy(b, c.cid[:])
+	copy(b[CIDLen:], p)
+	var err error
+	if c.ln == nil {
+		_, err = c.pc.(*net.UDPConn).Write(b)
+	} else {
+		_, err = c.pc.WriteTo(b, c.RemoteAddr())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ConfirmPeer implements DatagramConn.
+func (c *UDPConn) ConfirmPeer() {
+	c.mu.Lock()
+	c.raddr = c.from
+	c.mu.Unlock()
+}
+
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		if c.ln != nil {
+			c.ln.forget(c.cid)
+		} else {
+			c.pc.Close()
+		}
+	})
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr { return c.local }
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raddr
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op: datagram writes do not wait for the peer.
+func (c *UDPConn) SetWriteDeadline(time.Time) error { return nil }
+
+// UDPDialer opens client UDP connections with a fresh connection ID.
+type UDPDialer struct{}
+
+func (d UDPDialer) Dial(addr string) (Conn, error) {
+	return d.DialFrom("", addr)
+}
+
+func (UDPDialer) DialFrom(source, addr string) (Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := netDialer("udp", source, 10*time.Second).Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	pc := nc.(*net.UDPConn)
+	var cid [CIDLen]byte
+	if _, err := rand.Read(cid[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	c := newUDPConn(cid, pc, raddr)
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *UDPConn) readLoop() {
+	buf := datagramPool.Get().(*[]byte)
+	for {
+		n, err := c.pc.(*net.UDPConn).Read(*buf)
+		if err != nil {
+			datagramPool.Put(buf)
+			c.Close()
+			return
+		}
+		cid, rec, ok := splitDatagram((*buf)[:n])
+		if !ok || cid != c.cid {
+			continue
+		}
+		// The reader returns the buffer to the pool once it has read rec.
+		c.deliver(datagram{b: rec, from: c.raddr, buf: buf})
+		buf = datagramPool.Get().(*[]byte)
+	}
+}
+
+// Gate screens the first record of an unseen connection ID before a
+// listener keeps any state for it. It returns whether to admit the
+// connection and, if not nil, a record to answer the datagram with.
+type Gate func(from net.Addr, rec []byte) (admit bool, reply []byte)
+
+// Gated is a listener that takes a Gate.
+type Gated interface {
+	SetGate(g Gate)
+}
+
+// UDPListener serves many connections over one UDP socket, demultiplexed by
+// the connection ID in front of every datagram rather than by source address,
+// so a client keeps its session across NAT rebinding.
+type UDPListener struct {
+	pc     net.PacketConn
+	mu     sync.Mutex
+	conns  map[[CIDLen]byte]*UDPConn
+	gate   Gate
+	accept chan *UDPConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func ListenUDP(addr string) (*UDPListener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln := &UDPListener{
+		pc:     pc,
+		conns:  make(map[[CIDLen]byte]*UDPConn),
+		accept: make(chan *UDPConn, 64),
+		done:   make(chan struct{}),
+	}
+	go ln.readLoop()
+	return ln, nil
+}
+
+// Accept returns the connection for the next unseen connection ID.
+func (l *UDPListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *UDPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.pc.Close()
+		l.mu.Lock()
+		conns := l.conns
+		l.conns = make(map[[CIDLen]byte]*UDPConn)
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (l *UDPListener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// SetGate implements Gated; g applies to connection IDs seen from now on.
+func (l *UDPListener) SetGate(g Gate) {
+	l.mu.Lock()
+	l.gate = g
+	l.mu.Unlock()
+}
+
+func (l *UDPListener) readLoop() {
+	pc := l.pc.(*net.UDPConn)
+	buf := datagramPool.Get().(*[]byte)
+	for {
+		n, ap, err := pc.ReadFromUDPAddrPort(*buf)
+		if err != nil {
+			datagramPool.Put(buf)
+			l.Close()
+			return
+		}
+		cid, rec, ok := splitDatagram((*buf)[:n])
+		if !ok {
+			continue
+		}
+		l.mu.Lock()
+		c, gate := l.conns[cid], l.gate
+		l.mu.Unlock()
+		var from net.Addr
+		if c != nil && c.lastFrom == ap {
+			from = c.lastAddr
+		} else {
+			from = net.UDPAddrFromAddrPort(ap)
+		}
+		if c == nil && gate != nil {
+			admit, reply := gate(from, rec)
+			if reply != nil {
+				out := append(make([]byte, 0, CIDLen+len(reply)), cid[:]...)
+				_, _ = l.pc.WriteTo(append(out, reply...), from)
+			}
+			if !admit {
+				continue
+			}
+		}
+		l.mu.Lock()
+		if c = l.conns[cid]; c == nil {
+			c = newUDPConn(cid, l.pc, from)
+			c.ln = l
+			select {
+			case l.accept <- c:
+				l.conns[cid] = c
+			default:
+				c = nil // backlog full; the client will retransmit
+			}
+		}
+		l.mu.Unlock()
+		if c != nil {
+			c.lastFrom, c.lastAddr = ap, from
+			// The reader returns the buffer to the pool once it has read rec.
+			c.deliver(datagram{b: rec, from: from, buf: buf})
+			buf = datagramPool.Get().(*[]byte)
+		}
+	}
+}
+
+func (l *UDPListener) forget(cid [CIDLen]byte) {
+	l.mu.Lock()
+	delete(l.conns, cid)
+	l.mu.Unlock()
+}
+
+// splitDatagram checks that a datagram is a connection ID followed by exactly
+// one length-prefixed record, so a truncated or padded datagram can never
+// desynchronise the record reader.
+func splitDatagram(b []byte) (cid [CIDLen]byte, rec []byte, ok bool) {
+	if len(b) < CIDLen+2 {
+		return cid, nil, false
+	}
+	copy(cid[:], b)
+	rec = b[CIDLen:]
+	return cid, rec, validRecord(rec)
+}
+
+// inbox presents whole records that arrive out of band, as datagrams or from
+// a helper goroutine, as the byte stream the record reader expects.
+type inbox struct {
+	in       chan datagram
+	buf      []byte
+	pooled   *[]byte // pool buffer behind buf, if any
+	deadline deadline
+	done     chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{in: make(chan datagram, udpQueue), deadline: makeDeadline(), done: make(chan struct{})}
+}
+
+// read fills p from the current record, waiting for the next one once it is
+// used up. from is the source of a newly started record, nil otherwise.
+func (b *inbox) read(p []byte) (n int, from net.Addr, err error) {
+	if len(b.buf) == 0 {
+		select {
+		case d := <-b.in:
+			b.buf, from, b.pooled = d.b, d.from, d.buf
+		case <-b.done:
+			return 0, nil, net.ErrClosed
+		case <-b.deadline.wait():
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+	}
+	n = copy(p, b.buf)
+	b.buf = b.buf[n:]
+	if len(b.buf) == 0 && b.pooled != nil {
+		datagramPool.Put(b.pooled)
+		b.pooled = nil
+	}
+	return n, from, nil
+}
+
+// deliver queues a record, dropping it if the reader has fallen behind.
+func (b *inbox) deliver(d datagram) {
+	select {
+	case b.in <- d:
+	case <-b.done:
+		d.release()
+	default:
+		d.release()
+	}
+}
+
+// release returns the pool buffer of a record that will not be read.
+func (d datagram) release() {
+	if d.buf != nil {
+		datagramPool.Put(d.buf)
+	}
+}
+
+// validRecord reports whether b is exactly one length-prefixed record.
+func validRecord(b []byte) bool {
+	return len(b) >= 2 && int(binary.BigEndian.Uint16(b))+2 == len(b)
+}
+
+// deadline is a resettable read deadline in the style of net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish closing cancel
+	}
+	d.timer = nil
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,282 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"nox-core/v2/protocol"
+)
+
+func record(b byte) protocol.Frame {
+	return protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: []byte{b}}
+}
+
+func TestUDPDemuxByCID(t *testing.T) {
+	ln, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := UDPDialer{}.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := protocol.WriteRecord(c, record(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	for i := 0; i < 2; i++ {
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		f, err := protocol.ReadRecord(sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sc.(*UDPConn).CID()
+		if clients[f.Payload[0]].(*UDPConn).CID() != want {
+			t.Fatalf("record %d delivered to wrong connection", f.Payload[0])
+		}
+		// Reply reaches only the matching client.
+		if err := protocol.WriteRecord(sc, record(f.Payload[0]+10)); err != nil {
+			t.Fatal(err)
+		}
+		c := clients[f.Payload[0]]
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r, err := protocol.ReadRecord(c)
+		if err != nil || r.Payload[0] != f.Payload[0]+10 {
+			t.Fatalf("reply: %v %v", err, r.Payload)
+		}
+	}
+}
+
+func TestUDPMalformedDropped(t *testing.T) {
+	ln, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := UDPDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	uc := c.(*UDPConn)
+	cid := uc.CID()
+	// Length prefix claims more than the datagram holds.
+	bad := append(cid[:], 0, 50, 1, 2, 3)
+	if _, err := uc.pc.(*net.UDPConn).Write(bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteRecord(c, record(7)); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := protocol.ReadRecord(sc)
+	if err != nil || !bytes.Equal(f.Payload, []byte{7}) {
+		t.Fatalf("got %v %v, want the well-formed record", err, f.Payload)
+	}
+}
+
+func TestUDPConfirmPeerFollowsRebind(t *testing.T) {
+	ln, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := UDPDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	protocol.WriteRecord(c, record(1))
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := protocol.ReadRecord(sc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same CID from a new socket, as after a NAT rebinding.
+	moved, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Close()
+	cid := c.(*UDPConn).CID()
+	var buf bytes.Buffer
+	protocol.WriteRecord(&buf, record(2))
+	if _, err := moved.WriteTo(append(cid[:], buf.Bytes()...), ln.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadRecord(sc); err != nil {
+		t.Fatal(err)
+	}
+	if sc.RemoteAddr().String() == moved.LocalAddr().String() {
+		t.Fatalf("address changed before ConfirmPeer")
+	}
+	sc.(DatagramConn).ConfirmPeer()
+	if sc.RemoteAddr().String() != moved.LocalAddr().String() {
+		t.Fatalf("remote %s, want %s", sc.RemoteAddr(), moved.LocalAddr())
+	}
+}
+
+// lossy drops the first n writes.
+type lossy struct {
+	net.Conn
+	n int
+}
+
+func (l *lossy) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		l.n--
+		return len(p), nil
+	}
+	return l.Conn.Write(p)
+}
+
+func TestRetransmitterRecoversLoss(t *testing.T) {
+	ln, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := UDPDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go func() {
+		sc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if f, err := protocol.ReadRecord(sc); err == nil {
+			protocol.WriteRecord(sc, record(f.Payload[0]+1))
+		}
+	}()
+
+	rt := protocol.NewRetransmitter(&lossy{Conn: c, n: 2}, 20*time.Millisecond, time.Now().Add(2*time.Second))
+	if err := rt.Send(record(41)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := rt.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Payload[0] != 42 || rt.Retransmits() != 2 {
+		t.Fatalf("reply %v after %d retransmits", f.Payload, rt.Retransmits())
+	}
+
+	rt = protocol.NewRetransmitter(c, 0, time.Now().Add(50*time.Millisecond))
+	if _, err := rt.Read(); err != protocol.ErrHandshakeTimeout {
+		t.Fatalf("reliable read: %v", err)
+	}
+}
+
+// udpPair returns a dialed UDP connection and the listener's side of it.
+func udpPair(t testing.TB) (Conn, Conn) {
+	t.Helper()
+	ln, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	c, err := UDPDialer{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := protocol.WriteRecord(c, record(0)); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+	if _, err := protocol.ReadRecord(sc); err != nil {
+		t.Fatal(err)
+	}
+	return c, sc
+}
+
+// udpRoundTrip sends rec from c to sc and back, reading each with its Reader.
+func udpRoundTrip(c, sc Conn, crd, srd *protocol.Reader, rec []byte) error {
+	if _, err := c.Write(rec); err != nil {
+		return err
+	}
+	if _, err := srd.Read(); err != nil {
+		return err
+	}
+	if _, err := sc.Write(rec); err != nil {
+		return err
+	}
+	_, err := crd.Read()
+	return err
+}
+
+// BenchmarkUDPRecordPath measures a data record over loopback UDP, client to
+// server and back; it reports 0 allocs/op.
+func BenchmarkUDPRecordPath(b *testing.B) {
+	for _, size := range []int{64, 512, 1400} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			c, sc := udpPair(b)
+			rec := make([]byte, protocol.RecordHeaderLen+size)
+			protocol.PutRecordHeader(rec, protocol.KindData)
+			crd, srd := protocol.NewReader(c), protocol.NewReader(sc)
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := udpRoundTrip(c, sc, crd, srd, rec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// raceEnabled is set by race_test.go; the race detector allocates on
+// channel and goroutine handoffs.
+var raceEnabled bool
+
+func TestUDPRecordPathAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+	c, sc := udpPair(t)
+	rec := make([]byte, protocol.RecordHeaderLen+1000)
+	protocol.PutRecordHeader(rec, protocol.KindData)
+	crd, srd := protocol.NewReader(c), protocol.NewReader(sc)
+	var err error
+	allocs := testing.AllocsPerRun(100, func() {
+		if e := udpRoundTrip(c, sc, crd, srd, rec); e != nil {
+			err = e
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocs != 0 {
+		t.Fatalf("%.1f allocs per round trip", allocs)
+	}
+}
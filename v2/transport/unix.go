@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// UnixDialer dials Unix stream sockets.
+type UnixDialer struct {
+	Timeout time.Duration
+}
+
+func (d UnixDialer) Dial(path string) (Conn, error) {
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Second
+	}
+	return net.DialTimeout("unix", path, d.Timeout)
+}
+
+// UnixListener wraps a Unix stream listener; the socket file is removed on Close.
+type UnixListener struct {
+	net.Listener
+}
+
+func ListenUnix(path string) (*UnixListener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &UnixListener{Listener: ln}, nil
+}
+
+func (l *UnixListener) Accept() (Conn, error) {
+	return l.Listener.Accept()
+}
@@ -0,0 +1,282 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"nox-core/pkg/proxy"
+)
+
+// decoyPage is what the WebSocket listener serves on every other path and to
+// plain HTTP requests on the tunnel path.
+const decoyPage = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>Welcome</h1><p>This site is under construction.</p></body>
+</html>
+`
+
+// WSConn carries one record per binary WebSocket message, so the tunnel looks
+// like an ordinary HTTPS WebSocket to middleboxes and proxies.
+type WSConn struct {
+	ws  *websocket.Conn
+	r   io.Reader // current message
+	wmu sync.Mutex
+	wdl atomic.Int64 // write deadline in Unix nanoseconds, 0 for none
+}
+
+func newWSConn(ws *websocket.Conn) *WSConn {
+	ws.SetReadLimit(2 + 65535)
+	return &WSConn{ws: ws}
+}
+
+func (c *WSConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			kind, r, err := c.ws.NextReader()
+			if err != nil {
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends p as one binary message; WriteRecord issues one Write per record.
+func (c *WSConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var deadline time.Time
+	if ns := c.wdl.Load(); ns != 0 {
+		deadline = time.Unix(0, ns)
+	}
+	c.ws.SetWriteDeadline(deadline)
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the connection, which releases a
+// Write blocked on a peer that stopped reading. WriteControl may run
+// alongside that Write and gives up after its own deadline, so Close never
+// waits on wmu.
+func (c *WSConn) Close() error {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *WSConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error { return c.ws.SetReadDeadline(t) }
+
+// SetWriteDeadline applies to later writes and to one in progress. It does
+// not wait for wmu: the deadline is handed to the next Write, and set on the
+// underlying connection directly for a Write that is already blocked.
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	c.wdl.Store(ns)
+	return c.ws.NetConn().SetWriteDeadline(t)
+}
+
+// parseWS reads "host:port/path?opts" as given after "ws://" or "wss://".
+func parseWS(addr string) (*url.URL, error) {
+	u, err := url.Parse("ws://" + addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// WSDialer opens WebSocket connections, over TLS when Secure is set.
+// Options come from the address query:
+//
+//	sni=name        TLS server name to send (default: the host)
+//	pin=kind:hash   accepted server certificate, repeatable; see CertPins
+//	insecure=1      accept any certificate when there is no pin
+//
+// Without TLS set, wss:// needs one of pin= or insecure=1, as for TLSDialer.
+type WSDialer struct {
+	Secure  bool
+	Timeout time.Duration
+	TLS     *tls.Config // nil: the pin= and insecure= options decide
+	Proxy   *proxy.Proxy
+}
+
+func (d WSDialer) Dial(addr string) (Conn, error) {
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Second
+	}
+	u, err := parseWS(addr)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	u.RawQuery = ""
+	dialer := websocket.Dialer{HandshakeTimeout: d.Timeout, NetDial: func(network, addr string) (net.Conn, error) {
+		return d.Proxy.Dial(&net.Dialer{Timeout: d.Timeout}, addr)
+	}}
+	if d.Secure {
+		u.Scheme = "wss"
+		tlsConf := &tls.Config{}
+		if d.TLS != nil {
+			tlsConf = d.TLS.Clone()
+		}
+		if sni := q.Get("sni"); sni != "" {
+			tlsConf.ServerName = sni
+		}
+		// A caller's TLS config verifies the server itself unless pins are given.
+		if d.TLS == nil || len(q["pin"]) > 0 {
+			if err := applyPins(tlsConf, q, u.Host); err != nil {
+				return nil, err
+			}
+		}
+		dialer.TLSClientConfig = tlsConf
+	}
+	ws, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket %s: %s", u.Redacted(), resp.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+// WSListener is an HTTP(S) server that upgrades requests on one path to
+// tunnel connections and serves a decoy page everywhere else.
+type WSListener struct {
+	ln     net.Listener
+	srv    *http.Server
+	path   string
+	decoy  []byte
+	accept chan *WSConn
+	done   chan struct{}
+	once   sync.Once
+	up     websocket.Upgrader
+}
+
+// ListenWS listens on "host:port/path?opts", over TLS when secure is set.
+// Options:
+//
+//	cert=file, key=file   PEM certificate and key (default: self-signed)
+//	decoy=file            page served off the tunnel path (default: a placeholder)
+func ListenWS(addr string, secure bool) (*WSListener, error) {
+	u, err := parseWS(addr)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	l := &WSListener{
+		path:   u.Path,
+		decoy:  []byte(decoyPage),
+		accept: make(chan *WSConn, 64),
+		done:   make(chan struct{}),
+		up: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     func(*http.Request) bool { return true },
+		},
+	}
+	if f := q.Get("decoy"); f != "" {
+		if l.decoy, err = os.ReadFile(f); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		cert, err := loadCert(q)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}})
+	}
+	l.ln = ln
+	l.srv = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		l.srv.Serve(ln)
+		l.Close()
+	}()
+	return l, nil
+}
+
+func (l *WSListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path || !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(l.decoy)
+		return
+	}
+	ws, err := l.up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case l.accept <- newWSConn(ws):
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+func (l *WSListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *WSListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.srv.Close()
+	})
+	return nil
+}
+
+func (l *WSListener) Addr() net.Addr { return l.ln.Addr() }
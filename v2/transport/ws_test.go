@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nox-core/v2/protocol"
+)
+
+func TestWSSRoundTrip(t *testing.T) {
+	ln, err := Listen("wss://127.0.0.1:0/nox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			f, err := protocol.ReadRecord(c)
+			if err != nil {
+				return
+			}
+			protocol.WriteRecord(c, f)
+		}
+	}()
+
+	if _, err := Dial("wss://" + ln.Addr().String() + "/other?insecure=1"); err == nil {
+		t.Fatal("dial on the decoy path succeeded")
+	}
+	if _, err := Dial("wss://" + ln.Addr().String() + "/nox"); err == nil {
+		t.Fatal("dial without pin or insecure=1 succeeded")
+	}
+	c, err := Dial("wss://" + ln.Addr().String() + "/nox?sni=cdn.example.com&insecure=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	for i := byte(0); i < 3; i++ {
+		if err := protocol.WriteRecord(c, record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := byte(0); i < 3; i++ {
+		f, err := protocol.ReadRecord(c)
+		if err != nil || f.Payload[0] != i {
+			t.Fatalf("echo %d: %v %v", i, err, f.Payload)
+		}
+	}
+}
+
+func TestWSDecoy(t *testing.T) {
+	ln, err := Listen("wss://127.0.0.1:0/nox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, path := range []string{"/", "/index.html", "/nox"} {
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Welcome") {
+			t.Fatalf("%s: %s %q", path, resp.Status, body)
+		}
+	}
+}
+
+func TestWSCloseReleasesBlockedWrite(t *testing.T) {
+	ln, err := Listen("ws://127.0.0.1:0/nox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := Dial("ws://" + ln.Addr().String() + "/nox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The server does not read, so the client's writes soon block.
+	if err := protocol.WriteRecord(c, record(1)); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	blocked := make(chan error, 1)
+	go func() {
+		big := protocol.Frame{Version: protocol.Version, Kind: protocol.KindData, Payload: make([]byte, 60000)}
+		for {
+			if err := protocol.WriteRecord(c, big); err != nil {
+				blocked <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close waited on the blocked Write")
+	}
+	select {
+	case <-blocked:
+	case <-time.After(3 * time.Second):
+		t.Fatal("blocked Write not released by Close")
+	}
+}
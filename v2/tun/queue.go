@@ -0,0 +1,15 @@
+package tun
+
+// Queue is one queue of a TUN device: a *coretun.Tun, or a coretun.Fake
+// standing in for one.
+type Queue interface {
+	ReadPacket(buf []byte) (int, error)
+	WritePacket(pkt []byte) (int, error) // header and packet, on a vnet TUN
+	WriteIP(pkt []byte) (int, error)     // a bare IP packet
+	Vnet() bool
+	Close() error
+}
+
+// Opener opens a TUN device for a configuration; Manager.Ensure is the real
+// one.
+type Opener func(Config) (*Device, error)
@@ -7,6 +7,7 @@ import (
 	"net"
 
 	coretun "nox-core/pkg/tun"
+	"nox-core/v2/offload"
 
 	"github.com/vishvananda/netlink"
 )
@@ -16,12 +17,33 @@ type Config struct {
 	Name string
 	CIDR *net.IPNet
 	MTU  int
+	// Queues is how many IFF_MULTI_QUEUE descriptors to open; 0 or 1 opens
+	// a plain single-queue device.
+	Queues int
+	// Offload opens the queues with virtio-net headers and TSO/USO, when the
+	// kernel has them.
+	Offload bool
 }
 
 // Device wraps the opened TUN and netlink link.
 type Device struct {
-	Tun  *coretun.Tun
-	Link netlink.Link
+	Tun    Queue   // the first queue
+	Queues []Queue // every queue, Tun included
+	Link   netlink.Link
+	// Offload holds the TUN_F_* offloads in effect; non-zero means every
+	// queue reads and writes packets behind a virtio-net header.
+	Offload uint
+}
+
+// Close closes every queue.
+func (d *Device) Close() error {
+	var first error
+	for _, q := range d.Queues {
+		if err := q.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 // Manager configures TUN interfaces via netlink.
@@ -29,7 +51,8 @@ type Manager struct{}
 
 func NewManager() *Manager { return &Manager{} }
 
-// Ensure recreates the TUN interface, assigns address/route, and returns an opened device.
+// Ensure recreates the TUN interface with cfg.Queues queues, assigns
+// address/route, and returns an opened device.
 func (m *Manager) Ensure(cfg Config) (*Device, error) {
 	if cfg.CIDR == nil || cfg.CIDR.IP.To4() == nil {
 		return nil, fmt.Errorf("cidr required")
@@ -42,35 +65,52 @@ func (m *Manager) Ensure(cfg Config) (*Device, error) {
 		_ = netlink.LinkDel(existing)
 	}
 
-	tunDev, err := coretun.Create(cfg.Name)
+	var queues []*coretun.Tun
+	var offloads uint
+	var err error
+	if cfg.Offload {
+		queues, offloads, err = coretun.CreateOffload(cfg.Name, cfg.Queues)
+	} else {
+		queues, err = coretun.CreateQueues(cfg.Name, cfg.Queues)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("create tun: %w", err)
 	}
+	dev := &Device{Tun: queues[0], Offload: offloads}
+	for _, q := range queues {
+		dev.Queues = append(dev.Queues, q)
+	}
 
 	link, err := netlink.LinkByName(cfg.Name)
 	if err != nil {
-		tunDev.Close()
+		dev.Close()
 		return nil, fmt.Errorf("link by name: %w", err)
 	}
 
 	if err := netlink.LinkSetMTU(link, cfg.MTU); err != nil {
-		tunDev.Close()
+		dev.Close()
 		return nil, fmt.Errorf("set mtu: %w", err)
 	}
+	if offloads != 0 {
+		// Keep superpackets within one record. Older kernels cannot change
+		// the limit; larger superpackets are then split before sealing.
+		_ = netlink.LinkSetGSOMaxSize(link, offload.MaxPacket)
+	}
 	if err := netlink.LinkSetUp(link); err != nil {
-		tunDev.Close()
+		dev.Close()
 		return nil, fmt.Errorf("link up: %w", err)
 	}
 	addr := &netlink.Addr{IPNet: cfg.CIDR}
 	if err := netlink.AddrReplace(link, addr); err != nil {
-		tunDev.Close()
+		dev.Close()
 		return nil, fmt.Errorf("addr add: %w", err)
 	}
 	route := &netlink.Route{LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: cfg.CIDR}
 	if err := netlink.RouteReplace(route); err != nil {
-		tunDev.Close()
+		dev.Close()
 		return nil, fmt.Errorf("route add: %w", err)
 	}
 
-	return &Device{Tun: tunDev, Link: link}, nil
+	dev.Link = link
+	return dev, nil
 }
@@ -8,13 +8,17 @@ import (
 )
 
 type Config struct {
-	Name string
-	CIDR *net.IPNet
-	MTU  int
+	Name    string
+	CIDR    *net.IPNet
+	MTU     int
+	Queues  int
+	Offload bool
 }
 
 type Device struct{}
 
+func (d *Device) Close() error { return nil }
+
 type Manager struct{}
 
 func NewManager() *Manager { return &Manager{} }